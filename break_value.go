@@ -21,8 +21,11 @@ var (
 // also more UTXOs and more tx fees.
 // breakValue should be a fairly low value that is the smallest UTXO you want created other than
 // the remainder.
+// No output is less than the dust limit of dustPolicy. Value that is too small for another output
+// is added to the last output.
 func BreakValue(value, breakValue uint64, addresses []AddressKeyID,
-	dustFeeRate, feeRate float32, lastIsRemainder bool, subtractFee bool) ([]*Output, error) {
+	dustPolicy DustPolicy, feeRate FeeRate, lastIsRemainder bool,
+	subtractFee bool) ([]*Output, error) {
 	// Choose random multiples of breakValue until the value is taken up.
 
 	// Find the average value to break the value into the provided addresses
@@ -58,6 +61,7 @@ func BreakValue(value, breakValue uint64, addresses []AddressKeyID,
 		}
 
 		outputFee, inputFee, _ := OutputTotalCost(lockingScript, feeRate)
+		dust := DustLimitForLockingScript(lockingScript, dustPolicy)
 
 		if subtractFee {
 			if remaining <= outputFee {
@@ -65,11 +69,11 @@ func BreakValue(value, breakValue uint64, addresses []AddressKeyID,
 			}
 			remaining -= outputFee
 
-			if remaining <= inputFee || remaining < breakValue {
+			if remaining <= inputFee || remaining < breakValue || remaining < dust {
 				remaining += outputFee // abort adding this output, so add the fee for it back in
 				break                  // remaining amount is less than dust required to include next address
 			}
-		} else if remaining <= inputFee || remaining < breakValue {
+		} else if remaining <= inputFee || remaining < breakValue || remaining < dust {
 			break // remaining amount is less than dust required to include next address
 		}
 
@@ -90,6 +94,10 @@ func BreakValue(value, breakValue uint64, addresses []AddressKeyID,
 				uint64(rand.Int63n(int64(outputValue/5)))
 		}
 
+		if outputValue < dust {
+			outputValue = dust
+		}
+
 		if outputValue > remaining {
 			outputValue = remaining
 		}
@@ -117,7 +125,8 @@ func BreakValue(value, breakValue uint64, addresses []AddressKeyID,
 	if subtractFee {
 		outputFee, inputFee, _ := OutputTotalCost(lockingScript, feeRate)
 
-		if remaining > outputFee+inputFee {
+		if remaining > outputFee+inputFee &&
+			remaining-outputFee >= DustLimitForLockingScript(lockingScript, dustPolicy) {
 			remaining -= outputFee
 
 			result = append(result, &Output{
@@ -138,7 +147,8 @@ func BreakValue(value, breakValue uint64, addresses []AddressKeyID,
 	} else {
 		_, inputFee, _ := OutputTotalCost(lockingScript, feeRate)
 
-		if remaining >= inputFee {
+		if remaining >= inputFee &&
+			remaining >= DustLimitForLockingScript(lockingScript, dustPolicy) {
 			result = append(result, &Output{
 				TxOut: wire.TxOut{
 					Value:         remaining,
@@ -164,8 +174,11 @@ func BreakValue(value, breakValue uint64, addresses []AddressKeyID,
 	return result, nil
 }
 
+// BreakValueLockingScripts is the same as BreakValue, but with locking scripts instead of
+// addresses.
 func BreakValueLockingScripts(value, breakValue uint64, lockingScripts []bitcoin.Script,
-	dustFeeRate, feeRate float32, lastIsRemainder bool, subtractFee bool) ([]*Output, error) {
+	dustPolicy DustPolicy, feeRate FeeRate, lastIsRemainder bool,
+	subtractFee bool) ([]*Output, error) {
 	// Choose random multiples of breakValue until the value is taken up.
 
 	// Find the average value to break the value into the provided lockingScripts
@@ -191,6 +204,7 @@ func BreakValueLockingScripts(value, breakValue uint64, lockingScripts []bitcoin
 	nextIndex := 0
 	for _, lockingScript := range lockingScripts[:len(lockingScripts)-1] {
 		outputFee, inputFee, _ := OutputTotalCost(lockingScript, feeRate)
+		dust := DustLimitForLockingScript(lockingScript, dustPolicy)
 
 		if subtractFee {
 			if remaining <= outputFee {
@@ -198,11 +212,11 @@ func BreakValueLockingScripts(value, breakValue uint64, lockingScripts []bitcoin
 			}
 			remaining -= outputFee
 
-			if remaining <= inputFee || remaining < breakValue {
+			if remaining <= inputFee || remaining < breakValue || remaining < dust {
 				remaining += outputFee // abort adding this output, so add the fee for it back in
 				break                  // remaining amount is less than dust required to include next address
 			}
-		} else if remaining <= inputFee || remaining < breakValue {
+		} else if remaining <= inputFee || remaining < breakValue || remaining < dust {
 			break // remaining amount is less than dust required to include next address
 		}
 
@@ -223,6 +237,10 @@ func BreakValueLockingScripts(value, breakValue uint64, lockingScripts []bitcoin
 				uint64(rand.Int63n(int64(outputValue/5)))
 		}
 
+		if outputValue < dust {
+			outputValue = dust
+		}
+
 		if outputValue > remaining {
 			outputValue = remaining
 		}
@@ -243,7 +261,8 @@ func BreakValueLockingScripts(value, breakValue uint64, lockingScripts []bitcoin
 	if subtractFee {
 		outputFee, inputFee, _ := OutputTotalCost(lockingScript, feeRate)
 
-		if remaining > outputFee+inputFee {
+		if remaining > outputFee+inputFee &&
+			remaining-outputFee >= DustLimitForLockingScript(lockingScript, dustPolicy) {
 			remaining -= outputFee
 
 			result = append(result, &Output{
@@ -263,7 +282,8 @@ func BreakValueLockingScripts(value, breakValue uint64, lockingScripts []bitcoin
 	} else {
 		_, inputFee, _ := OutputTotalCost(lockingScript, feeRate)
 
-		if remaining > inputFee {
+		if remaining > inputFee &&
+			remaining >= DustLimitForLockingScript(lockingScript, dustPolicy) {
 			result = append(result, &Output{
 				TxOut: wire.TxOut{
 					Value:         remaining,
@@ -10,8 +10,8 @@ import (
 )
 
 func Test_BreakValue(t *testing.T) {
-	feeRate := float32(1.0)
-	dustFeeRate := float32(1.0)
+	feeRate := FeeRate(1000)
+	dustFeeRate := FeeRate(1000)
 
 	changeAddresses := make([]AddressKeyID, 5)
 	for i := 0; i < len(changeAddresses); i++ {
@@ -44,10 +44,18 @@ func Test_BreakValue(t *testing.T) {
 		25000,
 		10000,
 		5000,
-		547,
+		580, // output fee plus dust
+		579,
 	}
 	breakValue := uint64(10000)
 
+	lockingScript, err := changeAddresses[0].Address.LockingScript()
+	if err != nil {
+		t.Fatalf("Failed to create locking script : %s", err)
+	}
+
+	outputFee, dustLimit := OutputFeeAndDustForLockingScript(lockingScript, dustFeeRate, feeRate)
+
 	for _, changeValue := range changeValues {
 		t.Logf("Testing BreakValue %d/%d", changeValue, breakValue)
 
@@ -61,7 +69,7 @@ func Test_BreakValue(t *testing.T) {
 		txfees := uint64(0)
 		for _, output := range outputs {
 			sum += output.TxOut.Value
-			txfees += uint64(float32(output.TxOut.SerializeSize()) * feeRate)
+			txfees += feeRate.Fee(output.TxOut.SerializeSize())
 			t.Logf("Output %d : %x", output.TxOut.Value, output.TxOut.LockingScript)
 		}
 
@@ -69,7 +77,7 @@ func Test_BreakValue(t *testing.T) {
 			t.Fatalf("Total output value too high : %d > %d", sum, changeValue)
 		}
 
-		if changeValue > 500 {
+		if changeValue >= outputFee+dustLimit {
 			if sum+txfees != changeValue {
 				t.Fatalf("Total output + fees is wrong : got %d, want %d", sum+txfees, changeValue)
 			}
@@ -85,8 +93,8 @@ func Test_BreakValue(t *testing.T) {
 }
 
 func Test_BreakValueNoFee(t *testing.T) {
-	feeRate := float32(0.0)
-	dustFeeRate := float32(1.0)
+	feeRate := FeeRate(0)
+	dustFeeRate := FeeRate(1000)
 
 	addresses := make([]AddressKeyID, 5)
 	for i := 0; i < len(addresses); i++ {
@@ -373,6 +381,64 @@ func Test_AddFundingBreakChange(t *testing.T) {
 	}
 }
 
+func Test_AddFundingBreakChange_AdjustFee(t *testing.T) {
+	changeAddresses := make([]AddressKeyID, 5)
+	for i := 0; i < len(changeAddresses); i++ {
+		changeAddresses[i] = AddressKeyID{Address: randomAddress()}
+	}
+
+	tx := NewTxBuilder(0.5, 0.25)
+
+	if err := tx.AddPaymentOutput(randomAddress(), 10000, false); err != nil {
+		t.Fatalf("Failed to add payment output : %s", err)
+	}
+
+	utxos := []bitcoin.UTXO{
+		{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         20000,
+			LockingScript: randomLockingScript(),
+		},
+	}
+
+	// A break value of 1100 keeps every break output below about 6300, so there are always at least
+	// two change outputs.
+	if err := tx.AddFundingBreakChange(utxos, 1100, changeAddresses); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	t.Logf(tx.String(bitcoin.MainNet))
+
+	if len(tx.Outputs) < 3 {
+		t.Fatalf("Wrong output count : got %d, want at least %d", len(tx.Outputs), 3)
+	}
+
+	largest := uint64(0)
+	for i, output := range tx.Outputs[1:] {
+		if !output.IsRemainder {
+			t.Fatalf("Change output %d is not a remainder", i+1)
+		}
+
+		if value := tx.MsgTx.TxOut[i+1].Value; value > largest {
+			largest = value
+		}
+	}
+
+	// No change output can cover the increase alone.
+	previousFee := tx.Fee()
+	amount := largest + 1
+	if _, err := tx.AdjustFee(int64(amount)); err != nil {
+		t.Fatalf("Failed to adjust fee : %s", err)
+	}
+
+	t.Logf(tx.String(bitcoin.MainNet))
+
+	if tx.Fee() != previousFee+amount {
+		t.Fatalf("Wrong fee : got %d, want %d", tx.Fee(), previousFee+amount)
+	}
+}
+
 func Test_AddFundingBreakChangeInitiallyFunded(t *testing.T) {
 	changeAddresses := make([]AddressKeyID, 5)
 	for i := 0; i < len(changeAddresses); i++ {
@@ -694,3 +760,28 @@ func Test_RandomizeOutputsAfter(t *testing.T) {
 		}
 	}
 }
+
+func Test_BreakValue_DustPolicy(t *testing.T) {
+	feeRate := FeeRate(500)
+	dustPolicy := FixedDustPolicy(20000)
+
+	addresses := make([]AddressKeyID, 5)
+	for i := 0; i < len(addresses); i++ {
+		addresses[i] = AddressKeyID{Address: randomAddress()}
+	}
+
+	for _, value := range []uint64{1000000, 100000, 50000, 25000} {
+		outputs, err := BreakValue(value, 1000, addresses, dustPolicy, feeRate, true, true)
+		if err != nil {
+			t.Fatalf("Failed to break value : %s", err)
+		}
+
+		for _, output := range outputs {
+			t.Logf("Output %d : %x", output.TxOut.Value, output.TxOut.LockingScript)
+			if output.TxOut.Value < uint64(dustPolicy) {
+				t.Fatalf("Output below dust : got %d, want at least %d", output.TxOut.Value,
+					dustPolicy)
+			}
+		}
+	}
+}
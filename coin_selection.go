@@ -0,0 +1,431 @@
+package txbuilder
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultBranchAndBoundTries is the maximum number of branches searched by the branch and bound
+	// coin selector when MaxTries isn't specified.
+	DefaultBranchAndBoundTries = 100000
+)
+
+// CoinSelector chooses which UTXOs are used to fund a tx and the order they are added in.
+type CoinSelector interface {
+	// SelectCoins returns the UTXOs that should be used to fund the tx in the order that they
+	// should be added. target is the value needed to fund the tx not including the fees for the
+	// inputs that will be added to spend the UTXOs.
+	SelectCoins(utxos []bitcoin.UTXO, target uint64, feeRate FeeRate) (*CoinSelection, error)
+}
+
+// SelectedCoin is a UTXO chosen by a CoinSelector and the reason it was chosen.
+type SelectedCoin struct {
+	UTXO   bitcoin.UTXO `json:"utxo"`
+	Reason string       `json:"reason"`
+}
+
+// CoinSelection is the result of a CoinSelector. It is retained by the TxBuilder after funding so
+// the selection decisions can be logged.
+// Skipped contains the UTXOs that were not considered because they cost more to spend than they
+// are worth at the current fee rate. They can be consolidated later when fee rates are lower.
+type CoinSelection struct {
+	Strategy string          `json:"strategy"`
+	Coins    []*SelectedCoin `json:"coins"`
+	Skipped  []*SelectedCoin `json:"skipped,omitempty"`
+}
+
+// InOrderSelector selects UTXOs in the order they were provided. This is the default.
+type InOrderSelector struct{}
+
+// LargestFirstSelector selects the highest value UTXOs first.
+type LargestFirstSelector struct{}
+
+// SmallestFirstSelector selects the lowest value UTXOs first.
+type SmallestFirstSelector struct{}
+
+// OldestFirstSelector selects UTXOs confirmed in the earliest blocks first. UTXOs without a known
+// block height are treated as unconfirmed and selected last in the order they were provided.
+type OldestFirstSelector struct {
+	// BlockHeights contains the height of the block that confirmed each tx, keyed by txid.
+	BlockHeights map[bitcoin.Hash32]uint32
+}
+
+// RandomSelector selects UTXOs in a random order.
+type RandomSelector struct{}
+
+// BranchAndBoundSelector searches for a subset of the UTXOs that exactly funds the target so that
+// no change output is needed. The effective value (value minus the fee to spend it) of the subset
+// must be at least the target and no more than the target plus the tolerance.
+type BranchAndBoundSelector struct {
+	Tolerance uint64
+	MaxTries  int // Defaults to DefaultBranchAndBoundTries
+}
+
+// UTXOs returns the selected UTXOs in order.
+func (s CoinSelection) UTXOs() []bitcoin.UTXO {
+	result := make([]bitcoin.UTXO, len(s.Coins))
+	for i, coin := range s.Coins {
+		result[i] = coin.UTXO
+	}
+	return result
+}
+
+// SkippedUTXOs returns the UTXOs that were skipped because they are uneconomic to spend.
+func (s CoinSelection) SkippedUTXOs() []bitcoin.UTXO {
+	result := make([]bitcoin.UTXO, len(s.Skipped))
+	for i, coin := range s.Skipped {
+		result[i] = coin.UTXO
+	}
+	return result
+}
+
+// Value returns the total value of the selected UTXOs.
+func (s CoinSelection) Value() uint64 {
+	result := uint64(0)
+	for _, coin := range s.Coins {
+		result += coin.UTXO.Value
+	}
+	return result
+}
+
+func (s CoinSelection) Copy() CoinSelection {
+	result := CoinSelection{
+		Strategy: CopyString(s.Strategy),
+		Coins:    make([]*SelectedCoin, len(s.Coins)),
+	}
+
+	for i, coin := range s.Coins {
+		c := *coin
+		c.UTXO.LockingScript = coin.UTXO.LockingScript.Copy()
+		result.Coins[i] = &c
+	}
+
+	for _, coin := range s.Skipped {
+		c := *coin
+		c.UTXO.LockingScript = coin.UTXO.LockingScript.Copy()
+		result.Skipped = append(result.Skipped, &c)
+	}
+
+	return result
+}
+
+// spentBy returns a selection containing only the coins that are spent by inputs of the tx.
+func (s CoinSelection) spentBy(tx *TxBuilder) *CoinSelection {
+	result := &CoinSelection{
+		Strategy: s.Strategy,
+		Skipped:  s.Skipped,
+	}
+
+	for _, coin := range s.Coins {
+		for _, txin := range tx.MsgTx.TxIn {
+			if txin.PreviousOutPoint.Hash.Equal(&coin.UTXO.Hash) &&
+				txin.PreviousOutPoint.Index == coin.UTXO.Index {
+				result.Coins = append(result.Coins, coin)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+func (s InOrderSelector) SelectCoins(utxos []bitcoin.UTXO, target uint64,
+	feeRate FeeRate) (*CoinSelection, error) {
+
+	result := &CoinSelection{
+		Strategy: "in_order",
+		Coins:    make([]*SelectedCoin, len(utxos)),
+	}
+
+	for i, utxo := range utxos {
+		result.Coins[i] = &SelectedCoin{
+			UTXO:   utxo,
+			Reason: fmt.Sprintf("position %d in provided order", i),
+		}
+	}
+
+	return result, nil
+}
+
+func (s LargestFirstSelector) SelectCoins(utxos []bitcoin.UTXO, target uint64,
+	feeRate FeeRate) (*CoinSelection, error) {
+
+	sorted := make([]bitcoin.UTXO, len(utxos))
+	copy(sorted, utxos)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Value > sorted[j].Value
+	})
+
+	result := &CoinSelection{
+		Strategy: "largest_first",
+		Coins:    make([]*SelectedCoin, len(sorted)),
+	}
+
+	for i, utxo := range sorted {
+		result.Coins[i] = &SelectedCoin{
+			UTXO:   utxo,
+			Reason: fmt.Sprintf("value %d is number %d largest of %d", utxo.Value, i+1, len(sorted)),
+		}
+	}
+
+	return result, nil
+}
+
+func (s SmallestFirstSelector) SelectCoins(utxos []bitcoin.UTXO, target uint64,
+	feeRate FeeRate) (*CoinSelection, error) {
+
+	sorted := make([]bitcoin.UTXO, len(utxos))
+	copy(sorted, utxos)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Value < sorted[j].Value
+	})
+
+	result := &CoinSelection{
+		Strategy: "smallest_first",
+		Coins:    make([]*SelectedCoin, len(sorted)),
+	}
+
+	for i, utxo := range sorted {
+		result.Coins[i] = &SelectedCoin{
+			UTXO: utxo,
+			Reason: fmt.Sprintf("value %d is number %d smallest of %d", utxo.Value, i+1,
+				len(sorted)),
+		}
+	}
+
+	return result, nil
+}
+
+func (s OldestFirstSelector) SelectCoins(utxos []bitcoin.UTXO, target uint64,
+	feeRate FeeRate) (*CoinSelection, error) {
+
+	sorted := make([]bitcoin.UTXO, len(utxos))
+	copy(sorted, utxos)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		iHeight, iConfirmed := s.BlockHeights[sorted[i].Hash]
+		jHeight, jConfirmed := s.BlockHeights[sorted[j].Hash]
+		if !iConfirmed {
+			return false
+		}
+		if !jConfirmed {
+			return true
+		}
+		return iHeight < jHeight
+	})
+
+	result := &CoinSelection{
+		Strategy: "oldest_first",
+		Coins:    make([]*SelectedCoin, len(sorted)),
+	}
+
+	for i, utxo := range sorted {
+		reason := "unconfirmed or unknown block height"
+		if height, confirmed := s.BlockHeights[utxo.Hash]; confirmed {
+			reason = fmt.Sprintf("confirmed in block %d", height)
+		}
+
+		result.Coins[i] = &SelectedCoin{
+			UTXO:   utxo,
+			Reason: reason,
+		}
+	}
+
+	return result, nil
+}
+
+func (s RandomSelector) SelectCoins(utxos []bitcoin.UTXO, target uint64,
+	feeRate FeeRate) (*CoinSelection, error) {
+
+	shuffled := make([]bitcoin.UTXO, len(utxos))
+	copy(shuffled, utxos)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	result := &CoinSelection{
+		Strategy: "random",
+		Coins:    make([]*SelectedCoin, len(shuffled)),
+	}
+
+	for i, utxo := range shuffled {
+		result.Coins[i] = &SelectedCoin{
+			UTXO:   utxo,
+			Reason: fmt.Sprintf("randomly placed at position %d", i),
+		}
+	}
+
+	return result, nil
+}
+
+func (s BranchAndBoundSelector) SelectCoins(utxos []bitcoin.UTXO, target uint64,
+	feeRate FeeRate) (*CoinSelection, error) {
+
+	// Drop UTXOs that cost more to spend than they are worth.
+	candidates, skipped, err := SplitUneconomicUTXOs(utxos, feeRate)
+	if err != nil {
+		return nil, errors.Wrap(err, "split uneconomic")
+	}
+
+	values := make([]uint64, len(candidates))
+	for i, utxo := range candidates {
+		value, err := EffectiveValue(utxo, feeRate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "effective value %s", utxo.ID())
+		}
+		values[i] = value
+	}
+
+	// Search the largest values first so the search converges faster.
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return values[order[i]] > values[order[j]]
+	})
+
+	sortedValues := make([]uint64, len(order))
+	for i, index := range order {
+		sortedValues[i] = values[index]
+	}
+
+	maxTries := s.MaxTries
+	if maxTries == 0 {
+		maxTries = DefaultBranchAndBoundTries
+	}
+
+	selected, excess, found := branchAndBound(sortedValues, target, s.Tolerance, maxTries)
+	if !found {
+		return nil, errors.Wrap(ErrNoExactMatch, fmt.Sprintf("target %d, tolerance %d", target,
+			s.Tolerance))
+	}
+
+	result := &CoinSelection{
+		Strategy: "branch_and_bound",
+		Coins:    make([]*SelectedCoin, len(selected)),
+	}
+	result.addSkipped(skipped, feeRate)
+
+	for i, sortedIndex := range selected {
+		index := order[sortedIndex]
+		result.Coins[i] = &SelectedCoin{
+			UTXO: candidates[index],
+			Reason: fmt.Sprintf("effective value %d in subset matching target %d with excess %d",
+				values[index], target, excess),
+		}
+	}
+
+	return result, nil
+}
+
+// EffectiveValue returns the value of the UTXO minus the fee to spend it at the fee rate. It returns
+// zero if the UTXO costs more to spend than it is worth.
+func EffectiveValue(utxo bitcoin.UTXO, feeRate FeeRate) (uint64, error) {
+	_, inputFee, err := UTXOInputSizeAndFee(utxo, feeRate)
+	if err != nil {
+		return 0, err
+	}
+
+	if utxo.Value <= inputFee {
+		return 0, nil
+	}
+
+	return utxo.Value - inputFee, nil
+}
+
+// SplitUneconomicUTXOs separates the UTXOs that are worth more than the fee to spend them from the
+// ones that aren't. The order of the UTXOs is retained in both lists.
+func SplitUneconomicUTXOs(utxos []bitcoin.UTXO,
+	feeRate FeeRate) ([]bitcoin.UTXO, []bitcoin.UTXO, error) {
+
+	var economic, uneconomic []bitcoin.UTXO
+	for _, utxo := range utxos {
+		value, err := EffectiveValue(utxo, feeRate)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "effective value %s", utxo.ID())
+		}
+
+		if value == 0 {
+			uneconomic = append(uneconomic, utxo)
+		} else {
+			economic = append(economic, utxo)
+		}
+	}
+
+	return economic, uneconomic, nil
+}
+
+// addSkipped adds uneconomic UTXOs to the selection's skipped list.
+func (s *CoinSelection) addSkipped(utxos []bitcoin.UTXO, feeRate FeeRate) {
+	for _, utxo := range utxos {
+		_, inputFee, _ := UTXOInputSizeAndFee(utxo, feeRate)
+		s.Skipped = append(s.Skipped, &SelectedCoin{
+			UTXO: utxo,
+			Reason: fmt.Sprintf("value %d doesn't cover input fee %d at %s", utxo.Value,
+				inputFee, feeRate),
+		})
+	}
+}
+
+// branchAndBound does a depth first search for the subset of values that sums to at least the
+// target, but not more than the target plus the tolerance. values must be sorted in descending
+// order. It returns the indexes of the best subset found and its excess over the target.
+func branchAndBound(values []uint64, target, tolerance uint64,
+	maxTries int) ([]int, uint64, bool) {
+
+	available := uint64(0)
+	for _, value := range values {
+		available += value
+	}
+
+	var best []int
+	bestExcess := uint64(0)
+	found := false
+	tries := 0
+	var current []int
+
+	var search func(index int, sum, remaining uint64) bool
+	search = func(index int, sum, remaining uint64) bool {
+		if tries >= maxTries {
+			return true
+		}
+		tries++
+
+		if sum > target+tolerance {
+			return false // overshot the window
+		}
+
+		if sum >= target {
+			excess := sum - target
+			if !found || excess < bestExcess {
+				best = append([]int{}, current...)
+				bestExcess = excess
+				found = true
+			}
+			return excess == 0 // stop searching if the match is exact
+		}
+
+		if index >= len(values) || sum+remaining < target {
+			return false // not enough value left to reach the target
+		}
+
+		// Include this value
+		current = append(current, index)
+		if search(index+1, sum+values[index], remaining-values[index]) {
+			return true
+		}
+		current = current[:len(current)-1]
+
+		// Exclude this value
+		return search(index+1, sum, remaining-values[index])
+	}
+
+	search(0, 0, available)
+	return best, bestExcess, found
+}
@@ -0,0 +1,395 @@
+package txbuilder
+
+import (
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+func selectionTestUTXOs() []bitcoin.UTXO {
+	return []bitcoin.UTXO{
+		{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         2000,
+			LockingScript: randomLockingScript(),
+		},
+		{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         10000,
+			LockingScript: randomLockingScript(),
+		},
+		{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         1000,
+			LockingScript: randomLockingScript(),
+		},
+		{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         5000,
+			LockingScript: randomLockingScript(),
+		},
+	}
+}
+
+func Test_CoinSelectors_Order(t *testing.T) {
+	utxos := selectionTestUTXOs()
+
+	tests := []struct {
+		name     string
+		selector CoinSelector
+		values   []uint64
+	}{
+		{
+			name:     "in order",
+			selector: InOrderSelector{},
+			values:   []uint64{2000, 10000, 1000, 5000},
+		},
+		{
+			name:     "largest first",
+			selector: LargestFirstSelector{},
+			values:   []uint64{10000, 5000, 2000, 1000},
+		},
+		{
+			name:     "smallest first",
+			selector: SmallestFirstSelector{},
+			values:   []uint64{1000, 2000, 5000, 10000},
+		},
+		{
+			name: "oldest first",
+			selector: OldestFirstSelector{
+				BlockHeights: map[bitcoin.Hash32]uint32{
+					utxos[0].Hash: 700,
+					utxos[2].Hash: 500,
+					utxos[3].Hash: 600,
+				},
+			},
+			values: []uint64{1000, 5000, 2000, 10000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selection, err := tt.selector.SelectCoins(utxos, 3000, 500)
+			if err != nil {
+				t.Fatalf("Failed to select coins : %s", err)
+			}
+
+			if len(selection.Coins) != len(tt.values) {
+				t.Fatalf("Wrong coin count : got %d, want %d", len(selection.Coins),
+					len(tt.values))
+			}
+
+			for i, coin := range selection.Coins {
+				t.Logf("Selected %d : %s", coin.UTXO.Value, coin.Reason)
+				if coin.UTXO.Value != tt.values[i] {
+					t.Errorf("Wrong coin %d value : got %d, want %d", i, coin.UTXO.Value,
+						tt.values[i])
+				}
+				if len(coin.Reason) == 0 {
+					t.Errorf("Missing reason for coin %d", i)
+				}
+			}
+		})
+	}
+}
+
+func Test_CoinSelectors_Random(t *testing.T) {
+	utxos := selectionTestUTXOs()
+
+	selection, err := RandomSelector{}.SelectCoins(utxos, 3000, 500)
+	if err != nil {
+		t.Fatalf("Failed to select coins : %s", err)
+	}
+
+	if len(selection.Coins) != len(utxos) {
+		t.Fatalf("Wrong coin count : got %d, want %d", len(selection.Coins), len(utxos))
+	}
+
+	if selection.Value() != 18000 {
+		t.Fatalf("Wrong selection value : got %d, want %d", selection.Value(), 18000)
+	}
+}
+
+func Test_BranchAndBoundSelector(t *testing.T) {
+	utxos := selectionTestUTXOs()
+	feeRate := FeeRate(500)
+
+	inputFee, err := UTXOFee(utxos[0], feeRate)
+	if err != nil {
+		t.Fatalf("Failed to calculate input fee : %s", err)
+	}
+
+	// 2000 + 5000 minus the fees to spend them is an exact match.
+	target := 7000 - (2 * inputFee)
+
+	selection, err := BranchAndBoundSelector{}.SelectCoins(utxos, target, feeRate)
+	if err != nil {
+		t.Fatalf("Failed to select coins : %s", err)
+	}
+
+	for _, coin := range selection.Coins {
+		t.Logf("Selected %d : %s", coin.UTXO.Value, coin.Reason)
+	}
+
+	if len(selection.Coins) != 2 {
+		t.Fatalf("Wrong coin count : got %d, want %d", len(selection.Coins), 2)
+	}
+
+	if selection.Value() != 7000 {
+		t.Fatalf("Wrong selection value : got %d, want %d", selection.Value(), 7000)
+	}
+
+	// Nothing matches within the tolerance.
+	if _, err := (BranchAndBoundSelector{Tolerance: 10}).SelectCoins(utxos, target+500,
+		feeRate); errors.Cause(err) != ErrNoExactMatch {
+		t.Fatalf("Wrong error : got %v, want %s", err, ErrNoExactMatch)
+	}
+
+	// Matches within the tolerance.
+	selection, err = BranchAndBoundSelector{Tolerance: 100}.SelectCoins(utxos, target-50,
+		feeRate)
+	if err != nil {
+		t.Fatalf("Failed to select coins : %s", err)
+	}
+
+	if selection.Value() != 7000 {
+		t.Fatalf("Wrong selection value : got %d, want %d", selection.Value(), 7000)
+	}
+}
+
+func Test_AddFunding_CoinSelector(t *testing.T) {
+	utxos := selectionTestUTXOs()
+
+	tx := NewTxBuilder(0.5, 0.0)
+	tx.SetChangeAddress(randomAddress(), "")
+	tx.CoinSelector = LargestFirstSelector{}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 3000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFunding(utxos); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	if len(tx.Inputs) != 1 {
+		t.Fatalf("Wrong input count : got %d, want %d", len(tx.Inputs), 1)
+	}
+
+	if tx.Inputs[0].Value != 10000 {
+		t.Fatalf("Wrong input value : got %d, want %d", tx.Inputs[0].Value, 10000)
+	}
+
+	if tx.CoinSelection == nil {
+		t.Fatalf("Missing coin selection")
+	}
+
+	if tx.CoinSelection.Strategy != "largest_first" {
+		t.Fatalf("Wrong strategy : got %s, want %s", tx.CoinSelection.Strategy, "largest_first")
+	}
+
+	if len(tx.CoinSelection.Coins) != 1 {
+		t.Fatalf("Wrong selected coin count : got %d, want %d", len(tx.CoinSelection.Coins), 1)
+	}
+
+	t.Logf("Selected : %s", tx.CoinSelection.Coins[0].Reason)
+
+	// Default order
+	tx = NewTxBuilder(0.5, 0.0)
+	tx.SetChangeAddress(randomAddress(), "")
+
+	if err := tx.AddPaymentOutput(randomAddress(), 3000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFunding(utxos); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	if len(tx.Inputs) != 2 {
+		t.Fatalf("Wrong input count : got %d, want %d", len(tx.Inputs), 2)
+	}
+
+	if tx.CoinSelection.Strategy != "in_order" {
+		t.Fatalf("Wrong strategy : got %s, want %s", tx.CoinSelection.Strategy, "in_order")
+	}
+}
+
+func Test_AddFundingChangeless(t *testing.T) {
+	utxos := selectionTestUTXOs()
+
+	tx := NewTxBuilder(0.5, 0.0)
+	tx.SetChangeAddress(randomAddress(), "")
+
+	if err := tx.AddPaymentOutput(randomAddress(), 6800, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFundingChangeless(utxos); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	t.Logf(tx.String(bitcoin.MainNet))
+
+	if len(tx.MsgTx.TxOut) != 1 {
+		t.Fatalf("Wrong output count : got %d, want %d", len(tx.MsgTx.TxOut), 1)
+	}
+
+	if tx.InputValue() != 7000 {
+		t.Fatalf("Wrong input value : got %d, want %d", tx.InputValue(), 7000)
+	}
+
+	outputFee, inputFee := tx.changeOutputCost()
+	if tx.Fee() < tx.EstimatedFee() || tx.Fee() > tx.EstimatedFee()+outputFee+inputFee {
+		t.Fatalf("Wrong fee : got %d, want %d", tx.Fee(), tx.EstimatedFee())
+	}
+
+	// No changeless subset so it falls back to adding change.
+	tx = NewTxBuilder(0.5, 0.0)
+	tx.SetChangeAddress(randomAddress(), "")
+
+	if err := tx.AddPaymentOutput(randomAddress(), 3000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFundingChangeless(utxos); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	t.Logf(tx.String(bitcoin.MainNet))
+
+	if len(tx.MsgTx.TxOut) != 2 {
+		t.Fatalf("Wrong output count : got %d, want %d", len(tx.MsgTx.TxOut), 2)
+	}
+
+	if !tx.Outputs[1].IsRemainder {
+		t.Fatalf("Second output should be change")
+	}
+}
+
+func Test_AddFunding_SkipUneconomic(t *testing.T) {
+	utxos := []bitcoin.UTXO{
+		{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         50,
+			LockingScript: randomLockingScript(),
+		},
+		{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         5000,
+			LockingScript: randomLockingScript(),
+		},
+		{
+			Hash:          *randomTxId(),
+			Index:         1,
+			Value:         70,
+			LockingScript: randomLockingScript(),
+		},
+	}
+
+	economic, skipped, err := SplitUneconomicUTXOs(utxos, 500)
+	if err != nil {
+		t.Fatalf("Failed to split utxos : %s", err)
+	}
+
+	if len(economic) != 1 || economic[0].Value != 5000 {
+		t.Fatalf("Wrong economic utxos : %+v", economic)
+	}
+
+	if len(skipped) != 2 {
+		t.Fatalf("Wrong skipped count : got %d, want %d", len(skipped), 2)
+	}
+
+	tx := NewTxBuilder(0.5, 0.0)
+	tx.SetChangeAddress(randomAddress(), "")
+
+	if err := tx.AddPaymentOutput(randomAddress(), 1000, true); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFunding(utxos); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	t.Logf(tx.String(bitcoin.MainNet))
+
+	if len(tx.Inputs) != 1 {
+		t.Fatalf("Wrong input count : got %d, want %d", len(tx.Inputs), 1)
+	}
+
+	if tx.Inputs[0].Value != 5000 {
+		t.Fatalf("Wrong input value : got %d, want %d", tx.Inputs[0].Value, 5000)
+	}
+
+	skippedUTXOs := tx.CoinSelection.SkippedUTXOs()
+	if len(skippedUTXOs) != 2 {
+		t.Fatalf("Wrong skipped count : got %d, want %d", len(skippedUTXOs), 2)
+	}
+
+	for _, coin := range tx.CoinSelection.Skipped {
+		t.Logf("Skipped %d : %s", coin.UTXO.Value, coin.Reason)
+	}
+
+	// A lower fee rate makes them economic.
+	economic, skipped, err = SplitUneconomicUTXOs(utxos, 50)
+	if err != nil {
+		t.Fatalf("Failed to split utxos : %s", err)
+	}
+
+	if len(economic) != 3 || len(skipped) != 0 {
+		t.Fatalf("Wrong split : got %d/%d, want %d/%d", len(economic), len(skipped), 3, 0)
+	}
+}
+
+func Test_AddFunding_SendMaxUneconomic(t *testing.T) {
+	var utxos []bitcoin.UTXO
+	for _, value := range []uint64{50, 5000, 70} {
+		utxos = append(utxos, bitcoin.UTXO{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         value,
+			LockingScript: randomLockingScript(),
+		})
+	}
+
+	tx := NewTxBuilder(0.5, 0.0)
+	tx.SetChangeAddress(randomAddress(), "")
+	tx.SendMax = true
+	tx.CoinSelector = LargestFirstSelector{}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 1000, true); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFunding(utxos); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	t.Logf(tx.String(bitcoin.MainNet))
+
+	// A sweep spends every UTXO even when it costs more to spend than it is worth.
+	if len(tx.Inputs) != len(utxos) {
+		t.Fatalf("Wrong input count : got %d, want %d", len(tx.Inputs), len(utxos))
+	}
+
+	if len(tx.CoinSelection.Skipped) != 0 {
+		t.Fatalf("Wrong skipped count : got %d, want %d", len(tx.CoinSelection.Skipped), 0)
+	}
+
+	if len(tx.CoinSelection.Coins) != len(utxos) {
+		t.Fatalf("Wrong selected count : got %d, want %d", len(tx.CoinSelection.Coins),
+			len(utxos))
+	}
+
+	if tx.OutputValue(true)+tx.Fee() != 5120 {
+		t.Fatalf("Wrong total : got %d, want %d", tx.OutputValue(true)+tx.Fee(), 5120)
+	}
+}
@@ -0,0 +1,143 @@
+package txbuilder
+
+import (
+	"fmt"
+
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/wire"
+	"github.com/tokenized/txbuilder/fees"
+
+	"github.com/pkg/errors"
+)
+
+// NewCPFPTxBuilder returns a child tx that pays for its parents. It spends the specified outputs of
+// the parent txs to the change locking script with a fee high enough that the package of the
+// parents and the child reaches feeRate. The child always pays at least the fee for its own size.
+// The parents must be able to provide the outputs they spend so their fees can be calculated.
+// The child's TargetFee is set to the fee needed for the package so signing keeps that fee instead
+// of recalculating it from the child's own size. Clear TargetFee before adding inputs or outputs to
+// the child, otherwise the package fee is no longer correct.
+func NewCPFPTxBuilder(parents []TransactionWithOutputs, spend []wire.OutPoint,
+	changeLockingScript bitcoin.Script, changeKeyID string,
+	feeRate, dustFeeRate FeeRate) (*TxBuilder, error) {
+
+	tx := NewTxBuilderWithFeeRates(feeRate, dustFeeRate)
+	if err := tx.SetChangeLockingScript(changeLockingScript, changeKeyID); err != nil {
+		return nil, errors.Wrap(err, "change locking script")
+	}
+
+	for _, outpoint := range spend {
+		utxo, err := parentUTXO(parents, outpoint)
+		if err != nil {
+			return nil, errors.Wrapf(err, "outpoint %s", outpoint)
+		}
+
+		if err := tx.AddInputUTXO(utxo); err != nil {
+			return nil, errors.Wrapf(err, "add input %s", outpoint)
+		}
+	}
+
+	if err := tx.AddOutput(changeLockingScript, tx.InputValue(), true, false); err != nil {
+		return nil, errors.Wrap(err, "add change")
+	}
+
+	parentsStandardSize, parentsDataSize, parentsFee, err := packageSizesAndFee(parents)
+	if err != nil {
+		return nil, errors.Wrap(err, "parents")
+	}
+
+	childStandardSize, childDataSize, err := fees.EstimateSizes(tx, fees.TemplateSizer{})
+	if err != nil {
+		return nil, errors.Wrap(err, "child size")
+	}
+
+	model := tx.FeeModel()
+	packageFee := model.Fee(parentsStandardSize+childStandardSize,
+		parentsDataSize+childDataSize)
+	childFee := model.Fee(childStandardSize, childDataSize)
+
+	if packageFee > parentsFee+childFee {
+		childFee = packageFee - parentsFee
+	}
+
+	inputValue := tx.InputValue()
+	dust := DustLimitForLockingScript(changeLockingScript, tx.dustPolicy())
+	if inputValue < childFee+dust {
+		return nil, errors.Wrap(ErrInsufficientValue, fmt.Sprintf("%d/%d", inputValue,
+			childFee+dust))
+	}
+
+	tx.TargetFee = childFee
+	tx.MsgTx.TxOut[0].Value = inputValue - childFee
+
+	return tx, nil
+}
+
+// parentUTXO returns the UTXO for an output of one of the parent txs.
+func parentUTXO(parents []TransactionWithOutputs, outpoint wire.OutPoint) (bitcoin.UTXO, error) {
+	for _, parent := range parents {
+		txid := parent.TxID()
+		if !txid.Equal(&outpoint.Hash) {
+			continue
+		}
+
+		if int(outpoint.Index) >= parent.OutputCount() {
+			return bitcoin.UTXO{}, errors.Wrap(ErrMissingInputData, "output index out of range")
+		}
+
+		output := parent.Output(int(outpoint.Index))
+		return bitcoin.UTXO{
+			Hash:          outpoint.Hash,
+			Index:         outpoint.Index,
+			Value:         output.Value,
+			LockingScript: output.LockingScript,
+		}, nil
+	}
+
+	return bitcoin.UTXO{}, errors.Wrap(ErrMissingInputData, "parent tx not found")
+}
+
+// packageSizesAndFee returns the total standard and data sizes and the total fee of the txs.
+func packageSizesAndFee(txs []TransactionWithOutputs) (int, int, uint64, error) {
+	standardSize := 0
+	dataSize := 0
+	fee := uint64(0)
+	for i, tx := range txs {
+		txStandardSize, txDataSize, err := parentSizes(tx)
+		if err != nil {
+			return 0, 0, 0, errors.Wrapf(err, "tx %d size", i)
+		}
+		standardSize += txStandardSize
+		dataSize += txDataSize
+
+		txFee, err := fees.Fee(tx)
+		if err != nil {
+			return 0, 0, 0, errors.Wrapf(err, "tx %d fee", i)
+		}
+
+		if txFee > 0 {
+			fee += uint64(txFee)
+		}
+	}
+
+	return standardSize, dataSize, fee, nil
+}
+
+// parentSizes returns the standard and data sizes of the tx. The actual size is used when all
+// inputs are signed, which they normally are since the parents have already been broadcast.
+// Otherwise the size is estimated.
+func parentSizes(tx TransactionWithOutputs) (int, int, error) {
+	msgTx := tx.GetMsgTx()
+	for _, txin := range msgTx.TxIn {
+		if len(txin.UnlockingScript) == 0 {
+			return fees.EstimateSizes(tx, fees.TemplateSizer{})
+		}
+	}
+
+	dataSize := 0
+	for _, txout := range msgTx.TxOut {
+		dataSize += fees.OutputDataSize(txout)
+	}
+
+	return msgTx.SerializeSize() - dataSize, dataSize, nil
+}
@@ -0,0 +1,127 @@
+package txbuilder
+
+import (
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/wire"
+
+	"github.com/pkg/errors"
+)
+
+func Test_NewCPFPTxBuilder(t *testing.T) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	lockingScript, _ := key.LockingScript()
+
+	// Parent paying a very low fee rate.
+	parent := NewTxBuilderWithFeeRates(1, 250)
+	if err := parent.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         20000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := parent.AddPaymentOutput(randomAddress(), 10000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := parent.AddOutput(lockingScript, 9000, true, false); err != nil {
+		t.Fatalf("Failed to add change : %s", err)
+	}
+
+	if _, err := parent.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign parent : %s", err)
+	}
+
+	parentFee := parent.Fee()
+	parentSize := parent.MsgTx.SerializeSize()
+	t.Logf("Parent size %d, fee %d", parentSize, parentFee)
+
+	feeRate := FeeRate(500)
+	spend := []wire.OutPoint{{Hash: parent.TxID(), Index: 1}}
+	child, err := NewCPFPTxBuilder([]TransactionWithOutputs{parent}, spend,
+		randomLockingScript(), "", feeRate, 250)
+	if err != nil {
+		t.Fatalf("Failed to create child : %s", err)
+	}
+
+	if child.Fee() != child.TargetFee {
+		t.Fatalf("Wrong child fee : got %d, want %d", child.Fee(), child.TargetFee)
+	}
+
+	if _, err := child.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign child : %s", err)
+	}
+
+	childSize := child.MsgTx.SerializeSize()
+	childFee := child.Fee()
+	t.Logf("Child size %d, fee %d", childSize, childFee)
+
+	if childFee < feeRate.Fee(childSize) {
+		t.Fatalf("Child fee below its own fee : got %d, want at least %d", childFee,
+			feeRate.Fee(childSize))
+	}
+
+	packageFee := parentFee + childFee
+	wantFee := feeRate.Fee(parentSize + childSize)
+	if packageFee < wantFee {
+		t.Fatalf("Package fee below target rate : got %d, want at least %d", packageFee, wantFee)
+	}
+
+	// The package fee shouldn't be more than the signed parent size and the estimated child size
+	// require.
+	childEstimatedSize, err := child.EstimateSize()
+	if err != nil {
+		t.Fatalf("Failed to estimate child size : %s", err)
+	}
+
+	if packageFee != feeRate.Fee(parentSize+childEstimatedSize) {
+		t.Fatalf("Wrong package fee : got %d, want %d", packageFee,
+			feeRate.Fee(parentSize+childEstimatedSize))
+	}
+}
+
+func Test_NewCPFPTxBuilder_Invalid(t *testing.T) {
+	lockingScript := randomLockingScript()
+
+	parent := NewTxBuilderWithFeeRates(1, 250)
+	if err := parent.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         2000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := parent.AddOutput(lockingScript, 1500, false, false); err != nil {
+		t.Fatalf("Failed to add output : %s", err)
+	}
+
+	parents := []TransactionWithOutputs{parent}
+
+	_, err := NewCPFPTxBuilder(parents, []wire.OutPoint{{Hash: *randomTxId(), Index: 0}},
+		lockingScript, "", 500, 250)
+	if errors.Cause(err) != ErrMissingInputData {
+		t.Fatalf("Wrong error for missing parent : got %v, want %s", err, ErrMissingInputData)
+	}
+
+	_, err = NewCPFPTxBuilder(parents, []wire.OutPoint{{Hash: parent.TxID(), Index: 1}},
+		lockingScript, "", 500, 250)
+	if errors.Cause(err) != ErrMissingInputData {
+		t.Fatalf("Wrong error for missing output : got %v, want %s", err, ErrMissingInputData)
+	}
+
+	// The output isn't worth enough to pay for the package.
+	_, err = NewCPFPTxBuilder(parents, []wire.OutPoint{{Hash: parent.TxID(), Index: 0}},
+		lockingScript, "", 5000, 250)
+	if errors.Cause(err) != ErrInsufficientValue {
+		t.Fatalf("Wrong error for low value : got %v, want %s", err, ErrInsufficientValue)
+	}
+}
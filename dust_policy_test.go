@@ -0,0 +1,148 @@
+package txbuilder
+
+import (
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/wire"
+)
+
+func Test_DustPolicies(t *testing.T) {
+	lockingScript := randomLockingScript()
+	dataOutput := &wire.TxOut{
+		LockingScript: append(bitcoin.Script{bitcoin.OP_FALSE, bitcoin.OP_RETURN},
+			bitcoin.PushData([]byte("data"))...),
+	}
+
+	tests := []struct {
+		name   string
+		policy DustPolicy
+		dust   uint64
+	}{
+		{
+			name:   "legacy 0.25",
+			policy: FeeRate(250),
+			dust:   137,
+		},
+		{
+			name:   "legacy zero",
+			policy: FeeRate(0),
+			dust:   1,
+		},
+		{
+			name:   "fixed 1",
+			policy: FixedDustPolicy(1),
+			dust:   1,
+		},
+		{
+			name:   "fixed 546",
+			policy: FixedDustPolicy(546),
+			dust:   546,
+		},
+		{
+			name:   "zero",
+			policy: ZeroDustPolicy{},
+			dust:   0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dust := DustLimitForLockingScript(lockingScript, tt.policy)
+			if dust != tt.dust {
+				t.Fatalf("Wrong dust limit : got %d, want %d", dust, tt.dust)
+			}
+
+			if dust := DustLimitForOutput(dataOutput, tt.policy); dust != 0 {
+				t.Fatalf("Data output should have no dust limit : %d", dust)
+			}
+		})
+	}
+}
+
+func Test_DustPolicy_AddDustOutput(t *testing.T) {
+	tx := NewTxBuilderWithFeeRates(500, 1000)
+	tx.DustPolicy = ZeroDustPolicy{}
+
+	if err := tx.AddDustOutput(randomAddress(), false); err != nil {
+		t.Fatalf("Failed to add dust output : %s", err)
+	}
+
+	if tx.MsgTx.TxOut[0].Value != 0 {
+		t.Fatalf("Wrong dust output value : got %d, want %d", tx.MsgTx.TxOut[0].Value, 0)
+	}
+
+	tx.DustPolicy = FixedDustPolicy(1)
+
+	if err := tx.AddDustOutput(randomAddress(), false); err != nil {
+		t.Fatalf("Failed to add dust output : %s", err)
+	}
+
+	if tx.MsgTx.TxOut[1].Value != 1 {
+		t.Fatalf("Wrong dust output value : got %d, want %d", tx.MsgTx.TxOut[1].Value, 1)
+	}
+}
+
+func Test_DustPolicy_AddFunding(t *testing.T) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	lockingScript, _ := key.LockingScript()
+
+	tests := []struct {
+		name       string
+		policy     DustPolicy
+		withChange bool
+	}{
+		{
+			name:       "legacy",
+			policy:     FeeRate(250),
+			withChange: false,
+		},
+		{
+			name:       "fixed",
+			policy:     FixedDustPolicy(1),
+			withChange: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := NewTxBuilderWithFeeRates(500, 0)
+			tx.DustPolicy = tt.policy
+			tx.SetChangeLockingScript(randomLockingScript(), "")
+
+			if err := tx.AddPaymentOutput(randomAddress(), 9800, false); err != nil {
+				t.Fatalf("Failed to add payment : %s", err)
+			}
+
+			// Leaves about 100 satoshis of change, which is dust under the legacy policy.
+			if err := tx.AddFunding([]bitcoin.UTXO{
+				{
+					Hash:          *randomTxId(),
+					Index:         0,
+					Value:         10000,
+					LockingScript: lockingScript,
+				},
+			}); err != nil {
+				t.Fatalf("Failed to add funding : %s", err)
+			}
+
+			if _, err := tx.Sign([]bitcoin.Key{key}); err != nil {
+				t.Fatalf("Failed to sign : %s", err)
+			}
+
+			t.Logf("Tx : %s", tx.String(bitcoin.MainNet))
+
+			hasChange := len(tx.MsgTx.TxOut) == 2
+			if hasChange != tt.withChange {
+				t.Fatalf("Wrong change : got %t, want %t", hasChange, tt.withChange)
+			}
+
+			if tx.Fee() < tx.EstimatedFee() {
+				t.Fatalf("Fee too low : got %d, want at least %d", tx.Fee(), tx.EstimatedFee())
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package txbuilder
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/txbuilder/fees"
+
+	"github.com/pkg/errors"
+)
+
+func readFeePolicy(t *testing.T, name string) *fees.FeeModel {
+	b, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("Failed to read fixture : %s", err)
+	}
+
+	model, err := fees.ParseFeePolicy(b)
+	if err != nil {
+		t.Fatalf("Failed to parse fee policy : %s", err)
+	}
+
+	t.Logf("%s : standard %s, data %s, expiry %s", name, model.Standard, model.Data,
+		model.Expiry)
+	return model
+}
+
+func Test_ParseFeePolicy_ARC(t *testing.T) {
+	model := readFeePolicy(t, "arc_policy.json")
+
+	if model.Standard != 1 {
+		t.Fatalf("Wrong standard rate : got %s, want %s", model.Standard, FeeRate(1))
+	}
+
+	if model.Data != 1 {
+		t.Fatalf("Wrong data rate : got %s, want %s", model.Data, FeeRate(1))
+	}
+
+	if model.MinFee != 0 {
+		t.Fatalf("Wrong min fee : got %d, want %d", model.MinFee, 0)
+	}
+
+	if !model.Expiry.IsZero() {
+		t.Fatalf("ARC policy should not have an expiry : %s", model.Expiry)
+	}
+}
+
+func Test_ParseFeePolicy_MAPI(t *testing.T) {
+	model := readFeePolicy(t, "mapi_fee_quote.json")
+
+	if model.Standard != 50 {
+		t.Fatalf("Wrong standard rate : got %s, want %s", model.Standard, FeeRate(50))
+	}
+
+	if model.Data != 25 {
+		t.Fatalf("Wrong data rate : got %s, want %s", model.Data, FeeRate(25))
+	}
+
+	if model.MinFee != 0 {
+		t.Fatalf("Wrong min fee : got %d, want %d", model.MinFee, 0)
+	}
+
+	wantExpiry := time.Date(2099, 1, 15, 10, 30, 30, 0, time.UTC)
+	if !model.Expiry.Equal(wantExpiry) {
+		t.Fatalf("Wrong expiry : got %s, want %s", model.Expiry, wantExpiry)
+	}
+
+	// The bare payload parses the same as the envelope.
+	payload := `{"expiryTime":"2099-01-15T10:30:30.000Z","fees":[` +
+		`{"feeType":"standard","miningFee":{"satoshis":50,"bytes":1000}},` +
+		`{"feeType":"data","miningFee":{"satoshis":25,"bytes":1000}}]}`
+	bare, err := fees.ParseFeePolicy([]byte(payload))
+	if err != nil {
+		t.Fatalf("Failed to parse bare payload : %s", err)
+	}
+
+	if bare.Standard != model.Standard || bare.Data != model.Data ||
+		!bare.Expiry.Equal(model.Expiry) {
+		t.Fatalf("Bare payload doesn't match envelope : %+v", bare)
+	}
+}
+
+func Test_ParseFeePolicy_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		err  error
+	}{
+		{
+			name: "unknown",
+			json: `{"rate":1}`,
+			err:  fees.ErrUnknownFeePolicy,
+		},
+		{
+			name: "zero bytes",
+			json: `{"policy":{"miningFee":{"satoshis":1,"bytes":0}}}`,
+			err:  fees.ErrInvalidFeeAmount,
+		},
+		{
+			name: "missing standard",
+			json: `{"fees":[{"feeType":"data","miningFee":{"satoshis":1,"bytes":1000}}]}`,
+			err:  fees.ErrUnknownFeePolicy,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := fees.ParseFeePolicy([]byte(tt.json))
+			if errors.Cause(err) != tt.err {
+				t.Fatalf("Wrong error : got %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func Test_NewFeeRateFromAmount(t *testing.T) {
+	tests := []struct {
+		satoshis, bytes uint64
+		rate            FeeRate
+	}{
+		{satoshis: 1, bytes: 1000, rate: 1},
+		{satoshis: 50, bytes: 1000, rate: 50},
+		{satoshis: 1, bytes: 1, rate: 1000},
+		{satoshis: 1, bytes: 3, rate: 334},
+		{satoshis: 0, bytes: 1000, rate: 0},
+	}
+
+	for _, tt := range tests {
+		rate, err := fees.NewFeeRateFromAmount(tt.satoshis, tt.bytes)
+		if err != nil {
+			t.Fatalf("Failed to convert fee amount : %s", err)
+		}
+
+		if rate != tt.rate {
+			t.Fatalf("Wrong rate for %d/%d : got %s, want %s", tt.satoshis, tt.bytes, rate,
+				tt.rate)
+		}
+	}
+}
+
+func Test_NewTxBuilderFromFeeModel(t *testing.T) {
+	model := readFeePolicy(t, "mapi_fee_quote.json")
+
+	tx, err := NewTxBuilderFromFeeModel(*model, 1000)
+	if err != nil {
+		t.Fatalf("Failed to create tx : %s", err)
+	}
+
+	if tx.FeeRate != 50 || tx.DataFeeRate == nil || *tx.DataFeeRate != 25 ||
+		tx.MinFee != model.MinFee || !tx.FeeExpiry.Equal(model.Expiry) {
+		t.Fatalf("Wrong fee settings : rate %s, data rate %v, min fee %d, expiry %s", tx.FeeRate,
+			tx.DataFeeRate, tx.MinFee, tx.FeeExpiry)
+	}
+
+	// A zero data rate is kept instead of falling back to the standard rate.
+	free := fees.FeeModel{Standard: 50}
+	tx, err = NewTxBuilderFromFeeModel(free, 1000)
+	if err != nil {
+		t.Fatalf("Failed to create tx : %s", err)
+	}
+
+	if tx.FeeModel().Data != 0 {
+		t.Fatalf("Wrong data rate : got %s, want %s", tx.FeeModel().Data, FeeRate(0))
+	}
+
+	expired := readFeePolicy(t, "mapi_fee_quote_expired.json")
+	if _, err := NewTxBuilderFromFeeModel(*expired, 1000); errors.Cause(err) != ErrFeeQuoteExpired {
+		t.Fatalf("Wrong error for expired quote : got %v, want %s", err, ErrFeeQuoteExpired)
+	}
+}
+
+func Test_FeeExpiry(t *testing.T) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	lockingScript, _ := key.LockingScript()
+
+	utxos := []bitcoin.UTXO{
+		{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         10000,
+			LockingScript: lockingScript,
+		},
+	}
+
+	tx := NewTxBuilderWithFeeRates(50, 1000)
+	tx.SetChangeLockingScript(lockingScript, "")
+	tx.FeeExpiry = time.Now().Add(time.Hour)
+
+	if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	expiredTx := tx.Copy()
+
+	if err := tx.AddFunding(utxos); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	if _, err := tx.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	expiredTx.FeeExpiry = time.Now().Add(-time.Second)
+
+	if err := expiredTx.AddFunding(utxos); errors.Cause(err) != ErrFeeQuoteExpired {
+		t.Fatalf("Wrong funding error : got %v, want %s", err, ErrFeeQuoteExpired)
+	}
+
+	if err := expiredTx.AddFundingChangeless(utxos); errors.Cause(err) != ErrFeeQuoteExpired {
+		t.Fatalf("Wrong changeless funding error : got %v, want %s", err, ErrFeeQuoteExpired)
+	}
+
+	if _, err := expiredTx.Sign([]bitcoin.Key{key}); errors.Cause(err) != ErrFeeQuoteExpired {
+		t.Fatalf("Wrong sign error : got %v, want %s", err, ErrFeeQuoteExpired)
+	}
+}
@@ -0,0 +1,163 @@
+package txbuilder
+
+import (
+	"github.com/tokenized/pkg/wire"
+	"github.com/tokenized/txbuilder/fees"
+)
+
+// FeeReport is a breakdown of the sizes and fees of a tx.
+type FeeReport struct {
+	FeeRate     FeeRate `json:"fee_rate"`
+	DataFeeRate FeeRate `json:"data_fee_rate"`
+
+	// Signed is true when all inputs have unlocking scripts so the actual size is final.
+	Signed bool `json:"signed"`
+
+	// BaseSize is the size of the version, lock time, and input and output counts.
+	BaseSize      int `json:"base_size"`
+	EstimatedSize int `json:"estimated_size"`
+	ActualSize    int `json:"actual_size"`
+	DataSize      int `json:"data_size"`
+
+	InputValue  uint64 `json:"input_value"`
+	OutputValue uint64 `json:"output_value"`
+	Fee         int64  `json:"fee"`
+
+	// EstimatedFee is the fee required by the tx's fee settings for the estimated size.
+	EstimatedFee uint64 `json:"estimated_fee"`
+
+	// RequiredFee is the fee at the tx's fee rates for the actual size when signed, otherwise for
+	// the estimated size.
+	RequiredFee uint64 `json:"required_fee"`
+
+	// SatoshisPerByte is the effective fee rate paid.
+	SatoshisPerByte float64 `json:"satoshis_per_byte"`
+
+	// Overpayment is the fee paid above RequiredFee. It is negative when the fee is too low.
+	Overpayment int64 `json:"overpayment"`
+
+	// DroppedChange is the value that was too small to put in a change output and was left to the
+	// miner by the last funding or fee adjustment.
+	DroppedChange uint64 `json:"dropped_change"`
+
+	Inputs  []*InputFeeReport  `json:"inputs"`
+	Outputs []*OutputFeeReport `json:"outputs"`
+}
+
+// InputFeeReport is the size and fee breakdown of an input.
+type InputFeeReport struct {
+	Value uint64 `json:"value"`
+
+	// The estimated values are zero and EstimateError is set when the size can't be estimated.
+	EstimatedUnlockingSize int    `json:"estimated_unlocking_size"`
+	EstimatedSize          int    `json:"estimated_size"`
+	EstimatedCost          uint64 `json:"estimated_cost"`
+	EstimateError          string `json:"estimate_error,omitempty"`
+
+	// The actual values are for the current unlocking script, which is empty before signing.
+	ActualUnlockingSize int    `json:"actual_unlocking_size"`
+	ActualSize          int    `json:"actual_size"`
+	ActualCost          uint64 `json:"actual_cost"`
+}
+
+// OutputFeeReport is the size and fee breakdown of an output.
+type OutputFeeReport struct {
+	Value     uint64 `json:"value"`
+	Size      int    `json:"size"`
+	DataSize  int    `json:"data_size,omitempty"`
+	Cost      uint64 `json:"cost"`
+	DustLimit uint64 `json:"dust_limit"`
+
+	IsDust      bool `json:"is_dust"`
+	IsRemainder bool `json:"is_remainder"`
+	AddedForFee bool `json:"added_for_fee"`
+}
+
+// FeeReport returns a breakdown of the sizes and fees of the tx.
+func (tx *TxBuilder) FeeReport() *FeeReport {
+	model := tx.FeeModel()
+	result := &FeeReport{
+		FeeRate:     model.Standard,
+		DataFeeRate: model.Data,
+		Signed:      true,
+		BaseSize: BaseTxSize + wire.VarIntSerializeSize(uint64(len(tx.MsgTx.TxIn))) +
+			wire.VarIntSerializeSize(uint64(len(tx.MsgTx.TxOut))),
+		EstimatedSize: tx.EstimatedSize(),
+		ActualSize:    tx.MsgTx.SerializeSize(),
+		DataSize:      tx.DataSize(),
+		InputValue:    tx.InputValue(),
+		OutputValue:   tx.OutputValue(true),
+		Fee:           tx.ActualFee(),
+		EstimatedFee:  tx.EstimatedFee(),
+		DroppedChange: tx.DroppedChange,
+	}
+
+	for i, txin := range tx.MsgTx.TxIn {
+		input := tx.Inputs[i]
+		inputReport := &InputFeeReport{
+			Value:      input.Value,
+			ActualSize: txin.SerializeSize(),
+		}
+
+		if len(txin.UnlockingScript) == 0 || txin.UnlockingScript.IsFalseOpReturn() {
+			result.Signed = false
+		} else {
+			inputReport.ActualUnlockingSize = len(txin.UnlockingScript)
+		}
+		inputReport.ActualCost = model.Standard.Fee(inputReport.ActualSize)
+
+		estimatedSize, err := tx.estimateInputSize(i)
+		if err != nil {
+			inputReport.EstimateError = err.Error()
+		} else {
+			inputReport.EstimatedSize = estimatedSize
+			inputReport.EstimatedUnlockingSize = unlockingSizeForInputSize(estimatedSize)
+			inputReport.EstimatedCost = model.Standard.Fee(estimatedSize)
+		}
+
+		result.Inputs = append(result.Inputs, inputReport)
+	}
+
+	for i, txout := range tx.MsgTx.TxOut {
+		output := tx.Outputs[i]
+		size := txout.SerializeSize()
+		dataSize := fees.OutputDataSize(txout)
+
+		result.Outputs = append(result.Outputs, &OutputFeeReport{
+			Value:       txout.Value,
+			Size:        size,
+			DataSize:    dataSize,
+			Cost:        model.Fee(size-dataSize, dataSize),
+			DustLimit:   DustLimitForOutput(txout, tx.dustPolicy()),
+			IsDust:      output.IsDust,
+			IsRemainder: output.IsRemainder,
+			AddedForFee: output.addedForFee,
+		})
+	}
+
+	size := result.EstimatedSize
+	if result.Signed {
+		size = result.ActualSize
+	}
+	result.RequiredFee = model.Fee(size-result.DataSize, result.DataSize)
+	result.Overpayment = result.Fee - int64(result.RequiredFee)
+	if size > 0 {
+		result.SatoshisPerByte = float64(result.Fee) / float64(size)
+	}
+
+	return result
+}
+
+// unlockingSizeForInputSize returns the size of the unlocking script in an input of the specified
+// size.
+func unlockingSizeForInputSize(inputSize int) int {
+	scriptSize := inputSize - InputBaseSize
+	for _, varIntSize := range []int{1, 3, 5, 9} {
+		if scriptSize >= varIntSize &&
+			VarIntSerializeSize(uint64(scriptSize-varIntSize)) == varIntSize {
+			return scriptSize - varIntSize
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,145 @@
+package txbuilder
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+)
+
+func Test_FeeReport(t *testing.T) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	lockingScript, _ := key.LockingScript()
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	tx.SetChangeLockingScript(randomLockingScript(), "")
+
+	if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFunding([]bitcoin.UTXO{
+		{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         10000,
+			LockingScript: lockingScript,
+		},
+	}); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	unsigned := tx.FeeReport()
+	if unsigned.Signed {
+		t.Fatalf("Unsigned report should not be signed")
+	}
+
+	if unsigned.Inputs[0].EstimatedUnlockingSize != MaximumP2PKHSigScriptSize {
+		t.Fatalf("Wrong estimated unlocking size : got %d, want %d",
+			unsigned.Inputs[0].EstimatedUnlockingSize, MaximumP2PKHSigScriptSize)
+	}
+
+	if _, err := tx.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	report := tx.FeeReport()
+
+	js, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to marshal report : %s", err)
+	}
+	t.Logf("Report : %s", js)
+
+	if !report.Signed {
+		t.Fatalf("Signed report should be signed")
+	}
+
+	size := report.BaseSize
+	for _, input := range report.Inputs {
+		size += input.ActualSize
+
+		if input.ActualUnlockingSize > input.EstimatedUnlockingSize {
+			t.Fatalf("Actual unlocking size %d more than estimate %d",
+				input.ActualUnlockingSize, input.EstimatedUnlockingSize)
+		}
+	}
+	for _, output := range report.Outputs {
+		size += output.Size
+	}
+
+	if size != report.ActualSize {
+		t.Fatalf("Wrong total size : got %d, want %d", size, report.ActualSize)
+	}
+
+	if report.Fee != int64(tx.Fee()) {
+		t.Fatalf("Wrong fee : got %d, want %d", report.Fee, tx.Fee())
+	}
+
+	if report.Overpayment < 0 {
+		t.Fatalf("Overpayment should not be negative : %d", report.Overpayment)
+	}
+
+	if report.DroppedChange != 0 {
+		t.Fatalf("Dropped change should be zero with a change output : %d", report.DroppedChange)
+	}
+
+	if !report.Outputs[1].IsRemainder {
+		t.Fatalf("Change output should be a remainder")
+	}
+
+	read := &FeeReport{}
+	if err := json.Unmarshal(js, read); err != nil {
+		t.Fatalf("Failed to unmarshal report : %s", err)
+	}
+
+	if read.Fee != report.Fee || len(read.Inputs) != len(report.Inputs) ||
+		len(read.Outputs) != len(report.Outputs) {
+		t.Fatalf("Unmarshalled report doesn't match : %+v", read)
+	}
+}
+
+func Test_FeeReport_DroppedChange(t *testing.T) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	lockingScript, _ := key.LockingScript()
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+
+	if err := tx.AddPaymentOutput(randomAddress(), 9800, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFunding([]bitcoin.UTXO{
+		{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         10000,
+			LockingScript: lockingScript,
+		},
+	}); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	if _, err := tx.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	report := tx.FeeReport()
+	t.Logf("Fee %d, estimated fee %d, dropped change %d", report.Fee, report.EstimatedFee,
+		report.DroppedChange)
+
+	wantDropped := 10000 - 9800 - report.EstimatedFee
+	if report.DroppedChange != wantDropped {
+		t.Fatalf("Wrong dropped change : got %d, want %d", report.DroppedChange, wantDropped)
+	}
+
+	if report.DroppedChange == 0 {
+		t.Fatalf("Dropped change should not be zero")
+	}
+}
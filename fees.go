@@ -3,32 +3,43 @@ package txbuilder
 import (
 	"fmt"
 	"math"
+	"time"
 
-	"github.com/tokenized/bitcoin_interpreter/agent_bitcoin_transfer"
-	"github.com/tokenized/channels"
-	"github.com/tokenized/channels/unlocking_data"
 	"github.com/tokenized/pkg/bitcoin"
 	"github.com/tokenized/pkg/wire"
+	"github.com/tokenized/txbuilder/fees"
 
 	"github.com/pkg/errors"
 )
 
+// FeeRate is a fee rate in satoshis per 1000 bytes.
+type FeeRate = fees.FeeRate
+
+// FeeModel contains separate fee rates for standard bytes and data bytes.
+type FeeModel = fees.FeeModel
+
+// NewFeeRate returns the fee rate for a rate in satoshis per byte. It is a compatibility layer for
+// rates that are configured as floating point.
+func NewFeeRate(satoshisPerByte float32) FeeRate {
+	return fees.NewFeeRate(float64(satoshisPerByte))
+}
+
 const (
 	// BaseTxSize is the size of the tx not including inputs and outputs.
 	//   Version = 4 bytes
 	//   LockTime = 4 bytes
-	BaseTxSize = 8
+	BaseTxSize = fees.BaseTxSize
 
-	PublicKeyHashPushDataSize = 21                   // 1 byte push op code + 33 byte public key
-	PublicKeyPushDataSize     = 34                   // 1 byte push op code + 33 byte public key
-	MaxSignatureSize          = 73                   // 72 byte sig + 1 byte sig hash type
-	MaxSignaturesPushDataSize = 1 + MaxSignatureSize // 1 byte push op code + 72 byte sig + 1 byte sig hash type
+	PublicKeyHashPushDataSize = fees.PublicKeyHashPushDataSize
+	PublicKeyPushDataSize     = fees.PublicKeyPushDataSize
+	MaxSignatureSize          = fees.MaxSignatureSize
+	MaxSignaturesPushDataSize = fees.MaxSignaturesPushDataSize
 
 	// InputBaseSize is the size of a tx input not including script
 	//   Previous Transaction ID = 32 bytes
 	//   Previous Transaction Output Index = 4 bytes
 	//   Sequence = 4 bytes
-	InputBaseSize = bitcoin.Hash32Size + 4 + 4
+	InputBaseSize = fees.InputBaseSize
 
 	// MaximumP2PKHInputSize is the maximum serialized size of a P2PKH tx input based on all of the
 	// variable sized data.
@@ -79,7 +90,7 @@ const (
 	MaximumP2PKInputSize     = InputBaseSize + 1 + MaximumP2PKSigScriptSize
 
 	// OutputBaseSize is the size of a tx output not including script
-	OutputBaseSize = 8
+	OutputBaseSize = fees.OutputBaseSize
 
 	// P2PKHOutputSize is the serialized size of a P2PKH tx output.
 	// P2PKH/P2SH output size 34
@@ -105,64 +116,26 @@ const (
 	// DustInputSize is the fixed size of an input used in the calculation of the dust limit.
 	// This is actually the estimated size of a P2PKH input, but is used for dust calculation of all
 	//   locking scripts.
-	DustInputSize = 148
+	DustInputSize = fees.DustInputSize
 )
 
 // UnlockingScriptSize calculates the length of the unlocking script needed to unlock the specified
 // locking script.
 func UnlockingScriptSize(lockingScript bitcoin.Script) (int, error) {
-	if lockingScript.IsP2PK() {
-		// Only a signature in a P2PK unlocking script
-		return MaxSignaturesPushDataSize, nil
-	}
-
-	if lockingScript.IsP2PKH() {
-		// Signature and a public key in a P2PKH unlocking script
-		return MaxSignaturesPushDataSize + PublicKeyPushDataSize, nil
-	}
-
-	if required, total, err := lockingScript.MultiPKHCounts(); err == nil {
-		scriptSize := int(total - required) // OP_FALSE for all signatures not included
-
-		// Signature, public key and OP_TRUE for each required signature
-		scriptSize += int(required) * (MaxSignaturesPushDataSize + PublicKeyPushDataSize + 1)
-
-		return scriptSize, nil
-	}
-
-	if info, err := agent_bitcoin_transfer.MatchScript(lockingScript); err == nil && info != nil {
-		agentUnlockingScript := info.AgentLockingScript.Copy()
-		agentUnlockingScript.RemoveHardVerify()
-		agentUnlockingSize, err := UnlockingScriptSize(agentUnlockingScript)
-		if err != nil {
-			return 0, errors.Wrap(err, "agent unlocking size")
-		}
-
-		return agent_bitcoin_transfer.ApproveUnlockingSize(agentUnlockingSize), nil
-	}
-
-	return 0, bitcoin.ErrUnknownScriptTemplate
+	return fees.EstimateUnlockingSize(lockingScript)
 }
 
 // InputSize returns the serialize size in bytes of an input spending the specified locking script.
 // Note: The script is not the script that would be contained in the input, but the script that
 // is contained in the output being spent by this input.
 func InputSize(lockingScript bitcoin.Script) (int, error) {
-	scriptSize, err := UnlockingScriptSize(lockingScript)
-	if err != nil {
-		return 0, err
-	}
-
-	return InputBaseSize + // outpoint + sequence
-		VarIntSerializeSize(uint64(scriptSize)) + scriptSize, nil // unlocking script
+	return fees.InputSize(lockingScript)
 }
 
 // OutputSize returns the serialize size in bytes of an output containing the specified locking
 // script.
 func OutputSize(lockingScript bitcoin.Script) int {
-	scriptSize := len(lockingScript)
-	return OutputBaseSize + // value
-		VarIntSerializeSize(uint64(scriptSize)) + scriptSize // locking script
+	return fees.OutputSize(lockingScript)
 }
 
 // The fee should be estimated before signing, then after signing the fee should be checked.
@@ -183,57 +156,177 @@ func (tx *TxBuilder) ActualFee() int64 {
 	return i - o
 }
 
+// RegisterUnlockingSize adds an unlocking size estimator for a custom script template. It is used
+// by all size and fee estimates for locking scripts that match.
+func RegisterUnlockingSize(match fees.UnlockingSizeMatcher, estimate fees.UnlockingSizeEstimator) {
+	fees.RegisterUnlockingSize(match, estimate)
+}
+
+// EstimateSize returns the estimated size in bytes of the tx after signatures are added. It returns
+// an error for inputs with unknown script templates unless FallbackToP2PKH is set.
+func (tx *TxBuilder) EstimateSize() (int, error) {
+	return tx.estimateSize(tx.FallbackToP2PKH)
+}
+
 // EstimatedSize returns the estimated size in bytes of the tx after signatures are added.
-// It assumes all inputs are P2PKH, P2PK, or P2RPH.
+// Inputs with unknown script templates are assumed to be P2PKH. Use EstimateSize to get an error
+// instead.
 func (tx *TxBuilder) EstimatedSize() int {
-	result := BaseTxSize + wire.VarIntSerializeSize(uint64(len(tx.MsgTx.TxIn))) +
-		wire.VarIntSerializeSize(uint64(len(tx.MsgTx.TxOut)))
+	result, _ := tx.estimateSize(true)
+	return result
+}
 
-	for i, input := range tx.Inputs {
-		if len(input.LockingScript) == 0 {
-			txin := tx.MsgTx.TxIn[i]
-			if txin.UnlockingScript.IsFalseOpReturn() {
-				protocols := channels.NewProtocols(unlocking_data.NewProtocol())
-				msg, _, err := protocols.Parse(txin.UnlockingScript)
-				if err == nil {
-					unlockData, ok := msg.(*unlocking_data.UnlockingData)
-					if ok {
-						result += InputBaseSize + // outpoint + sequence
-							VarIntSerializeSize(unlockData.Size) +
-							int(unlockData.Size)
-						continue
-					}
-				}
-			}
-		}
+func (tx *TxBuilder) estimateSize(fallbackToP2PKH bool) (int, error) {
+	return fees.EstimateSize(tx, tx.unlockingSizer(fallbackToP2PKH))
+}
 
-		size, err := InputSize(input.LockingScript)
-		if err != nil {
-			result += MaximumP2PKHInputSize // Fall back to P2PKH
-			continue
+// unlockingSizer returns the sizer used to estimate the tx's unlocking scripts. With
+// fallbackToP2PKH inputs that can't be estimated are assumed to be P2PKH.
+func (tx *TxBuilder) unlockingSizer(fallbackToP2PKH bool) fees.UnlockingSizer {
+	var result fees.UnlockingSizer = fees.TemplateSizer{}
+	if tx.UnlockingSizer != nil {
+		result = tx.UnlockingSizer
+	}
+
+	if fallbackToP2PKH {
+		return fees.FallbackSizer{
+			Sizer: result,
+			Size:  MaximumP2PKHSigScriptSize,
 		}
+	}
+
+	return result
+}
 
-		result += size
+// inputSize returns the maximum size of an input spending the locking script, estimated with the
+// tx's unlocking sizer.
+func (tx *TxBuilder) inputSize(lockingScript bitcoin.Script) (int, error) {
+	unlockingSize, err := tx.unlockingSizer(false).UnlockingSize(lockingScript)
+	if err != nil {
+		return 0, err
 	}
 
-	for _, output := range tx.MsgTx.TxOut {
-		result += output.SerializeSize()
+	return fees.InputSizeForUnlockingScriptSize(unlockingSize), nil
+}
+
+// EstimatedSizes returns the estimated standard and data sizes in bytes of the tx after
+// signatures are added. Data bytes are the locking scripts of false OP_RETURN outputs.
+func (tx *TxBuilder) EstimatedSizes() (int, int) {
+	dataSize := tx.DataSize()
+	return tx.EstimatedSize() - dataSize, dataSize
+}
+
+// DataSize returns the number of bytes in the tx that are charged at the data fee rate.
+func (tx *TxBuilder) DataSize() int {
+	result := 0
+	for _, txout := range tx.MsgTx.TxOut {
+		result += fees.OutputDataSize(txout)
 	}
+	return result
+}
 
+// FeeModel returns the fee rates used for standard and data bytes. DataFeeRate defaults to FeeRate
+// when it is nil.
+func (tx *TxBuilder) FeeModel() FeeModel {
+	result := fees.NewFeeModel(tx.FeeRate)
+	if tx.DataFeeRate != nil {
+		result.Data = *tx.DataFeeRate
+	}
+	result.MinFee = tx.MinFee
+	result.Expiry = tx.FeeExpiry
 	return result
 }
 
+// SetDataFeeRate sets the fee rate for data bytes. Zero makes data bytes free.
+func (tx *TxBuilder) SetDataFeeRate(rate FeeRate) {
+	tx.DataFeeRate = &rate
+}
+
+// CheckFeeExpiry returns ErrFeeQuoteExpired if the fee quote the tx's fee rates came from has
+// expired.
+func (tx *TxBuilder) CheckFeeExpiry() error {
+	if tx.FeeModel().IsExpired(time.Now()) {
+		return errors.Wrap(ErrFeeQuoteExpired, tx.FeeExpiry.String())
+	}
+
+	return nil
+}
+
+// EstimateFee returns the fee required for the estimated size of the tx after signatures are
+// added. It returns an error for inputs with unknown script templates unless FallbackToP2PKH is
+// set.
+func (tx *TxBuilder) EstimateFee() (uint64, error) {
+	size, err := tx.EstimateSize()
+	if err != nil {
+		return 0, errors.Wrap(err, "estimate size")
+	}
+
+	return tx.FeeForSize(uint64(size)), nil
+}
+
+// EstimatedFee returns the fee required for the estimated size of the tx after signatures are
+// added. Inputs with unknown script templates are assumed to be P2PKH.
 func (tx *TxBuilder) EstimatedFee() uint64 {
-	return EstimatedFeeValue(uint64(tx.EstimatedSize()), float64(tx.FeeRate))
+	return tx.FeeForSize(uint64(tx.EstimatedSize()))
+}
+
+// FeeForSize returns the fee required for a tx of the specified size. The size must include the
+// tx's current outputs and any bytes beyond the tx's data bytes are charged as standard bytes.
+// It is TargetFee when that is set, otherwise the sizes at the fee model's rates but not less than
+// MinFee.
+func (tx *TxBuilder) FeeForSize(size uint64) uint64 {
+	dataSize := tx.DataSize()
+	standardSize := 0
+	if int(size) > dataSize {
+		standardSize = int(size) - dataSize
+	}
+
+	return tx.FeeForSizes(standardSize, dataSize)
+}
+
+// FeeForSizes returns the fee required for a tx with the specified standard and data sizes. It is
+// TargetFee when that is set, otherwise the sizes at the fee model's rates but not less than
+// MinFee.
+func (tx *TxBuilder) FeeForSizes(standardSize, dataSize int) uint64 {
+	if tx.TargetFee != 0 {
+		return tx.TargetFee
+	}
+
+	fee := tx.FeeModel().Fee(standardSize, dataSize)
+	if fee < tx.MinFee {
+		return tx.MinFee
+	}
+
+	return fee
+}
+
+// CheckFeeLimits returns FeeAboveMaximumError or FeeBelowMinimumError if the fee is outside of
+// the tx's MaxFee or MinFee.
+func (tx *TxBuilder) CheckFeeLimits(fee uint64) error {
+	if tx.MaxFee != 0 && fee > tx.MaxFee {
+		return FeeAboveMaximumError{Fee: fee, Maximum: tx.MaxFee}
+	}
+
+	if fee < tx.MinFee {
+		return FeeBelowMinimumError{Fee: fee, Minimum: tx.MinFee}
+	}
+
+	return nil
 }
 
 func (tx *TxBuilder) CalculateFee() error {
-	_, err := tx.AdjustFee(int64(tx.EstimatedFee()) - tx.ActualFee())
+	estimatedFee, err := tx.EstimateFee()
+	if err != nil {
+		return errors.Wrap(err, "estimate fee")
+	}
+
+	_, err = tx.AdjustFee(int64(estimatedFee) - tx.ActualFee())
 	return err
 }
 
+// ZeroizeFee moves all of the fee into the remainder outputs. It ignores MinFee.
 func (tx *TxBuilder) ZeroizeFee() error {
-	_, err := tx.AdjustFee(-tx.ActualFee())
+	_, err := tx.adjustFee(-tx.ActualFee())
 	return err
 }
 
@@ -241,22 +334,9 @@ func (tx *TxBuilder) ZeroizeFee() error {
 func (tx *TxBuilder) InputValue() uint64 {
 	inputValue := uint64(0)
 	for i, input := range tx.Inputs {
-		if input.Value == 0 {
-			txin := tx.MsgTx.TxIn[i]
-			if txin.UnlockingScript.IsFalseOpReturn() {
-				protocols := channels.NewProtocols(unlocking_data.NewProtocol())
-				msg, _, err := protocols.Parse(txin.UnlockingScript)
-				if err == nil {
-					unlockData, ok := msg.(*unlocking_data.UnlockingData)
-					if ok {
-						inputValue += unlockData.Value
-						continue
-					}
-				}
-			}
-		}
-
-		inputValue += input.Value
+		// Inputs without a value or unlocking data don't add anything.
+		value, _ := fees.InputValue(tx.MsgTx.TxIn[i], &wire.TxOut{Value: input.Value})
+		inputValue += value
 	}
 
 	return inputValue
@@ -278,7 +358,7 @@ func (tx *TxBuilder) Remainder() uint64 {
 	value := uint64(0)
 	for i, output := range tx.MsgTx.TxOut {
 		if tx.Outputs[i].IsRemainder {
-			value += EstimatedFeeValueDown(uint64(output.SerializeSize()), float64(tx.FeeRate))
+			value += EstimatedFeeValueDown(uint64(output.SerializeSize()), tx.FeeRate)
 			value += uint64(output.Value)
 		}
 	}
@@ -295,113 +375,134 @@ func (tx *TxBuilder) changeSum() uint64 {
 	return value
 }
 
-// adjustFee adjusts the tx fee up or down depending on if the amount is negative or positive.
+// AdjustFee adjusts the tx fee up or down depending on if the amount is negative or positive.
+// The adjustment is split between the remainder outputs based on tx.RemainderPolicy.
 // It returns true if no further fee adjustments should be attempted.
+// It returns FeeAboveMaximumError or FeeBelowMinimumError if the resulting fee is outside of the
+// tx's MaxFee or MinFee. The outputs are not modified when an error is returned.
 func (tx *TxBuilder) AdjustFee(amount int64) (bool, error) {
-	if amount == int64(0) {
-		return true, nil
+	previous := tx.saveOutputs()
+
+	done, err := tx.adjustFee(amount)
+	if err != nil {
+		previous.restore(tx)
+		return done, err
 	}
 
-	done := false
+	if err := tx.CheckFeeLimits(tx.Fee()); err != nil {
+		previous.restore(tx)
+		return done, errors.Wrap(err, "adjusted fee")
+	}
 
-	// Find change output
-	changeOutputIndex := 0xffffffff
-	for i, output := range tx.Outputs {
-		if output.IsRemainder {
-			changeOutputIndex = i
-			break
-		}
+	return done, nil
+}
+
+// savedOutputs is the state of a tx's outputs so that a failed fee adjustment can be undone. The
+// resulting fee can't be checked before adjusting since outputs below dust can be removed or left
+// off.
+type savedOutputs struct {
+	txouts        []*wire.TxOut
+	values        []uint64
+	outputs       []*OutputSupplement
+	droppedChange uint64
+}
+
+func (tx *TxBuilder) saveOutputs() savedOutputs {
+	result := savedOutputs{
+		txouts:        append([]*wire.TxOut(nil), tx.MsgTx.TxOut...),
+		values:        make([]uint64, len(tx.MsgTx.TxOut)),
+		outputs:       append([]*OutputSupplement(nil), tx.Outputs...),
+		droppedChange: tx.DroppedChange,
+	}
+
+	for i, txout := range tx.MsgTx.TxOut {
+		result.values[i] = txout.Value
+	}
+
+	return result
+}
+
+func (s savedOutputs) restore(tx *TxBuilder) {
+	for i, txout := range s.txouts {
+		txout.Value = s.values[i]
+	}
+
+	tx.MsgTx.TxOut = s.txouts
+	tx.Outputs = s.outputs
+	tx.DroppedChange = s.droppedChange
+}
+
+func (tx *TxBuilder) adjustFee(amount int64) (bool, error) {
+	tx.DroppedChange = 0
+	if amount == int64(0) {
+		return true, nil
 	}
 
 	if amount > int64(0) {
 		// Increase fee, transfer from change
-		if changeOutputIndex == 0xffffffff {
-			return false, errors.Wrap(ErrInsufficientValue, "No existing change for tx fee")
-		}
+		return tx.removeFeeFromRemainders(uint64(amount))
+	}
 
-		if tx.MsgTx.TxOut[changeOutputIndex].Value < uint64(amount) {
-			return false, errors.Wrap(ErrInsufficientValue, "Not enough change for tx fee")
-		}
+	// Decrease fee, transfer to change
+	if indexes := tx.remainderIndexes(); len(indexes) > 0 {
+		// Increase change, thereby decreasing the fee
+		// (amount is negative so subracting it increases the change value)
+		tx.addFeeToRemainders(indexes, uint64(-amount))
+		return false, nil
+	}
+
+	if _, allCommitted := tx.committedOutputs(); allCommitted {
+		return true, nil // an input signature commits to the current outputs
+	}
+
+	// Adjust amount of fee adjustment for new output being added.
+	estimatedSize, err := tx.EstimateSize()
+	if err != nil {
+		return false, errors.Wrap(err, "estimate size")
+	}
+	currentSize := uint64(estimatedSize)
+	currentFee := tx.FeeForSize(currentSize)
+
+	changeOutputSize, changeInputSize := tx.changeOutputSizes()
+	newSize := currentSize + uint64(changeOutputSize)
+	newFee := tx.FeeForSize(newSize)
 
-		// Decrease change, thereby increasing the fee
-		tx.MsgTx.TxOut[changeOutputIndex].Value -= uint64(amount)
+	changeOutputFee := newFee - currentFee
 
-		outputFee, inputFee, _ := OutputTotalCost(tx.MsgTx.TxOut[changeOutputIndex].LockingScript,
-			tx.FeeRate)
+	if changeOutputFee > uint64(-amount) {
+		tx.DroppedChange = uint64(-amount)
+		return true, nil // adding a change output would make the adjustment negative
+	}
 
-		// Check if change is below dust
-		if tx.MsgTx.TxOut[changeOutputIndex].Value < outputFee+inputFee {
-			if !tx.Outputs[changeOutputIndex].addedForFee {
-				// Don't remove outputs unless they were added by fee adjustment
-				return false, errors.Wrap(ErrInsufficientValue, "Not enough change for tx fee")
-			}
+	adjustment := uint64(-amount) - changeOutputFee
 
-			// Remove change output since it is less than dust. Dust will go to miner.
-			tx.MsgTx.TxOut = append(tx.MsgTx.TxOut[:changeOutputIndex],
-				tx.MsgTx.TxOut[changeOutputIndex+1:]...)
-			tx.Outputs = append(tx.Outputs[:changeOutputIndex], tx.Outputs[changeOutputIndex+1:]...)
-			done = true
+	// Add a change output if it would be more than the dust limit plus the fee to add the output
+	outputFee := EstimatedFeeValue(uint64(changeOutputSize), tx.FeeRate)
+	inputFee := EstimatedFeeValue(uint64(changeInputSize), tx.FeeRate)
+	if len(tx.ChangeScript) == 0 {
+		// Use two times the expected costs of adding an output so we don't fail out of this
+		// function with an error if the remaining amount is too small to worry about.
+		outputFee *= 2
+		inputFee *= 2
+	}
+	if adjustment > outputFee+inputFee {
+		if len(tx.ChangeScript) == 0 {
+			return false, errors.Wrap(ErrChangeAddressNeeded, fmt.Sprintf("Remaining: %d",
+				uint64(-amount)))
 		}
-	} else {
-		// Decrease fee, transfer to change
-		if changeOutputIndex == 0xffffffff {
-			// Adjust amount of fee adjustment for new output being added.
-			currentSize := uint64(tx.EstimatedSize())
-			currentFee := EstimatedFeeValue(currentSize, float64(tx.FeeRate))
-
-			var newSize uint64
-			if len(tx.ChangeScript) == 0 {
-				// Assume P2PKH for costs of adding an output so we don't fail out of this function
-				// with an error if the remaining amount is too small to worry about.
-				newSize = currentSize + P2PKHOutputSize
-			} else {
-				newSize = currentSize + uint64(OutputSize(tx.ChangeScript))
-			}
-			newFee := EstimatedFeeValue(newSize, float64(tx.FeeRate))
-
-			changeOutputFee := newFee - currentFee
-
-			if changeOutputFee > uint64(-amount) {
-				return true, nil // adding a change output would make the adjustment negative
-			}
-
-			adjustment := uint64(-amount) - changeOutputFee
-
-			// Add a change output if it would be more than the dust limit plus the fee to add the
-			// output
-			var outputFee, inputFee uint64
-			if len(tx.ChangeScript) == 0 {
-				// Assume P2PKH times two for costs of adding an output so we don't fail out of this
-				// function with an error if the remaining amount is too small to worry about.
-				outputFee = EstimatedFeeValue(P2PKHOutputSize*2, float64(tx.FeeRate))
-				inputFee = EstimatedFeeValue(uint64(MaximumP2PKHInputSize*2), float64(tx.FeeRate))
-			} else {
-				outputFee, inputFee, _ = OutputTotalCost(tx.ChangeScript, tx.FeeRate)
-			}
-			if adjustment > outputFee+inputFee {
-				if len(tx.ChangeScript) == 0 {
-					return false, errors.Wrap(ErrChangeAddressNeeded, fmt.Sprintf("Remaining: %d",
-						uint64(-amount)))
-				}
-
-				if err := tx.AddOutput(tx.ChangeScript, adjustment, true, false); err != nil {
-					return false, err
-				}
-
-				tx.Outputs[len(tx.Outputs)-1].KeyID = tx.ChangeKeyID
-				tx.Outputs[len(tx.Outputs)-1].addedForFee = true
-			} else {
-				// Leave less than dust as additional tx fee
-				done = true
-			}
-		} else {
-			// Increase change, thereby decreasing the fee
-			// (amount is negative so subracting it increases the change value)
-			tx.MsgTx.TxOut[changeOutputIndex].Value += uint64(-amount)
+
+		if err := tx.AddOutput(tx.ChangeScript, adjustment, true, false); err != nil {
+			return false, err
 		}
+
+		tx.Outputs[len(tx.Outputs)-1].KeyID = tx.ChangeKeyID
+		tx.Outputs[len(tx.Outputs)-1].addedForFee = true
+		return false, nil
 	}
 
-	return done, nil
+	// Leave less than dust as additional tx fee
+	tx.DroppedChange = uint64(-amount)
+	return true, nil
 }
 
 // VarIntSerializeSize returns the number of bytes it would take to serialize
@@ -427,10 +528,12 @@ func VarIntSerializeSize(val uint64) int {
 	return 9
 }
 
-func EstimatedFeeValue(size uint64, feeRate float64) uint64 {
-	return uint64(math.Ceil(float64(size) * feeRate))
+// EstimatedFeeValue returns the fee for the size at the fee rate, rounded up.
+func EstimatedFeeValue(size uint64, feeRate FeeRate) uint64 {
+	return feeRate.Fee(int(size))
 }
 
-func EstimatedFeeValueDown(size uint64, feeRate float64) uint64 {
-	return uint64(math.Floor(float64(size) * feeRate))
+// EstimatedFeeValueDown returns the fee for the size at the fee rate, rounded down.
+func EstimatedFeeValueDown(size uint64, feeRate FeeRate) uint64 {
+	return feeRate.FeeDown(int(size))
 }
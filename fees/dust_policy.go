@@ -0,0 +1,35 @@
+package fees
+
+// DustPolicy determines the minimum value of an output that nodes will relay.
+type DustPolicy interface {
+	// DustLimit returns the minimum value of a non-data output of the specified size.
+	DustLimit(outputSize int) uint64
+}
+
+// DustLimit implements the legacy dust policy, where an output is dust if it is worth less than
+// three times the fee to add it and a P2PKH input to spend it at the fee rate. The limit is never
+// less than one satoshi.
+func (r FeeRate) DustLimit(outputSize int) uint64 {
+	dust := r.Fee((outputSize + DustInputSize) * 3)
+	if dust < 1 {
+		return 1
+	}
+	return dust
+}
+
+// FixedDustPolicy is a dust policy where every output must be worth at least a fixed number of
+// satoshis. BSV nodes currently use a fixed dust limit of 1 satoshi.
+type FixedDustPolicy uint64
+
+// DustLimit returns the fixed dust limit.
+func (p FixedDustPolicy) DustLimit(outputSize int) uint64 {
+	return uint64(p)
+}
+
+// ZeroDustPolicy is a dust policy that allows outputs of any value, including zero.
+type ZeroDustPolicy struct{}
+
+// DustLimit returns zero.
+func (ZeroDustPolicy) DustLimit(outputSize int) uint64 {
+	return 0
+}
@@ -0,0 +1,145 @@
+package fees
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tokenized/arc"
+	"github.com/tokenized/pkg/json_envelope"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MAPIFeeTypeStandard is the mAPI fee type for standard bytes.
+	MAPIFeeTypeStandard = "standard"
+
+	// MAPIFeeTypeData is the mAPI fee type for data bytes.
+	MAPIFeeTypeData = "data"
+)
+
+// MAPIFeeQuote is the payload of a mAPI fee quote response.
+type MAPIFeeQuote struct {
+	APIVersion                string    `json:"apiVersion"`
+	Timestamp                 time.Time `json:"timestamp"`
+	ExpiryTime                time.Time `json:"expiryTime"`
+	MinerID                   string    `json:"minerId"`
+	CurrentHighestBlockHash   string    `json:"currentHighestBlockHash"`
+	CurrentHighestBlockHeight uint32    `json:"currentHighestBlockHeight"`
+	Fees                      []MAPIFee `json:"fees"`
+}
+
+// MAPIFee is the fee for one type of bytes in a mAPI fee quote.
+type MAPIFee struct {
+	FeeType   string        `json:"feeType"`
+	MiningFee MAPIFeeAmount `json:"miningFee"`
+	RelayFee  MAPIFeeAmount `json:"relayFee"`
+}
+
+// MAPIFeeAmount is a number of satoshis charged per number of bytes.
+type MAPIFeeAmount struct {
+	Satoshis uint64 `json:"satoshis"`
+	Bytes    uint64 `json:"bytes"`
+}
+
+// ParseFeePolicy parses either an ARC policy or a mAPI fee quote into a fee model.
+func ParseFeePolicy(b []byte) (*FeeModel, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, errors.Wrap(err, "json")
+	}
+
+	if _, ok := fields["policy"]; ok {
+		return ParseARCPolicy(b)
+	}
+
+	if _, ok := fields["payload"]; ok {
+		return ParseMAPIFeeQuote(b)
+	}
+
+	if _, ok := fields["fees"]; ok {
+		return ParseMAPIFeeQuote(b)
+	}
+
+	return nil, errors.Wrap(ErrUnknownFeePolicy, "no policy, payload, or fees")
+}
+
+// ParseARCPolicy parses the response from ARC's /v1/policy endpoint into a fee model. ARC charges
+// the same rate for standard and data bytes and doesn't specify an expiry or a minimum fee.
+func ParseARCPolicy(b []byte) (*FeeModel, error) {
+	policy := &arc.Policy{}
+	if err := json.Unmarshal(b, policy); err != nil {
+		return nil, errors.Wrap(err, "json")
+	}
+
+	rate, err := NewFeeRateFromAmount(policy.Policy.MiningFee.Satoshis,
+		policy.Policy.MiningFee.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "mining fee")
+	}
+
+	result := NewFeeModel(rate)
+	return &result, nil
+}
+
+// ParseMAPIFeeQuote parses a mAPI fee quote into a fee model. The quote can either be wrapped in a
+// JSON envelope, as returned by the mAPI endpoint, or be the bare payload. If the envelope is signed
+// then the signature is verified. The data rate is the same as the standard rate if the quote
+// doesn't contain a data fee.
+func ParseMAPIFeeQuote(b []byte) (*FeeModel, error) {
+	envelope := &json_envelope.JSONEnvelope{}
+	if err := json.Unmarshal(b, envelope); err != nil {
+		return nil, errors.Wrap(err, "json envelope")
+	}
+
+	payload := b
+	if len(envelope.Payload) > 0 {
+		if envelope.Signature != nil {
+			if err := envelope.Verify(); err != nil {
+				return nil, errors.Wrap(err, "verify")
+			}
+		}
+
+		payload = []byte(envelope.Payload)
+	}
+
+	quote := &MAPIFeeQuote{}
+	if err := json.Unmarshal(payload, quote); err != nil {
+		return nil, errors.Wrap(err, "json payload")
+	}
+
+	return quote.FeeModel()
+}
+
+// FeeModel returns the fee model for the mining fees in the quote. mAPI quotes don't specify a
+// minimum fee.
+func (q MAPIFeeQuote) FeeModel() (*FeeModel, error) {
+	var standard, data *FeeRate
+	for _, fee := range q.Fees {
+		rate, err := NewFeeRateFromAmount(fee.MiningFee.Satoshis, fee.MiningFee.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s mining fee", fee.FeeType)
+		}
+
+		switch fee.FeeType {
+		case MAPIFeeTypeStandard:
+			standard = &rate
+		case MAPIFeeTypeData:
+			data = &rate
+		}
+	}
+
+	if standard == nil {
+		return nil, errors.Wrap(ErrUnknownFeePolicy, fmt.Sprintf("missing %s fee",
+			MAPIFeeTypeStandard))
+	}
+
+	result := NewFeeModel(*standard)
+	if data != nil {
+		result.Data = *data
+	}
+	result.Expiry = q.ExpiryTime
+
+	return &result, nil
+}
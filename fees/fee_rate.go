@@ -0,0 +1,160 @@
+package fees
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+
+	"github.com/tokenized/bitcoin_interpreter"
+	"github.com/tokenized/pkg/wire"
+)
+
+// FeeRate is a fee rate in satoshis per 1000 bytes. Integer rates avoid the rounding errors of
+// floating point sat/byte rates at low rates like 0.05 or 0.001 sat/byte.
+type FeeRate uint64
+
+// NewFeeRate returns the fee rate for a rate in satoshis per byte, rounded to the nearest satoshi
+// per 1000 bytes. It is a compatibility layer for rates that are configured as floating point.
+func NewFeeRate(satoshisPerByte float64) FeeRate {
+	if satoshisPerByte <= 0 {
+		return 0
+	}
+
+	return FeeRate(math.Round(satoshisPerByte * 1000.0))
+}
+
+// Fee returns the fee for the specified size in bytes, rounded up to the next satoshi.
+func (r FeeRate) Fee(size int) uint64 {
+	if size <= 0 {
+		return 0
+	}
+
+	hi, lo := bits.Mul64(uint64(size), uint64(r))
+	quotient, remainder := bits.Div64(hi, lo, 1000)
+	if remainder != 0 {
+		quotient++
+	}
+
+	return quotient
+}
+
+// NewFeeRateFromAmount returns the fee rate for a number of satoshis per number of bytes, like the
+// mining fees in ARC policies and mAPI fee quotes. It is rounded up to the next satoshi per 1000
+// bytes.
+func NewFeeRateFromAmount(satoshis, bytes uint64) (FeeRate, error) {
+	if bytes == 0 {
+		return 0, ErrInvalidFeeAmount
+	}
+
+	hi, lo := bits.Mul64(satoshis, 1000)
+	if hi >= bytes {
+		return 0, ErrInvalidFeeAmount
+	}
+
+	quotient, remainder := bits.Div64(hi, lo, bytes)
+	if remainder != 0 {
+		quotient++
+	}
+
+	return FeeRate(quotient), nil
+}
+
+// FeeDown returns the fee for the specified size in bytes, rounded down to the previous satoshi.
+func (r FeeRate) FeeDown(size int) uint64 {
+	if size <= 0 {
+		return 0
+	}
+
+	hi, lo := bits.Mul64(uint64(size), uint64(r))
+	quotient, _ := bits.Div64(hi, lo, 1000)
+	return quotient
+}
+
+// SatoshisPerByte returns the fee rate in satoshis per byte.
+func (r FeeRate) SatoshisPerByte() float64 {
+	return float64(r) / 1000.0
+}
+
+func (r FeeRate) String() string {
+	return fmt.Sprintf("%d sat/kB", uint64(r))
+}
+
+// FeeModel contains the fee rates a miner charges for standard bytes and for data bytes. Data bytes
+// are the locking scripts of false OP_RETURN outputs. All other bytes are standard.
+// MinFee is the minimum fee for any tx and Expiry is when the rates are no longer valid. Both are
+// zero when not specified.
+type FeeModel struct {
+	Standard FeeRate   `json:"standard"`
+	Data     FeeRate   `json:"data"`
+	MinFee   uint64    `json:"min_fee,omitempty"`
+	Expiry   time.Time `json:"expiry,omitempty"`
+}
+
+// NewFeeModel returns a fee model that charges the same rate for all bytes.
+func NewFeeModel(rate FeeRate) FeeModel {
+	return FeeModel{
+		Standard: rate,
+		Data:     rate,
+	}
+}
+
+// IsExpired returns true if the model has an expiry and it is before the specified time.
+func (m FeeModel) IsExpired(now time.Time) bool {
+	return !m.Expiry.IsZero() && now.After(m.Expiry)
+}
+
+// Fee returns the fee for the specified numbers of standard and data bytes, rounded up to the
+// next satoshi.
+func (m FeeModel) Fee(standardSize, dataSize int) uint64 {
+	if standardSize < 0 {
+		standardSize = 0
+	}
+	if dataSize < 0 {
+		dataSize = 0
+	}
+
+	// Sum in millisatoshis before rounding so there is only one rounding.
+	hi, lo := bits.Mul64(uint64(standardSize), uint64(m.Standard))
+	dataHi, dataLo := bits.Mul64(uint64(dataSize), uint64(m.Data))
+	lo, carry := bits.Add64(lo, dataLo, 0)
+	hi, _ = bits.Add64(hi, dataHi, carry)
+
+	quotient, remainder := bits.Div64(hi, lo, 1000)
+	if remainder != 0 {
+		quotient++
+	}
+
+	return quotient
+}
+
+// IsDataOutput returns true if the output's locking script is charged at the data rate.
+func IsDataOutput(txout *wire.TxOut) bool {
+	return txout.LockingScript.IsFalseOpReturn()
+}
+
+// OutputDataSize returns the number of bytes of the output that are charged at the data rate.
+func OutputDataSize(txout *wire.TxOut) int {
+	if !IsDataOutput(txout) {
+		return 0
+	}
+
+	return len(txout.LockingScript)
+}
+
+// EstimateSizes returns the estimated standard and data sizes of the tx after it is signed.
+func EstimateSizes(tx bitcoin_interpreter.TransactionWithOutputs,
+	unlocker UnlockingSizer) (int, int, error) {
+
+	size, err := EstimateSize(tx, unlocker)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	dataSize := 0
+	for _, txout := range tx.GetMsgTx().TxOut {
+		dataSize += OutputDataSize(txout)
+	}
+
+	return size - dataSize, dataSize, nil
+}
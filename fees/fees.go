@@ -1,7 +1,7 @@
 package fees
 
 import (
-	"math"
+	"bytes"
 
 	"github.com/tokenized/bitcoin_interpreter"
 	"github.com/tokenized/bitcoin_interpreter/agent_bitcoin_transfer"
@@ -41,10 +41,57 @@ const (
 
 var (
 	MissingUnlockingData = errors.New("Missing Unlocking Data")
+
+	// ErrInvalidFeeAmount means that a fee amount in a policy can't be converted to a fee rate.
+	ErrInvalidFeeAmount = errors.New("Invalid Fee Amount")
+
+	// ErrUnknownFeePolicy means that a fee policy document is not in a recognized format.
+	ErrUnknownFeePolicy = errors.New("Unknown Fee Policy")
 )
 
+// UnlockingSizer estimates the size of the unlocking script for a locking script. It is the part of
+// bitcoin_interpreter.Unlocker used to estimate tx sizes, so any unlocker can be used.
+type UnlockingSizer interface {
+	UnlockingSize(lockingScript bitcoin.Script) (int, error)
+}
+
+// RedeemScripts is implemented by txs that can provide the redeem scripts of their P2SH inputs.
+// The size of a P2SH input can't be estimated from its locking script alone since the locking
+// script only contains the hash of the redeem script.
+type RedeemScripts interface {
+	// InputRedeemScript returns the redeem script of the input or nil if it doesn't have one.
+	InputRedeemScript(index int) bitcoin.Script
+}
+
+// FallbackSizer estimates unlocking sizes with Sizer and uses Size for locking scripts that Sizer
+// can't estimate. Size is also used for inputs whose locking script isn't known and that don't
+// have unlocking data.
+type FallbackSizer struct {
+	Sizer UnlockingSizer
+	Size  int
+}
+
+// UnlockingSize estimates the size of the unlocking script for the locking script.
+func (s FallbackSizer) UnlockingSize(lockingScript bitcoin.Script) (int, error) {
+	size, err := s.Sizer.UnlockingSize(lockingScript)
+	if err != nil {
+		return s.Size, nil
+	}
+
+	return size, nil
+}
+
+// TemplateSizer estimates the size of unlocking scripts for the templates supported by
+// EstimateUnlockingSize, including those registered with RegisterUnlockingSize.
+type TemplateSizer struct{}
+
+// UnlockingSize estimates the size of the unlocking script for the locking script.
+func (TemplateSizer) UnlockingSize(lockingScript bitcoin.Script) (int, error) {
+	return EstimateUnlockingSize(lockingScript)
+}
+
 func EstimateFee(tx bitcoin_interpreter.TransactionWithOutputs,
-	unlocker bitcoin_interpreter.Unlocker, feeRate float64) (uint64, error) {
+	unlocker UnlockingSizer, feeRate FeeRate) (uint64, error) {
 
 	size, err := EstimateSize(tx, unlocker)
 	if err != nil {
@@ -54,24 +101,22 @@ func EstimateFee(tx bitcoin_interpreter.TransactionWithOutputs,
 	return EstimateFeeValue(size, feeRate), nil
 }
 
-func EstimateFeeValue(size int, feeRate float64) uint64 {
-	return uint64(math.Ceil(float64(size) * feeRate))
+// EstimateFeeValue returns the fee for the specified size in bytes, rounded up.
+func EstimateFeeValue(size int, feeRate FeeRate) uint64 {
+	return feeRate.Fee(size)
 }
 
+// EstimateSize returns the estimated size of the tx after it is fully unlocked. If tx implements
+// RedeemScripts then the redeem scripts are used to estimate the size of P2SH inputs.
 func EstimateSize(tx bitcoin_interpreter.TransactionWithOutputs,
-	unlocker bitcoin_interpreter.Unlocker) (int, error) {
+	unlocker UnlockingSizer) (int, error) {
 	msgTx := tx.GetMsgTx()
 
 	result := BaseTxSize + wire.VarIntSerializeSize(uint64(len(msgTx.TxIn))) +
 		wire.VarIntSerializeSize(uint64(len(msgTx.TxOut)))
 
-	for inputIndex, txin := range msgTx.TxIn {
-		inputOutput, err := tx.InputOutput(inputIndex)
-		if err != nil {
-			return 0, errors.Wrapf(err, "input %d output", inputIndex)
-		}
-
-		inputSize, err := EstimateInputSize(txin, inputOutput.LockingScript, unlocker)
+	for inputIndex := range msgTx.TxIn {
+		inputSize, err := EstimateTxInputSize(tx, inputIndex, unlocker)
 		if err != nil {
 			return 0, errors.Wrapf(err, "input %d size", inputIndex)
 		}
@@ -86,8 +131,35 @@ func EstimateSize(tx bitcoin_interpreter.TransactionWithOutputs,
 	return result, nil
 }
 
+// EstimateTxInputSize returns the estimated size of the tx's input after it is unlocked. If tx
+// implements RedeemScripts and the input has a redeem script then it is estimated as P2SH. If the
+// input's output isn't known then the size must be encoded as unlocking data.
+func EstimateTxInputSize(tx bitcoin_interpreter.TransactionWithOutputs, inputIndex int,
+	unlocker UnlockingSizer) (int, error) {
+
+	if redeemScripts, ok := tx.(RedeemScripts); ok {
+		if redeemScript := redeemScripts.InputRedeemScript(inputIndex); len(redeemScript) > 0 {
+			unlockingSize, err := p2shUnlockingSize(redeemScript, unlocker)
+			if err != nil {
+				return 0, err
+			}
+
+			return InputSizeForUnlockingScriptSize(unlockingSize), nil
+		}
+	}
+
+	var lockingScript bitcoin.Script
+	if inputOutput, err := tx.InputOutput(inputIndex); err == nil {
+		lockingScript = inputOutput.LockingScript
+	}
+
+	return EstimateInputSize(tx.GetMsgTx().TxIn[inputIndex], lockingScript, unlocker)
+}
+
+// EstimateInputSize returns the estimated size of the input after it is unlocked. If the locking
+// script is not known then the size must be encoded as unlocking data in the unlocking script.
 func EstimateInputSize(txin *wire.TxIn, lockingScript bitcoin.Script,
-	unlocker bitcoin_interpreter.Unlocker) (int, error) {
+	unlocker UnlockingSizer) (int, error) {
 	if len(lockingScript) != 0 {
 		// Estimate the size of the unlocking script.
 		unlockingSize, err := unlocker.UnlockingSize(lockingScript)
@@ -95,34 +167,51 @@ func EstimateInputSize(txin *wire.TxIn, lockingScript bitcoin.Script,
 			return 0, errors.Wrapf(err, "unlocking size")
 		}
 
-		return InputBaseSize + // outpoint + sequence
-				wire.VarIntSerializeSize(uint64(unlockingSize)) + unlockingSize, // script
-			nil
+		return InputSizeForUnlockingScriptSize(unlockingSize), nil
 	}
 
 	// The locking script is not known so the only way we can estimate the final size is if
 	// unlocking data has been encoded in the unlocking script.
 	if !txin.UnlockingScript.IsFalseOpReturn() {
-		return 0, MissingUnlockingData
+		return missingUnlockingDataSize(unlocker)
 	}
 
 	protocols := channels.NewProtocols(unlocking_data.NewProtocol())
 	msg, _, err := protocols.Parse(txin.UnlockingScript)
 	if err != nil {
-		return 0, MissingUnlockingData
+		return missingUnlockingDataSize(unlocker)
 	}
 
 	unlockingData, ok := msg.(*unlocking_data.UnlockingData)
 	if !ok {
-		return 0, MissingUnlockingData
+		return missingUnlockingDataSize(unlocker)
 	}
 
-	return InputBaseSize + // outpoint + sequence
-			wire.VarIntSerializeSize(unlockingData.Size) + int(unlockingData.Size), // script
-		nil
+	return InputSizeForUnlockingScriptSize(int(unlockingData.Size)), nil
+}
+
+// missingUnlockingDataSize returns the fallback input size if the unlocker is a FallbackSizer,
+// otherwise MissingUnlockingData.
+func missingUnlockingDataSize(unlocker UnlockingSizer) (int, error) {
+	if fallback, ok := unlocker.(FallbackSizer); ok {
+		return InputSizeForUnlockingScriptSize(fallback.Size), nil
+	}
+
+	return 0, MissingUnlockingData
 }
 
+// EstimateUnlockingSize returns the maximum size of the unlocking script for the locking script.
+// Templates registered with RegisterUnlockingSize are checked before the built in templates. It
+// returns bitcoin.ErrUnknownScriptTemplate if no template matches.
 func EstimateUnlockingSize(lockingScript bitcoin.Script) (int, error) {
+	return DefaultUnlockingSizes.UnlockingSize(lockingScript)
+}
+
+// estimateTemplateUnlockingSize returns the maximum size of the unlocking script for the built in
+// templates. Embedded locking scripts are estimated with the unlocker.
+func estimateTemplateUnlockingSize(lockingScript bitcoin.Script,
+	unlocker UnlockingSizer) (int, error) {
+
 	if lockingScript.IsP2PK() {
 		// Only a signature in a P2PK unlocking script
 		return MaxSignaturesPushDataSize, nil
@@ -139,34 +228,142 @@ func EstimateUnlockingSize(lockingScript bitcoin.Script) (int, error) {
 			int(required)*(MaxSignaturesPushDataSize+PublicKeyPushDataSize+1), nil
 	}
 
-	if info, err := agent_bitcoin_transfer.MatchScript(lockingScript); err != nil {
-		agentUnlockingSize, err := EstimateUnlockingSize(info.AgentLockingScript)
+	if required, _, err := ParseMultiSig(lockingScript); err == nil {
+		// OP_FALSE for the extra item removed by OP_CHECKMULTISIG and a signature for each
+		// required signer
+		return 1 + required*MaxSignaturesPushDataSize, nil
+	}
+
+	if _, err := ParseRPuzzle(lockingScript); err == nil {
+		// Signature and a public key in an R-puzzle unlocking script
+		return MaxSignaturesPushDataSize + PublicKeyPushDataSize, nil
+	}
+
+	if info, err := agent_bitcoin_transfer.MatchScript(lockingScript); err == nil && info != nil {
+		agentUnlockingScript := info.AgentLockingScript.Copy()
+		agentUnlockingScript.RemoveHardVerify()
+		agentUnlockingSize, err := unlocker.UnlockingSize(agentUnlockingScript)
 		if err != nil {
-			return 0, errors.Wrap(err, "agent")
+			return 0, errors.Wrap(err, "agent unlocking size")
 		}
 
 		return agent_bitcoin_transfer.ApproveUnlockingSize(agentUnlockingSize), nil
 	}
 
-	return 0, bitcoin.ErrWrongScriptTemplate
+	return 0, bitcoin.ErrUnknownScriptTemplate
+}
+
+// P2SHUnlockingSize returns the maximum size of the unlocking script for a P2SH locking script
+// with the redeem script. It is the unlocking script for the redeem script followed by a push of
+// the redeem script.
+func P2SHUnlockingSize(redeemScript bitcoin.Script) (int, error) {
+	return p2shUnlockingSize(redeemScript, TemplateSizer{})
+}
+
+func p2shUnlockingSize(redeemScript bitcoin.Script, unlocker UnlockingSizer) (int, error) {
+	unlockingSize, err := unlocker.UnlockingSize(redeemScript)
+	if err != nil {
+		return 0, errors.Wrap(err, "redeem script")
+	}
+
+	return unlockingSize + len(bitcoin.PushData(redeemScript)), nil
+}
+
+// P2SHInputSize returns the maximum size of an input spending a P2SH locking script with the
+// redeem script.
+func P2SHInputSize(redeemScript bitcoin.Script) (int, error) {
+	unlockingSize, err := P2SHUnlockingSize(redeemScript)
+	if err != nil {
+		return 0, err
+	}
+
+	return InputSizeForUnlockingScriptSize(unlockingSize), nil
+}
+
+// ParseMultiSig returns the number of signatures required and the public keys of a bare multi-sig
+// script like OP_2 <public key> <public key> <public key> OP_3 OP_CHECKMULTISIG.
+func ParseMultiSig(lockingScript bitcoin.Script) (int, [][]byte, error) {
+	items, err := bitcoin.ParseScriptItems(bytes.NewReader(lockingScript), -1)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	l := len(items)
+	if l < 4 || !isSmallIntItem(items[0]) || !isSmallIntItem(items[l-2]) ||
+		items[l-1].Type != bitcoin.ScriptItemTypeOpCode ||
+		items[l-1].OpCode != bitcoin.OP_CHECKMULTISIG {
+		return 0, nil, bitcoin.ErrUnknownScriptTemplate
+	}
+
+	required := int(items[0].OpCode-bitcoin.OP_1) + 1
+	total := int(items[l-2].OpCode-bitcoin.OP_1) + 1
+	if total != l-3 || required > total {
+		return 0, nil, bitcoin.ErrUnknownScriptTemplate
+	}
+
+	publicKeys := make([][]byte, 0, total)
+	for _, item := range items[1 : l-2] {
+		if item.Type != bitcoin.ScriptItemTypePushData {
+			return 0, nil, bitcoin.ErrUnknownScriptTemplate
+		}
+		publicKeys = append(publicKeys, item.Data)
+	}
+
+	return required, publicKeys, nil
+}
+
+// RPuzzleScriptPrefix is the part of an R-puzzle locking script before the hash of r. It extracts r
+// from the DER encoded signature that is below the public key on the stack and hashes it.
+var RPuzzleScriptPrefix = bitcoin.Script{bitcoin.OP_OVER, bitcoin.OP_3, bitcoin.OP_SPLIT,
+	bitcoin.OP_NIP, bitcoin.OP_1, bitcoin.OP_SPLIT, bitcoin.OP_SWAP, bitcoin.OP_SPLIT,
+	bitcoin.OP_DROP, bitcoin.OP_HASH160}
+
+// RPuzzleScriptSuffix is the part of an R-puzzle locking script after the hash of r.
+var RPuzzleScriptSuffix = bitcoin.Script{bitcoin.OP_EQUALVERIFY, bitcoin.OP_CHECKSIG}
+
+// ParseRPuzzle returns the hash of r from an R-puzzle (P2RPH) locking script like
+// OP_OVER OP_3 OP_SPLIT OP_NIP OP_1 OP_SPLIT OP_SWAP OP_SPLIT OP_DROP OP_HASH160 <r hash>
+// OP_EQUALVERIFY OP_CHECKSIG.
+func ParseRPuzzle(lockingScript bitcoin.Script) ([]byte, error) {
+	prefixSize := len(RPuzzleScriptPrefix)
+	hashSize := bitcoin.Hash20Size + 1
+	if len(lockingScript) != prefixSize+hashSize+len(RPuzzleScriptSuffix) ||
+		!bytes.Equal(lockingScript[:prefixSize], RPuzzleScriptPrefix) ||
+		lockingScript[prefixSize] != bitcoin.Hash20Size ||
+		!bytes.Equal(lockingScript[prefixSize+hashSize:], RPuzzleScriptSuffix) {
+		return nil, bitcoin.ErrUnknownScriptTemplate
+	}
+
+	return lockingScript[prefixSize+1 : prefixSize+hashSize], nil
+}
+
+func isSmallIntItem(item *bitcoin.ScriptItem) bool {
+	return item.Type == bitcoin.ScriptItemTypeOpCode && item.OpCode >= bitcoin.OP_1 &&
+		item.OpCode <= bitcoin.OP_16
+}
+
+// InputSize returns the maximum size of an input spending the locking script.
+func InputSize(lockingScript bitcoin.Script) (int, error) {
+	unlockingSize, err := EstimateUnlockingSize(lockingScript)
+	if err != nil {
+		return 0, err
+	}
+
+	return InputSizeForUnlockingScriptSize(unlockingSize), nil
 }
 
 // OutputTotalCost calculates the satoshis required in tx fees to include an output with the
 // specified locking script and then to include an input in a tx to spend that output. If the
 // unlocking script size can't be determined it will still return the output fee and a zero for the
 // input size with an error.
-func OutputTotalCost(lockingScript bitcoin.Script, feeRate float64) (uint64, uint64, error) {
+func OutputTotalCost(lockingScript bitcoin.Script, feeRate FeeRate) (uint64, uint64, error) {
 	outputSize := OutputSize(lockingScript)
 
-	unlockingScriptSize, err := EstimateUnlockingSize(lockingScript)
+	inputSize, err := InputSize(lockingScript)
 	if err != nil {
-		return EstimateFeeValue(OutputSize(lockingScript), feeRate), 0,
-			errors.Wrapf(err, "unlocking size")
+		return EstimateFeeValue(outputSize, feeRate), 0, errors.Wrapf(err, "input size")
 	}
 
-	inputSize := InputBaseSize + wire.VarIntSerializeSize(uint64(unlockingScriptSize)) +
-		unlockingScriptSize
-
 	return EstimateFeeValue(outputSize, feeRate), EstimateFeeValue(inputSize, feeRate), nil
 }
 
@@ -186,9 +383,10 @@ func InputsValue(tx bitcoin_interpreter.TransactionWithOutputs) (uint64, error)
 	result := uint64(0)
 
 	for inputIndex, txin := range msgTx.TxIn {
+		// If the input's output isn't known then the value must be encoded as unlocking data.
 		inputOutput, err := tx.InputOutput(inputIndex)
 		if err != nil {
-			return 0, errors.Wrapf(err, "input %d output", inputIndex)
+			inputOutput = &wire.TxOut{}
 		}
 
 		inputValue, err := InputValue(txin, inputOutput)
@@ -233,7 +431,7 @@ func InputValue(txin *wire.TxIn, inputOutput *wire.TxOut) (uint64, error) {
 		return 0, MissingUnlockingData
 	}
 
-	return unlockingData.Size, nil
+	return unlockingData.Value, nil
 }
 
 func InputSizeForUnlockingScriptSize(unlockingScriptSize int) int {
@@ -253,64 +451,60 @@ func OutputSizeForLockingScriptSize(lockingScriptSize int) int {
 }
 
 // DustLimit calculates the dust limit for an output.
-func DustLimit(outputSize int, dustFeeRate float64) uint64 {
-	if dustFeeRate == 0 {
-		return uint64(1)
-	}
+func DustLimit(outputSize int, dustPolicy DustPolicy) uint64 {
+	return dustPolicy.DustLimit(outputSize)
+}
 
-	dust := EstimateFeeValue(((outputSize + DustInputSize) * 3), dustFeeRate)
-	if dust < 1 {
-		return uint64(1)
+// DustLimitForOutput calculates the dust limit. Data outputs don't have a dust limit.
+func DustLimitForOutput(output *wire.TxOut, dustPolicy DustPolicy) uint64 {
+	if IsDataOutput(output) {
+		return 0
 	}
-	return dust
-}
 
-// DustLimitForOutput calculates the dust limit
-func DustLimitForOutput(output *wire.TxOut, feeRate float64) uint64 {
-	return DustLimit(output.SerializeSize(), feeRate)
+	return dustPolicy.DustLimit(output.SerializeSize())
 }
 
 // DustLimitForLockingScript calculates the dust limit
-func DustLimitForLockingScript(lockingScript bitcoin.Script, feeRate float64) uint64 {
+func DustLimitForLockingScript(lockingScript bitcoin.Script, dustPolicy DustPolicy) uint64 {
 	output := &wire.TxOut{
 		LockingScript: lockingScript,
 	}
-	return DustLimitForOutput(output, feeRate)
+	return DustLimitForOutput(output, dustPolicy)
 }
 
-func DustLimitForLockingScriptSize(lockingScriptSize int, feeRate float64) uint64 {
-	return DustLimit(OutputSizeForLockingScriptSize(lockingScriptSize), feeRate)
+func DustLimitForLockingScriptSize(lockingScriptSize int, dustPolicy DustPolicy) uint64 {
+	return dustPolicy.DustLimit(OutputSizeForLockingScriptSize(lockingScriptSize))
 }
 
-func OutputFeeForLockingScript(lockingScript bitcoin.Script, feeRate float64) uint64 {
+func OutputFeeForLockingScript(lockingScript bitcoin.Script, feeRate FeeRate) uint64 {
 	output := &wire.TxOut{
 		LockingScript: lockingScript,
 	}
 	outputSize := output.SerializeSize()
 
-	return EstimateFeeValue(outputSize, float64(feeRate))
+	return EstimateFeeValue(outputSize, feeRate)
 }
 
 // OutputFeeAndDustForLockingScript returns the tx fee required to include the locking script as an
 // output in a tx and the dust limit of that output.
-func OutputFeeAndDustForLockingScript(lockingScript bitcoin.Script,
-	dustFeeRate, feeRate float64) (uint64, uint64) {
+func OutputFeeAndDustForLockingScript(lockingScript bitcoin.Script, dustPolicy DustPolicy,
+	feeRate FeeRate) (uint64, uint64) {
 
 	output := &wire.TxOut{
 		LockingScript: lockingScript,
 	}
 	outputSize := output.SerializeSize()
 
-	return EstimateFeeValue(outputSize, float64(feeRate)), DustLimit(outputSize, dustFeeRate)
+	return EstimateFeeValue(outputSize, feeRate), DustLimitForOutput(output, dustPolicy)
 }
 
 func OutputSizeAndDustForLockingScript(lockingScript bitcoin.Script,
-	dustFeeRate float64) (int, uint64) {
+	dustPolicy DustPolicy) (int, uint64) {
 
 	output := &wire.TxOut{
 		LockingScript: lockingScript,
 	}
 	outputSize := output.SerializeSize()
 
-	return outputSize, DustLimit(outputSize, dustFeeRate)
+	return outputSize, DustLimitForOutput(output, dustPolicy)
 }
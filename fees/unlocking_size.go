@@ -0,0 +1,79 @@
+package fees
+
+import (
+	"sync"
+
+	"github.com/tokenized/pkg/bitcoin"
+)
+
+// UnlockingSizeMatcher returns true if the locking script matches a script template.
+type UnlockingSizeMatcher func(lockingScript bitcoin.Script) bool
+
+// UnlockingSizeEstimator returns the maximum size of the unlocking script for a locking script that
+// matches a script template.
+type UnlockingSizeEstimator func(lockingScript bitcoin.Script) (int, error)
+
+type unlockingSizeTemplate struct {
+	match    UnlockingSizeMatcher
+	estimate UnlockingSizeEstimator
+}
+
+// UnlockingSizeRegistry contains unlocking size estimators for script templates that are not
+// built in. It implements UnlockingSizer and falls back to the built in templates for locking
+// scripts that don't match a registered template. It is safe for concurrent use.
+type UnlockingSizeRegistry struct {
+	templates []unlockingSizeTemplate
+	lock      sync.RWMutex
+}
+
+// DefaultUnlockingSizes is the registry used by EstimateUnlockingSize.
+var DefaultUnlockingSizes = &UnlockingSizeRegistry{}
+
+// NewUnlockingSizeRegistry returns an empty registry. It can be set as a TxBuilder's
+// UnlockingSizer to estimate templates that are only used by that tx.
+func NewUnlockingSizeRegistry() *UnlockingSizeRegistry {
+	return &UnlockingSizeRegistry{}
+}
+
+// RegisterUnlockingSize adds a script template to the default registry.
+func RegisterUnlockingSize(match UnlockingSizeMatcher, estimate UnlockingSizeEstimator) {
+	DefaultUnlockingSizes.Register(match, estimate)
+}
+
+// Register adds a script template. Templates are checked in the order they are registered.
+func (r *UnlockingSizeRegistry) Register(match UnlockingSizeMatcher,
+	estimate UnlockingSizeEstimator) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.templates = append(r.templates, unlockingSizeTemplate{
+		match:    match,
+		estimate: estimate,
+	})
+}
+
+// UnlockingSize returns the estimate from the first registered template that matches the locking
+// script, otherwise the estimate for the built in templates. Scripts embedded in built in
+// templates, like the agent locking script of an agent bitcoin transfer, are also estimated with
+// the registry.
+func (r *UnlockingSizeRegistry) UnlockingSize(lockingScript bitcoin.Script) (int, error) {
+	if estimate := r.find(lockingScript); estimate != nil {
+		return estimate(lockingScript)
+	}
+
+	return estimateTemplateUnlockingSize(lockingScript, r)
+}
+
+func (r *UnlockingSizeRegistry) find(lockingScript bitcoin.Script) UnlockingSizeEstimator {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, template := range r.templates {
+		if template.match(lockingScript) {
+			return template.estimate
+		}
+	}
+
+	return nil
+}
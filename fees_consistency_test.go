@@ -0,0 +1,162 @@
+package txbuilder
+
+import (
+	"testing"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/unlocking_data"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/wire"
+	"github.com/tokenized/txbuilder/fees"
+)
+
+// Test_FeesConsistency_SignedSize verifies the estimated size against the serialized size of the
+// tx after it is signed.
+func Test_FeesConsistency_SignedSize(t *testing.T) {
+	var keys []bitcoin.Key
+	for i := 0; i < 4; i++ {
+		key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+		if err != nil {
+			t.Fatalf("Failed to generate key : %s", err)
+		}
+		keys = append(keys, key)
+	}
+
+	ra, err := bitcoin.NewRawAddressPublicKey(keys[0].PublicKey())
+	if err != nil {
+		t.Fatalf("Failed to create P2PK address : %s", err)
+	}
+	p2pkScript, _ := ra.LockingScript()
+
+	p2pkhScript, _ := keys[1].LockingScript()
+
+	var pkhs [][]byte
+	for _, key := range keys[1:] {
+		pkhs = append(pkhs, bitcoin.Hash160(key.PublicKey().Bytes()))
+	}
+	ra, err = bitcoin.NewRawAddressMultiPKH(2, pkhs)
+	if err != nil {
+		t.Fatalf("Failed to create multi-PKH address : %s", err)
+	}
+	multiPKHScript, _ := ra.LockingScript()
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	for _, lockingScript := range []bitcoin.Script{p2pkScript, p2pkhScript, multiPKHScript} {
+		if err := tx.AddInputUTXO(bitcoin.UTXO{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         10000,
+			LockingScript: lockingScript,
+		}); err != nil {
+			t.Fatalf("Failed to add input : %s", err)
+		}
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 24000, true); err != nil {
+		t.Fatalf("Failed to add change : %s", err)
+	}
+
+	dataScript := bitcoin.Script{bitcoin.OP_FALSE, bitcoin.OP_RETURN}
+	dataScript = append(dataScript, bitcoin.PushData(make([]byte, 100))...)
+	if err := tx.AddOutput(dataScript, 0, false, false); err != nil {
+		t.Fatalf("Failed to add data output : %s", err)
+	}
+
+	estimatedSize, err := tx.EstimateSize()
+	if err != nil {
+		t.Fatalf("Failed to estimate size : %s", err)
+	}
+
+	if _, err := tx.Sign(keys[:3]); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	for i := range tx.Inputs {
+		if !tx.InputIsSigned(i) {
+			t.Fatalf("Input %d not signed", i)
+		}
+	}
+
+	// Signatures are estimated at their maximum size and are usually a byte or two smaller.
+	signatureCount := 4
+	actualSize := tx.MsgTx.SerializeSize()
+	t.Logf("Estimated size %d, actual size %d", estimatedSize, actualSize)
+
+	if actualSize > estimatedSize {
+		t.Fatalf("Actual size above estimate : got %d, estimated %d", actualSize, estimatedSize)
+	}
+
+	if estimatedSize-actualSize > signatureCount*3 {
+		t.Fatalf("Estimate too far above actual size : got %d, estimated %d", actualSize,
+			estimatedSize)
+	}
+}
+
+// Test_FeesConsistency_Value verifies the root package values and fees against the fees package,
+// including an input whose value is only known from its unlocking data.
+func Test_FeesConsistency_Value(t *testing.T) {
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: randomLockingScript(),
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	unlockingScript, err := channels.Wrap(&unlocking_data.UnlockingData{
+		Size:  300,
+		Value: 7000,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create unlocking data : %s", err)
+	}
+
+	if err := tx.AddInput(wire.OutPoint{Hash: *randomTxId()}, nil, 0); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+	tx.MsgTx.TxIn[1].UnlockingScript = unlockingScript
+
+	if err := tx.AddPaymentOutput(randomAddress(), 15000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	inputsValue, err := fees.InputsValue(tx)
+	if err != nil {
+		t.Fatalf("Failed to get inputs value : %s", err)
+	}
+
+	if inputsValue != 17000 {
+		t.Fatalf("Wrong fees inputs value : got %d, want %d", inputsValue, 17000)
+	}
+
+	if tx.InputValue() != inputsValue {
+		t.Fatalf("Input values don't match : root %d, fees %d", tx.InputValue(), inputsValue)
+	}
+
+	fee, err := fees.Fee(tx)
+	if err != nil {
+		t.Fatalf("Failed to get fee : %s", err)
+	}
+
+	if tx.ActualFee() != fee {
+		t.Fatalf("Fees don't match : root %d, fees %d", tx.ActualFee(), fee)
+	}
+
+	// The unlocking data input's size comes from the unlocking data.
+	size, err := tx.EstimateSize()
+	if err != nil {
+		t.Fatalf("Failed to estimate size : %s", err)
+	}
+
+	wantSize := BaseTxSize + 1 + 1 + MaximumP2PKHInputSize +
+		fees.InputSizeForUnlockingScriptSize(300) + tx.MsgTx.TxOut[0].SerializeSize()
+	if size != wantSize {
+		t.Fatalf("Wrong estimated size : got %d, want %d", size, wantSize)
+	}
+}
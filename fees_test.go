@@ -177,32 +177,50 @@ func Test_LowFeeSettlementCalculate(t *testing.T) {
 func Test_EstimatedFeeValue(t *testing.T) {
 	tests := []struct {
 		feeRateString string
-		feeRate       float32
+		feeRate       FeeRate
 		size, fee     uint64
 	}{
 		{
 			feeRateString: "0.05",
-			feeRate:       0.05,
+			feeRate:       50,
 			size:          359,
 			fee:           18,
 		},
 		{
 			feeRateString: "0.05",
-			feeRate:       0.05,
+			feeRate:       50,
 			size:          360,
-			fee:           19,
+			fee:           18,
 		},
 		{
 			feeRateString: "0.05",
-			feeRate:       0.05,
+			feeRate:       50,
 			size:          399,
 			fee:           20,
 		},
 		{
 			feeRateString: "0.05",
-			feeRate:       0.05,
+			feeRate:       50,
 			size:          400,
-			fee:           21,
+			fee:           20,
+		},
+		{
+			feeRateString: "0.001",
+			feeRate:       1,
+			size:          1000,
+			fee:           1,
+		},
+		{
+			feeRateString: "0.001",
+			feeRate:       1,
+			size:          1001,
+			fee:           2,
+		},
+		{
+			feeRateString: "0.5",
+			feeRate:       500,
+			size:          225,
+			fee:           113,
 		},
 	}
 
@@ -212,15 +230,15 @@ func Test_EstimatedFeeValue(t *testing.T) {
 			if err != nil {
 				return
 			}
-			feeRate := float32(feeRate64)
+			feeRate := NewFeeRate(float32(feeRate64))
 
 			if feeRate != tt.feeRate {
-				t.Errorf("Wrong fee rate : got %f, want %f", feeRate, tt.feeRate)
+				t.Errorf("Wrong fee rate : got %d, want %d", feeRate, tt.feeRate)
 			}
 
 			t.Logf("size: %d", tt.size)
 
-			fee := EstimatedFeeValue(tt.size, float64(tt.feeRate))
+			fee := EstimatedFeeValue(tt.size, tt.feeRate)
 
 			t.Logf("fee: %d", fee)
 
@@ -544,3 +562,252 @@ func Test_CalculateFee_EnoughRemainingBalance_NoChangeScript(t *testing.T) {
 		t.Logf("Correct error : %s", err)
 	}
 }
+
+func feeLimitsTestTx(t *testing.T, feeRate float32) (*TxBuilder, bitcoin.Key) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	lockingScript, _ := key.LockingScript()
+
+	changeAddress := randomAddress()
+	tx := NewTxBuilder(feeRate, 0.0)
+	tx.SetChangeAddress(changeAddress, "")
+
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(changeAddress, 4000, true); err != nil {
+		t.Fatalf("Failed to add change : %s", err)
+	}
+
+	return tx, key
+}
+
+func Test_Sign_TargetFee(t *testing.T) {
+	tx, key := feeLimitsTestTx(t, 0.5)
+	tx.TargetFee = 321
+
+	if _, err := tx.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	t.Logf(tx.String(bitcoin.MainNet))
+
+	if tx.Fee() != 321 {
+		t.Fatalf("Wrong fee : got %d, want %d", tx.Fee(), 321)
+	}
+}
+
+func Test_Sign_MinFee(t *testing.T) {
+	tx, key := feeLimitsTestTx(t, 0.05)
+	tx.MinFee = 200
+
+	if _, err := tx.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if tx.Fee() != 200 {
+		t.Fatalf("Wrong fee : got %d, want %d", tx.Fee(), 200)
+	}
+
+	// Removing the fee violates the minimum.
+	_, err := tx.AdjustFee(-100)
+	belowErr, ok := errors.Cause(err).(FeeBelowMinimumError)
+	if !ok {
+		t.Fatalf("Wrong error : got %v, want FeeBelowMinimumError", err)
+	}
+
+	if belowErr.Fee != 100 || belowErr.Minimum != 200 {
+		t.Fatalf("Wrong error values : got %d/%d, want %d/%d", belowErr.Fee, belowErr.Minimum,
+			100, 200)
+	}
+
+	// The failed adjustment is undone.
+	if tx.Fee() != 200 {
+		t.Fatalf("Wrong fee after failed adjustment : got %d, want %d", tx.Fee(), 200)
+	}
+
+	// An increase above the maximum is undone.
+	tx.MaxFee = 250
+	outputCount := len(tx.MsgTx.TxOut)
+	if _, err := tx.AdjustFee(100); err == nil {
+		t.Fatalf("Adjust fee should fail above the maximum")
+	}
+
+	if tx.Fee() != 200 || len(tx.MsgTx.TxOut) != outputCount {
+		t.Fatalf("Wrong fee after failed adjustment : got %d, want %d", tx.Fee(), 200)
+	}
+}
+
+func Test_Sign_MaxFee(t *testing.T) {
+	tx, key := feeLimitsTestTx(t, 0.5)
+	tx.MaxFee = 50
+
+	_, err := tx.Sign([]bitcoin.Key{key})
+	aboveErr, ok := errors.Cause(err).(FeeAboveMaximumError)
+	if !ok {
+		t.Fatalf("Wrong error : got %v, want FeeAboveMaximumError", err)
+	}
+
+	t.Logf("Error : %s", err)
+
+	if aboveErr.Maximum != 50 || aboveErr.Fee != tx.EstimatedFee() {
+		t.Fatalf("Wrong error values : got %d/%d, want %d/%d", aboveErr.Fee, aboveErr.Maximum,
+			tx.EstimatedFee(), 50)
+	}
+
+	// Within the maximum.
+	tx, key = feeLimitsTestTx(t, 0.5)
+	tx.MaxFee = 500
+
+	if _, err := tx.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if tx.Fee() > 500 {
+		t.Fatalf("Fee above maximum : %d", tx.Fee())
+	}
+
+	// Target fee above the maximum.
+	tx, _ = feeLimitsTestTx(t, 0.5)
+	tx.MaxFee = 500
+	tx.TargetFee = 600
+
+	err = tx.CalculateFee()
+	if _, ok := errors.Cause(err).(FeeAboveMaximumError); !ok {
+		t.Fatalf("Wrong error : got %v, want FeeAboveMaximumError", err)
+	}
+}
+
+func Test_AddFunding_FeeLimits(t *testing.T) {
+	fundingTx := func(t *testing.T) (*TxBuilder, []bitcoin.UTXO) {
+		tx := NewTxBuilder(0.5, 0.25)
+		tx.SetChangeAddress(randomAddress(), "")
+
+		if err := tx.AddPaymentOutput(randomAddress(), 10000, false); err != nil {
+			t.Fatalf("Failed to add payment : %s", err)
+		}
+
+		var utxos []bitcoin.UTXO
+		for i := 0; i < 3; i++ {
+			utxos = append(utxos, bitcoin.UTXO{
+				Hash:          *randomTxId(),
+				Index:         0,
+				Value:         4000,
+				LockingScript: randomLockingScript(),
+			})
+		}
+
+		return tx, utxos
+	}
+
+	// The target fee doesn't increase with the inputs and change output.
+	tx, utxos := fundingTx(t)
+	tx.TargetFee = 500
+
+	if err := tx.AddFunding(utxos); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	if tx.Fee() != 500 {
+		t.Fatalf("Wrong fee : got %d, want %d", tx.Fee(), 500)
+	}
+
+	if len(tx.MsgTx.TxOut) != 2 || tx.MsgTx.TxOut[1].Value != 1500 {
+		t.Fatalf("Wrong change : %v", outputValues(tx))
+	}
+
+	// The maximum fee is checked when funding completes.
+	tx, utxos = fundingTx(t)
+	tx.MaxFee = 100
+
+	err := tx.AddFunding(utxos)
+	if _, ok := errors.Cause(err).(FeeAboveMaximumError); !ok {
+		t.Fatalf("Wrong error : got %v, want FeeAboveMaximumError", err)
+	}
+}
+
+func Test_DataFeeRate(t *testing.T) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	lockingScript, _ := key.LockingScript()
+
+	payload := make([]byte, 5000)
+	rand.Read(payload)
+	dataScript := bitcoin.ConcatScript(bitcoin.OP_FALSE, bitcoin.OP_RETURN,
+		bitcoin.PushData(payload))
+
+	dataOutput := wire.NewTxOut(0, dataScript)
+	if DustLimitForOutput(dataOutput, FeeRate(1000)) != 0 {
+		t.Fatalf("Data output should not have a dust limit : %d",
+			DustLimitForOutput(dataOutput, FeeRate(1000)))
+	}
+
+	tx := NewTxBuilderWithFeeRates(500, 0)
+	tx.SetDataFeeRate(50)
+	tx.SetChangeAddress(randomAddress(), "")
+
+	if err := tx.AddOutput(dataScript, 0, false, false); err != nil {
+		t.Fatalf("Failed to add data output : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 1000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	standardSize, dataSize := tx.EstimatedSizes()
+	if dataSize != len(dataScript) {
+		t.Fatalf("Wrong data size : got %d, want %d", dataSize, len(dataScript))
+	}
+	if standardSize+dataSize != tx.EstimatedSize() {
+		t.Fatalf("Wrong standard size : got %d, want %d", standardSize,
+			tx.EstimatedSize()-dataSize)
+	}
+
+	utxos := []bitcoin.UTXO{
+		{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         3000,
+			LockingScript: lockingScript,
+		},
+	}
+
+	if err := tx.AddFunding(utxos); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	if _, err := tx.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	size := tx.MsgTx.SerializeSize()
+	wantFee := tx.FeeModel().Fee(size-len(dataScript), len(dataScript))
+	t.Logf("Size %d, data %d, fee %d, want %d", size, len(dataScript), tx.Fee(), wantFee)
+
+	if tx.Fee() < wantFee {
+		t.Fatalf("Fee too low : got %d, want %d", tx.Fee(), wantFee)
+	}
+
+	// Charging data at the standard rate would cost far more.
+	if tx.Fee() >= FeeRate(500).Fee(size) {
+		t.Fatalf("Data charged at standard rate : got %d, want %d", tx.Fee(), wantFee)
+	}
+
+	if len(tx.MsgTx.TxOut) != 3 {
+		t.Fatalf("Wrong output count : got %d, want %d", len(tx.MsgTx.TxOut), 3)
+	}
+}
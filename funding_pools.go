@@ -0,0 +1,185 @@
+package txbuilder
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+// FundingShare specifies what a funding pool pays for.
+type FundingShare uint8
+
+const (
+	// FundingShareValue is a pool that pays a fixed amount of the output value. It doesn't pay any
+	// of the tx fee.
+	FundingShareValue = FundingShare(0)
+
+	// FundingShareFee is a pool that pays the tx fee, including the fees for the inputs and change
+	// outputs of the other pools, and any output value not covered by value pools.
+	FundingShareFee = FundingShare(1)
+)
+
+// FundingPool is a set of UTXOs belonging to one party that contributes a declared share of the
+// funding for a tx. Change from each pool is paid back to the pool's change script.
+type FundingPool struct {
+	UTXOs        []bitcoin.UTXO `json:"utxos"`
+	ChangeScript bitcoin.Script `json:"change_script"`
+	ChangeKeyID  string         `json:"change_key_id,omitempty"`
+	Share        FundingShare   `json:"share"`
+
+	// Value is the amount of output value paid by a FundingShareValue pool.
+	Value uint64 `json:"value,omitempty"`
+}
+
+// AddFundingPools adds inputs from each funding pool to pay its declared share of the tx.
+// Value pools are funded first, each adding inputs until its value is covered and paying any change
+// to its own change script in a non-remainder output. Change below the dust limit is left to the
+// fee, reducing what the fee pool pays, so it isn't included in DroppedChange.
+// Exactly one fee pool is required. It is funded last with AddFunding, its change script becomes
+// the tx's change script, and its change output is marked to absorb fee corrections made by
+// AdjustFee and Sign. If the tx already has a change script or change key ID then the fee pool's
+// must be empty or match it.
+// If any pool can't be funded then the tx is returned to the state it was in before the call.
+func (tx *TxBuilder) AddFundingPools(pools []FundingPool) error {
+	if err := tx.CheckFeeExpiry(); err != nil {
+		return err
+	}
+
+	var feePool *FundingPool
+	for i, pool := range pools {
+		switch pool.Share {
+		case FundingShareValue:
+			if len(pool.ChangeScript) == 0 {
+				return errors.Wrap(ErrChangeAddressNeeded, fmt.Sprintf("value pool %d", i))
+			}
+		case FundingShareFee:
+			if feePool != nil {
+				return fmt.Errorf("More than one fee pool: %d", i)
+			}
+			feePool = &pools[i]
+		default:
+			return fmt.Errorf("Unknown funding share for pool %d: %d", i, pool.Share)
+		}
+	}
+
+	if feePool == nil {
+		return errors.New("Missing fee pool")
+	}
+
+	if tx.hasRemainder() {
+		return errors.New("Remainder output already exists")
+	}
+
+	if len(tx.ChangeScript) > 0 && len(feePool.ChangeScript) > 0 &&
+		!bytes.Equal(tx.ChangeScript, feePool.ChangeScript) {
+		return errors.New("Fee pool change script doesn't match tx change script")
+	}
+
+	if len(tx.ChangeKeyID) > 0 && len(feePool.ChangeKeyID) > 0 &&
+		tx.ChangeKeyID != feePool.ChangeKeyID {
+		return errors.New("Fee pool change key ID doesn't match tx change key ID")
+	}
+
+	previousInputs := tx.Inputs
+	previousTxIns := tx.MsgTx.TxIn
+	previousOutputs := tx.saveOutputs()
+	previousChangeScript := tx.ChangeScript
+	previousChangeKeyID := tx.ChangeKeyID
+	previousSelection := tx.CoinSelection
+	restore := func() {
+		tx.Inputs = previousInputs
+		tx.MsgTx.TxIn = previousTxIns
+		previousOutputs.restore(tx)
+		tx.ChangeScript = previousChangeScript
+		tx.ChangeKeyID = previousChangeKeyID
+		tx.CoinSelection = previousSelection
+	}
+
+	combined := &CoinSelection{}
+	for i, pool := range pools {
+		if pool.Share != FundingShareValue {
+			continue
+		}
+
+		selection, err := tx.addValuePoolFunding(pool)
+		if err != nil {
+			restore()
+			return errors.Wrapf(err, "value pool %d", i)
+		}
+
+		combined.Strategy = selection.Strategy
+		combined.Coins = append(combined.Coins, selection.Coins...)
+		combined.Skipped = append(combined.Skipped, selection.Skipped...)
+	}
+
+	if len(tx.ChangeScript) == 0 {
+		tx.ChangeScript = feePool.ChangeScript
+	}
+	if len(tx.ChangeKeyID) == 0 {
+		tx.ChangeKeyID = feePool.ChangeKeyID
+	}
+
+	if err := tx.AddFunding(feePool.UTXOs); err != nil {
+		restore()
+		return errors.Wrap(err, "fee pool")
+	}
+
+	combined.Strategy = tx.CoinSelection.Strategy
+	combined.Coins = append(combined.Coins, tx.CoinSelection.Coins...)
+	combined.Skipped = append(combined.Skipped, tx.CoinSelection.Skipped...)
+	tx.CoinSelection = combined
+
+	for _, output := range tx.Outputs {
+		if output.IsRemainder {
+			output.AbsorbsFee = true
+		}
+	}
+
+	return nil
+}
+
+// addValuePoolFunding adds inputs from the pool until its value is covered and adds an output for
+// its change.
+func (tx *TxBuilder) addValuePoolFunding(pool FundingPool) (*CoinSelection, error) {
+	selection, err := tx.selectCoins(pool.UTXOs, pool.Value)
+	if err != nil {
+		return nil, errors.Wrap(err, "select coins")
+	}
+
+	added := uint64(0)
+	var spent []*SelectedCoin
+	for _, coin := range selection.Coins {
+		if added >= pool.Value {
+			break
+		}
+
+		if err := tx.AddInputUTXO(coin.UTXO); err != nil {
+			if errors.Cause(err) == ErrDuplicateInput {
+				continue
+			}
+			return nil, errors.Wrap(err, "adding input")
+		}
+
+		added += coin.UTXO.Value
+		spent = append(spent, coin)
+	}
+	selection.Coins = spent
+
+	if added < pool.Value {
+		return selection, errors.Wrap(ErrInsufficientValue, fmt.Sprintf("%d/%d", added,
+			pool.Value))
+	}
+
+	change := added - pool.Value
+	if change > 0 && change >= DustLimitForLockingScript(pool.ChangeScript, tx.dustPolicy()) {
+		if err := tx.AddOutput(pool.ChangeScript, change, false, false); err != nil {
+			return selection, errors.Wrap(err, "adding change")
+		}
+		tx.Outputs[len(tx.Outputs)-1].KeyID = pool.ChangeKeyID
+	}
+
+	return selection, nil
+}
@@ -0,0 +1,317 @@
+package txbuilder
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+)
+
+func Test_AddFundingPools(t *testing.T) {
+	userKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	userLockingScript, _ := userKey.LockingScript()
+	userChangeScript := randomLockingScript()
+
+	feeKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	feeLockingScript, _ := feeKey.LockingScript()
+	feeChangeScript := randomLockingScript()
+
+	pools := []FundingPool{
+		{
+			UTXOs: []bitcoin.UTXO{
+				{
+					Hash:          *randomTxId(),
+					Index:         0,
+					Value:         2000,
+					LockingScript: userLockingScript,
+				},
+				{
+					Hash:          *randomTxId(),
+					Index:         0,
+					Value:         2000,
+					LockingScript: userLockingScript,
+				},
+				{
+					Hash:          *randomTxId(),
+					Index:         0,
+					Value:         2000,
+					LockingScript: userLockingScript,
+				},
+			},
+			ChangeScript: userChangeScript,
+			ChangeKeyID:  "user",
+			Share:        FundingShareValue,
+			Value:        3000,
+		},
+		{
+			UTXOs: []bitcoin.UTXO{
+				{
+					Hash:          *randomTxId(),
+					Index:         0,
+					Value:         10000,
+					LockingScript: feeLockingScript,
+				},
+			},
+			ChangeScript: feeChangeScript,
+			ChangeKeyID:  "fee",
+			Share:        FundingShareFee,
+		},
+	}
+
+	tx := NewTxBuilder(0.5, 0.25)
+
+	if err := tx.AddPaymentOutput(randomAddress(), 3000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFundingPools(pools); err != nil {
+		t.Fatalf("Failed to add funding pools : %s", err)
+	}
+
+	if _, err := tx.Sign([]bitcoin.Key{userKey, feeKey}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	t.Logf(tx.String(bitcoin.MainNet))
+
+	if len(tx.MsgTx.TxIn) != 3 {
+		t.Fatalf("Wrong input count : got %d, want %d", len(tx.MsgTx.TxIn), 3)
+	}
+
+	if len(tx.MsgTx.TxOut) != 3 {
+		t.Fatalf("Wrong output count : got %d, want %d", len(tx.MsgTx.TxOut), 3)
+	}
+
+	// User change is exactly the excess value of the user's inputs.
+	userChange := tx.MsgTx.TxOut[1]
+	if !userChange.LockingScript.Equal(userChangeScript) {
+		t.Fatalf("Wrong user change script : got %s, want %s", userChange.LockingScript,
+			userChangeScript)
+	}
+	if userChange.Value != 1000 {
+		t.Fatalf("Wrong user change value : got %d, want %d", userChange.Value, 1000)
+	}
+	if tx.Outputs[1].IsRemainder || tx.Outputs[1].KeyID != "user" {
+		t.Fatalf("Wrong user change supplement : %+v", tx.Outputs[1])
+	}
+
+	// Fee change pays the whole fee.
+	feeChange := tx.MsgTx.TxOut[2]
+	if !feeChange.LockingScript.Equal(feeChangeScript) {
+		t.Fatalf("Wrong fee change script : got %s, want %s", feeChange.LockingScript,
+			feeChangeScript)
+	}
+	if feeChange.Value != 10000-tx.Fee() {
+		t.Fatalf("Wrong fee change value : got %d, want %d", feeChange.Value, 10000-tx.Fee())
+	}
+	if !tx.Outputs[2].IsRemainder || !tx.Outputs[2].AbsorbsFee || tx.Outputs[2].KeyID != "fee" {
+		t.Fatalf("Wrong fee change supplement : %+v", tx.Outputs[2])
+	}
+
+	if tx.Fee() < tx.EstimatedFee() {
+		t.Fatalf("Fee too low : got %d, want %d", tx.Fee(), tx.EstimatedFee())
+	}
+
+	if len(tx.CoinSelection.Coins) != 3 {
+		t.Fatalf("Wrong selected coin count : got %d, want %d", len(tx.CoinSelection.Coins), 3)
+	}
+}
+
+func Test_AddFundingPools_Invalid(t *testing.T) {
+	valuePool := FundingPool{
+		UTXOs: []bitcoin.UTXO{
+			{
+				Hash:          *randomTxId(),
+				Index:         0,
+				Value:         5000,
+				LockingScript: randomLockingScript(),
+			},
+		},
+		ChangeScript: randomLockingScript(),
+		Share:        FundingShareValue,
+		Value:        3000,
+	}
+
+	feePool := FundingPool{
+		UTXOs: []bitcoin.UTXO{
+			{
+				Hash:          *randomTxId(),
+				Index:         0,
+				Value:         5000,
+				LockingScript: randomLockingScript(),
+			},
+		},
+		ChangeScript: randomLockingScript(),
+		Share:        FundingShareFee,
+	}
+
+	tx := NewTxBuilder(0.5, 0.25)
+	if err := tx.AddFundingPools([]FundingPool{valuePool}); err == nil {
+		t.Fatalf("Missing fee pool should fail")
+	}
+
+	if err := tx.AddFundingPools([]FundingPool{valuePool, feePool, feePool}); err == nil {
+		t.Fatalf("Multiple fee pools should fail")
+	}
+
+	tx.SetChangeAddress(randomAddress(), "")
+	if err := tx.AddPaymentOutput(randomAddress(), 3000, true); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFundingPools([]FundingPool{valuePool, feePool}); err == nil {
+		t.Fatalf("Existing remainder should fail")
+	}
+
+	// A different existing change script is not overwritten.
+	changeScript := randomLockingScript()
+	tx = NewTxBuilder(0.5, 0.25)
+	tx.SetChangeLockingScript(changeScript, "m/0/1")
+	if err := tx.AddPaymentOutput(randomAddress(), 3000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFundingPools([]FundingPool{valuePool, feePool}); err == nil {
+		t.Fatalf("Conflicting change script should fail")
+	}
+
+	if !bytes.Equal(tx.ChangeScript, changeScript) || tx.ChangeKeyID != "m/0/1" {
+		t.Fatalf("Change script overwritten")
+	}
+
+	if len(tx.Inputs) != 0 {
+		t.Fatalf("Inputs added before conflict : %d", len(tx.Inputs))
+	}
+
+	// The same change script with no key ID keeps the existing key ID.
+	feePool.ChangeScript = changeScript
+	if err := tx.AddFundingPools([]FundingPool{valuePool, feePool}); err != nil {
+		t.Fatalf("Failed to add funding pools : %s", err)
+	}
+
+	if tx.ChangeKeyID != "m/0/1" {
+		t.Fatalf("Wrong change key ID : got %s, want %s", tx.ChangeKeyID, "m/0/1")
+	}
+}
+
+func Test_AddFundingPools_DustValueChange(t *testing.T) {
+	valuePool := FundingPool{
+		UTXOs: []bitcoin.UTXO{
+			{
+				Hash:          *randomTxId(),
+				Index:         0,
+				Value:         3100,
+				LockingScript: randomLockingScript(),
+			},
+		},
+		ChangeScript: randomLockingScript(),
+		Share:        FundingShareValue,
+		Value:        3000,
+	}
+
+	feePool := FundingPool{
+		UTXOs: []bitcoin.UTXO{
+			{
+				Hash:          *randomTxId(),
+				Index:         0,
+				Value:         10000,
+				LockingScript: randomLockingScript(),
+			},
+		},
+		ChangeScript: randomLockingScript(),
+		Share:        FundingShareFee,
+	}
+
+	tx := NewTxBuilder(0.5, 0.25)
+	if err := tx.AddPaymentOutput(randomAddress(), 3000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFundingPools([]FundingPool{valuePool, feePool}); err != nil {
+		t.Fatalf("Failed to add funding pools : %s", err)
+	}
+
+	t.Logf(tx.String(bitcoin.MainNet))
+
+	// The value pool's 100 of change is below dust so it pays part of the fee instead of the fee
+	// pool. DroppedChange only covers the fee pool's funding, which has a change output.
+	if len(tx.MsgTx.TxOut) != 2 {
+		t.Fatalf("Wrong output count : got %d, want %d", len(tx.MsgTx.TxOut), 2)
+	}
+
+	if tx.Fee() != tx.EstimatedFee() {
+		t.Fatalf("Wrong fee : got %d, want %d", tx.Fee(), tx.EstimatedFee())
+	}
+
+	if tx.DroppedChange != 0 {
+		t.Fatalf("Wrong dropped change : got %d, want %d", tx.DroppedChange, 0)
+	}
+
+	if report := tx.FeeReport(); report.DroppedChange != 0 {
+		t.Fatalf("Wrong reported dropped change : got %d, want %d", report.DroppedChange, 0)
+	}
+}
+
+func Test_AddFundingPools_Rollback(t *testing.T) {
+	valuePool := FundingPool{
+		UTXOs: []bitcoin.UTXO{
+			{
+				Hash:          *randomTxId(),
+				Index:         0,
+				Value:         5000,
+				LockingScript: randomLockingScript(),
+			},
+		},
+		ChangeScript: randomLockingScript(),
+		Share:        FundingShareValue,
+		Value:        3000,
+	}
+
+	// The fee pool can't cover the fee.
+	feePool := FundingPool{
+		UTXOs: []bitcoin.UTXO{
+			{
+				Hash:          *randomTxId(),
+				Index:         0,
+				Value:         50,
+				LockingScript: randomLockingScript(),
+			},
+		},
+		ChangeScript: randomLockingScript(),
+		Share:        FundingShareFee,
+	}
+
+	tx := NewTxBuilder(0.5, 0.25)
+	if err := tx.AddPaymentOutput(randomAddress(), 3000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFundingPools([]FundingPool{valuePool, feePool}); err == nil {
+		t.Fatalf("Underfunded fee pool should fail")
+	}
+
+	// The value pool's input and change output are removed.
+	if len(tx.Inputs) != 0 || len(tx.MsgTx.TxIn) != 0 {
+		t.Fatalf("Wrong input count : got %d/%d, want %d", len(tx.Inputs), len(tx.MsgTx.TxIn),
+			0)
+	}
+
+	if len(tx.Outputs) != 1 || len(tx.MsgTx.TxOut) != 1 {
+		t.Fatalf("Wrong output count : got %d/%d, want %d", len(tx.Outputs),
+			len(tx.MsgTx.TxOut), 1)
+	}
+
+	if len(tx.ChangeScript) != 0 || tx.CoinSelection != nil {
+		t.Fatalf("Change script or coin selection not restored")
+	}
+
+	// The tx can still be funded with a fee pool that covers the fee.
+	feePool.UTXOs[0].Value = 10000
+	if err := tx.AddFundingPools([]FundingPool{valuePool, feePool}); err != nil {
+		t.Fatalf("Failed to add funding pools : %s", err)
+	}
+
+	if len(tx.Inputs) != 2 {
+		t.Fatalf("Wrong input count : got %d, want %d", len(tx.Inputs), 2)
+	}
+}
@@ -3,6 +3,7 @@ module github.com/tokenized/txbuilder
 go 1.18
 
 require (
+	github.com/btcsuite/btcd v0.20.1-beta
 	github.com/pkg/errors v0.9.1
 	github.com/tokenized/arc v0.0.0-20240321210357-e5700dc9cc36
 	github.com/tokenized/bitcoin_interpreter v0.1.1
@@ -16,7 +17,6 @@ require (
 	github.com/FactomProject/basen v0.0.0-20150613233007-fe3947df716e // indirect
 	github.com/FactomProject/btcutilecc v0.0.0-20130527213604-d3a63a5752ec // indirect
 	github.com/aws/aws-sdk-go v1.35.3 // indirect
-	github.com/btcsuite/btcd v0.20.1-beta // indirect
 	github.com/btcsuite/btcutil v1.0.2 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
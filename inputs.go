@@ -144,11 +144,40 @@ func (tx *TxBuilder) RemoveInput(index int) error {
 
 // AddFunding adds inputs spending the specified UTXOs until the transaction has enough funding to
 // cover the fees and outputs.
-// If SendMax is set then all UTXOs are added as inputs.
+// If SendMax is set then all UTXOs are added as inputs, including uneconomic ones.
+// The UTXOs are chosen and ordered by tx.CoinSelector and the ones spent are retained in
+// tx.CoinSelection.
+// Otherwise UTXOs that cost more to spend than they are worth at the current fee rate are not
+// added and are listed in tx.CoinSelection.Skipped.
 func (tx *TxBuilder) AddFunding(utxos []bitcoin.UTXO) error {
+	if err := tx.CheckFeeExpiry(); err != nil {
+		return err
+	}
+
+	target, err := tx.fundingTarget(0)
+	if err != nil {
+		return errors.Wrap(err, "funding target")
+	}
+
+	selection, err := tx.selectCoins(utxos, target)
+	if err != nil {
+		return errors.Wrap(err, "select coins")
+	}
+
+	err = tx.addFunding(selection.UTXOs())
+	tx.CoinSelection = selection.spentBy(tx)
+	return err
+}
+
+func (tx *TxBuilder) addFunding(utxos []bitcoin.UTXO) error {
 	inputValue := tx.InputValue()
 	outputValue := tx.OutputValue(true)
-	estFeeValue := tx.EstimatedFee()
+	estimatedSize, err := tx.EstimateSize()
+	if err != nil {
+		return errors.Wrap(err, "estimate size")
+	}
+	estSize := uint64(estimatedSize)
+	estFeeValue := tx.FeeForSize(estSize)
 
 	if !tx.SendMax && inputValue > outputValue && inputValue-outputValue >= estFeeValue {
 		return tx.CalculateFee() // Already funded
@@ -159,49 +188,29 @@ func (tx *TxBuilder) AddFunding(utxos []bitcoin.UTXO) error {
 			inputValue, outputValue+estFeeValue))
 	}
 
-	// Calculate additional funding needed. Include cost of first added input.
-	// TODO Add support for input scripts other than P2PKH.
-	neededFunding := estFeeValue + outputValue - inputValue
-	changeOutputFee := uint64(0)
-	duplicateValue := uint64(0)
-
-	// Calculate the dust limit used when determining if a change output will be added
-	var changeDustLimit uint64
-	for i, output := range tx.Outputs {
-		if !output.IsRemainder {
-			continue
-		}
-
-		changeOutputFee = uint64(tx.MsgTx.TxOut[i].SerializeSize())
-		changeDustLimit = DustLimitForOutput(tx.MsgTx.TxOut[i], tx.DustFeeRate)
-		if changeDustLimit > 0 {
-			break
-		}
-	}
-	if changeDustLimit == 0 && len(tx.ChangeScript) > 0 {
-		changeOutputFee, changeDustLimit = OutputFeeAndDustForLockingScript(tx.ChangeScript,
-			tx.DustFeeRate, tx.FeeRate)
-	}
-	if changeDustLimit == 0 {
-		// Use P2PKH dust limit
-		changeDustLimit = DustLimit(P2PKHOutputSize, tx.DustFeeRate)
-		changeOutputFee = uint64(float32(P2PKHOutputSize) * tx.FeeRate)
-	}
+	// Calculate the dust limit used when determining if a change output will be added.
+	changeOutputSize, _ := tx.changeOutputSizes()
+	changeDustLimit := DustLimit(changeOutputSize, tx.dustPolicy())
 
+	// The size of each input is added as it is added and the fee is recalculated from the fee model
+	// so TargetFee, MinFee, and data fee rates apply.
 	for _, utxo := range utxos {
 		if err := tx.AddInputUTXO(utxo); err != nil {
 			if errors.Cause(err) == ErrDuplicateInput {
-				duplicateValue += utxo.Value
 				continue
 			}
 			return errors.Wrap(err, "adding input")
 		}
 
-		inputFee, err := UTXOFee(utxo, tx.FeeRate)
+		inputSize, err := tx.estimateInputSize(len(tx.Inputs) - 1)
 		if err != nil {
-			return errors.Wrap(err, "utxo fee")
+			return errors.Wrap(err, "input size")
 		}
-		neededFunding += inputFee // Add cost of input
+
+		estSize += uint64(inputSize)
+		estFeeValue = tx.FeeForSize(estSize)
+		neededFunding := estFeeValue + outputValue - inputValue
+		inputValue += utxo.Value
 
 		if tx.SendMax {
 			continue
@@ -210,15 +219,18 @@ func (tx *TxBuilder) AddFunding(utxos []bitcoin.UTXO) error {
 		if neededFunding <= utxo.Value {
 			// Funding complete
 			change := utxo.Value - neededFunding
+			tx.DroppedChange = change // until it is put in an output
 			if change > changeDustLimit {
 				for i, output := range tx.Outputs {
 					if output.IsRemainder {
 						// Updating existing "change" output
 						tx.MsgTx.TxOut[i].Value += change
-						return nil
+						tx.DroppedChange = 0
+						return tx.checkFundedFee()
 					}
 				}
 
+				changeOutputFee := tx.FeeForSize(estSize+uint64(changeOutputSize)) - estFeeValue
 				if change > changeDustLimit+changeOutputFee {
 					// Add new change output
 					change -= changeOutputFee
@@ -231,35 +243,149 @@ func (tx *TxBuilder) AddFunding(utxos []bitcoin.UTXO) error {
 						return errors.Wrap(err, "adding change")
 					}
 					tx.Outputs[len(tx.Outputs)-1].KeyID = tx.ChangeKeyID
+					tx.DroppedChange = 0
 				}
 			}
 
-			return nil
+			return tx.checkFundedFee()
 		}
-
-		// More UTXOs required
-		neededFunding -= utxo.Value // Subtract the value this input added
 	}
 
 	if tx.SendMax {
 		return tx.CalculateFee()
-	} else {
-		available := uint64(0)
+	}
+
+	available := uint64(0)
+	for _, input := range tx.Inputs {
+		available += input.Value
+	}
+	return errors.Wrap(ErrInsufficientValue, fmt.Sprintf("%d/%d", available,
+		outputValue+tx.EstimatedFee()))
+}
+
+// checkFundedFee returns FeeAboveMaximumError or FeeBelowMinimumError if the fee of the funded tx
+// is outside of the tx's MaxFee or MinFee.
+func (tx *TxBuilder) checkFundedFee() error {
+	if err := tx.CheckFeeLimits(tx.Fee()); err != nil {
+		return errors.Wrap(err, "funded fee")
+	}
+
+	return nil
+}
+
+// AddFundingChangeless adds inputs spending a subset of the UTXOs that funds the tx without needing
+// a change output. The subset can exceed the needed value by up to the cost of adding a change
+// output and later spending it, in which case the excess is left as additional fee. If no such
+// subset is found then it falls back to AddFunding, which adds change as normal.
+func (tx *TxBuilder) AddFundingChangeless(utxos []bitcoin.UTXO) error {
+	if err := tx.CheckFeeExpiry(); err != nil {
+		return err
+	}
+
+	if tx.SendMax {
+		return tx.AddFunding(utxos)
+	}
+
+	// Don't consider UTXOs that are already spent by the tx.
+	var unspent []bitcoin.UTXO
+	for _, utxo := range utxos {
+		found := false
+		for _, txin := range tx.MsgTx.TxIn {
+			if txin.PreviousOutPoint.Hash.Equal(&utxo.Hash) &&
+				txin.PreviousOutPoint.Index == utxo.Index {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			unspent = append(unspent, utxo)
+		}
+	}
+
+	outputFee, inputFee := tx.changeOutputCost()
+	selector := BranchAndBoundSelector{
+		Tolerance: outputFee + inputFee,
+	}
+
+	target, err := tx.fundingTarget(0)
+	if err != nil {
+		return errors.Wrap(err, "funding target")
+	}
+
+	selection, err := selector.SelectCoins(unspent, target, tx.FeeRate)
+	if err != nil {
+		if errors.Cause(err) == ErrNoExactMatch {
+			return tx.AddFunding(utxos)
+		}
+		return errors.Wrap(err, "select coins")
+	}
+
+	for _, utxo := range selection.UTXOs() {
+		if err := tx.AddInputUTXO(utxo); err != nil {
+			return errors.Wrap(err, "adding input")
+		}
+	}
+	tx.CoinSelection = selection
+
+	return tx.CalculateFee()
+}
+
+// changeOutputCost returns the fees to add a change output to the tx and to later spend it.
+func (tx *TxBuilder) changeOutputCost() (uint64, uint64) {
+	outputSize, inputSize := tx.changeOutputSizes()
+	return EstimatedFeeValue(uint64(outputSize), tx.FeeRate),
+		EstimatedFeeValue(uint64(inputSize), tx.FeeRate)
+}
+
+// changeOutputSizes returns the size of the change output and the size of the input that will
+// later spend it. The change locking script is taken from the first remainder output, then the
+// change script, then the first input with a known template since change usually goes back to the
+// same type of wallet. P2PKH is assumed only when none of those are available. The input size is
+// zero when the change locking script's template is unknown.
+func (tx *TxBuilder) changeOutputSizes() (int, int) {
+	var lockingScript bitcoin.Script
+	for i, output := range tx.Outputs {
+		if output.IsRemainder {
+			lockingScript = tx.MsgTx.TxOut[i].LockingScript
+			break
+		}
+	}
+
+	if len(lockingScript) == 0 {
+		lockingScript = tx.ChangeScript
+	}
+
+	if len(lockingScript) == 0 {
 		for _, input := range tx.Inputs {
-			available += input.Value
+			if _, err := tx.inputSize(input.LockingScript); err == nil {
+				lockingScript = input.LockingScript
+				break
+			}
 		}
-		return errors.Wrap(ErrInsufficientValue, fmt.Sprintf("%d/%d", available,
-			outputValue+tx.EstimatedFee()))
 	}
 
-	return nil
+	if len(lockingScript) == 0 {
+		return P2PKHOutputSize, MaximumP2PKHInputSize
+	}
+
+	inputSize, err := tx.inputSize(lockingScript)
+	if err != nil {
+		return OutputSize(lockingScript), 0
+	}
+
+	return OutputSize(lockingScript), inputSize
 }
 
 // AddFundingBreakChange adds inputs spending the specified UTXOs until the transaction has enough
 // funding to cover the fees and outputs.
-// If SendMax is set then all UTXOs are added as inputs.
+// If SendMax is set then all UTXOs are added as inputs, including uneconomic ones.
+// Otherwise UTXOs that cost more to spend than they are worth are listed in
+// tx.CoinSelection.Skipped.
 // If there is already an IsRemainder output, then it will get all of the "change" and it won't be
 // broken up.
+// All of the change outputs are remainders, so fee adjustments are split between them based on
+// tx.RemainderPolicy.
 // tx.ChangeScript is ignored.
 // breakValue should be a fairly low value that is the smallest UTXO you want created other than
 // the remainder.
@@ -268,6 +394,39 @@ func (tx *TxBuilder) AddFunding(utxos []bitcoin.UTXO) error {
 func (tx *TxBuilder) AddFundingBreakChange(utxos []bitcoin.UTXO, breakValue uint64,
 	changeAddresses []AddressKeyID) error {
 
+	if err := tx.CheckFeeExpiry(); err != nil {
+		return err
+	}
+
+	// Include the first change output in the target if a remainder isn't already included.
+	changeOutputSize := uint64(0)
+	if len(changeAddresses) > 0 && !tx.hasRemainder() {
+		lockingScript, err := changeAddresses[0].Address.LockingScript()
+		if err != nil {
+			return errors.Wrap(err, "first change locking script")
+		}
+
+		changeOutputSize = uint64(OutputSize(lockingScript))
+	}
+
+	target, err := tx.fundingTarget(changeOutputSize)
+	if err != nil {
+		return errors.Wrap(err, "funding target")
+	}
+
+	selection, err := tx.selectCoins(utxos, target)
+	if err != nil {
+		return errors.Wrap(err, "select coins")
+	}
+
+	err = tx.addFundingBreakChange(selection.UTXOs(), breakValue, changeAddresses)
+	tx.CoinSelection = selection.spentBy(tx)
+	return err
+}
+
+func (tx *TxBuilder) addFundingBreakChange(utxos []bitcoin.UTXO, breakValue uint64,
+	changeAddresses []AddressKeyID) error {
+
 	// Calculate the dust limit used when determining if a change output will be added
 	remainderIncluded := false
 	for _, output := range tx.Outputs {
@@ -291,16 +450,19 @@ func (tx *TxBuilder) AddFundingBreakChange(utxos []bitcoin.UTXO, breakValue uint
 
 	inputValue := tx.InputValue()
 	outputValue := tx.OutputValue(true)
-	estSize := uint64(tx.EstimatedSize()) + firstChangeOutputSize
-	feeRate := float64(tx.FeeRate)
-	estFeeValue := EstimatedFeeValue(estSize, feeRate)
+	estimatedSize, err := tx.EstimateSize()
+	if err != nil {
+		return errors.Wrap(err, "estimate size")
+	}
+	estSize := uint64(estimatedSize) + firstChangeOutputSize
+	estFeeValue := tx.FeeForSize(estSize)
 
 	changeLockingScript, err := changeAddresses[0].Address.LockingScript()
 	if err != nil {
 		return errors.Wrap(err, "change locking script")
 	}
 
-	outputFee, inputFee, _ := OutputTotalCost(changeLockingScript, tx.FeeRate)
+	outputFee, inputFee := tx.outputTotalCost(changeLockingScript)
 
 	// Check if tx is already funded.
 	if !tx.SendMax && inputValue > outputValue && inputValue-outputValue >= estFeeValue {
@@ -323,9 +485,8 @@ func (tx *TxBuilder) AddFundingBreakChange(utxos []bitcoin.UTXO, breakValue uint
 			outputValue+estFeeValue))
 	}
 
-	// Calculate additional funding needed. Include cost of first added input.
-	// TODO Add support for input scripts other than P2PKH.
-	estFeeValue = EstimatedFeeValue(estSize, feeRate)
+	// Calculate additional funding needed. The size of each input is added as it is added.
+	estFeeValue = tx.FeeForSize(estSize)
 	neededFunding := estFeeValue + outputValue - inputValue
 	duplicateValue := uint64(0)
 
@@ -338,13 +499,13 @@ func (tx *TxBuilder) AddFundingBreakChange(utxos []bitcoin.UTXO, breakValue uint
 			return errors.Wrap(err, "adding input")
 		}
 
-		inputSize, err := InputSize(utxo.LockingScript)
+		inputSize, err := tx.inputSize(utxo.LockingScript)
 		if err != nil {
 			return errors.Wrap(err, "input size")
 		}
 
 		estSize += uint64(inputSize)
-		estFeeValue = EstimatedFeeValue(estSize, feeRate)
+		estFeeValue = tx.FeeForSize(estSize)
 		neededFunding = estFeeValue + outputValue - inputValue
 		inputValue += utxo.Value
 
@@ -356,7 +517,7 @@ func (tx *TxBuilder) AddFundingBreakChange(utxos []bitcoin.UTXO, breakValue uint
 			// Funding complete
 			// Re-calculate fee without estimating first change output because BreakValue will take
 			// the fees out of the values.
-			finalFeeValue := EstimatedFeeValue(estSize-firstChangeOutputSize, feeRate)
+			finalFeeValue := tx.FeeForSize(estSize - firstChangeOutputSize)
 			finalNeededFunding := finalFeeValue + outputValue - inputValue + utxo.Value
 			changeValue := utxo.Value - finalNeededFunding
 
@@ -365,20 +526,32 @@ func (tx *TxBuilder) AddFundingBreakChange(utxos []bitcoin.UTXO, breakValue uint
 					if output.IsRemainder {
 						// Updating existing "change" output
 						tx.MsgTx.TxOut[i].Value += changeValue
-						return nil
+						tx.DroppedChange = 0
+						return tx.checkFundedFee()
 					}
 				}
 
 				return errors.New("Missing remainder that was previously there!")
 			} else {
-				// Break change between supplied addresses.
-				outputs, err := BreakValue(changeValue, breakValue, changeAddresses, tx.DustFeeRate,
-					tx.FeeRate, true, true)
+				// Break change between supplied addresses. A target fee doesn't increase with the
+				// outputs so their fees aren't subtracted.
+				outputs, err := BreakValue(changeValue, breakValue, changeAddresses, tx.dustPolicy(),
+					tx.FeeRate, true, tx.TargetFee == 0)
 				if err != nil {
 					return errors.Wrap(err, "break change")
 				}
 
+				// Every change output can absorb fee adjustments, not just the last one.
+				for _, output := range outputs {
+					output.Supplement.IsRemainder = true
+				}
+
 				tx.AddOutputs(outputs)
+				if len(outputs) == 0 {
+					tx.DroppedChange = changeValue // too small for a change output
+				} else {
+					tx.DroppedChange = 0
+				}
 				if len(outputs) > 1 {
 					for _, output := range outputs[1:] {
 						estSize += uint64(output.TxOut.SerializeSize())
@@ -386,11 +559,11 @@ func (tx *TxBuilder) AddFundingBreakChange(utxos []bitcoin.UTXO, breakValue uint
 				}
 			}
 
-			return nil
+			return tx.checkFundedFee()
 		}
 
 		// More UTXOs required
-		estFeeValue = EstimatedFeeValue(estSize, feeRate)
+		estFeeValue = tx.FeeForSize(estSize)
 		neededFunding = estFeeValue + outputValue - inputValue
 	}
 
@@ -406,35 +579,90 @@ func (tx *TxBuilder) AddFundingBreakChange(utxos []bitcoin.UTXO, breakValue uint
 		outputValue+tx.EstimatedFee()))
 }
 
+// selectCoins uses the tx's coin selector to choose and order the UTXOs used for funding. UTXOs
+// that are uneconomic to spend are removed before selection and retained in the skipped list.
+// When SendMax is set every UTXO is used in the order provided since the tx is a sweep.
+func (tx *TxBuilder) selectCoins(utxos []bitcoin.UTXO, target uint64) (*CoinSelection, error) {
+	if tx.SendMax {
+		return InOrderSelector{}.SelectCoins(utxos, target, tx.FeeRate)
+	}
+
+	selector := tx.CoinSelector
+	if selector == nil {
+		selector = InOrderSelector{}
+	}
+
+	economic, uneconomic, err := SplitUneconomicUTXOs(utxos, tx.FeeRate)
+	if err != nil {
+		return nil, errors.Wrap(err, "split uneconomic")
+	}
+
+	selection, err := selector.SelectCoins(economic, target, tx.FeeRate)
+	if err != nil {
+		return nil, err
+	}
+
+	selection.addSkipped(uneconomic, tx.FeeRate)
+	return selection, nil
+}
+
+// fundingTarget returns the value that needs to be added to fund the tx, not including the fees
+// for the inputs that will be added. extraSize is the size of any outputs that will be added.
+func (tx *TxBuilder) fundingTarget(extraSize uint64) (uint64, error) {
+	size, err := tx.EstimateSize()
+	if err != nil {
+		return 0, errors.Wrap(err, "estimate size")
+	}
+
+	needed := tx.OutputValue(true) + tx.FeeForSize(uint64(size)+extraSize)
+	inputValue := tx.InputValue()
+	if inputValue >= needed {
+		return 0, nil
+	}
+
+	return needed - inputValue, nil
+}
+
+// hasRemainder returns true if the tx contains an output marked to receive the remainder.
+func (tx *TxBuilder) hasRemainder() bool {
+	for _, output := range tx.Outputs {
+		if output.IsRemainder {
+			return true
+		}
+	}
+
+	return false
+}
+
 // UTXOFee calculates the tx fee for the input to spend the UTXO.
-func UTXOFee(utxo bitcoin.UTXO, feeRate float32) (uint64, error) {
+func UTXOFee(utxo bitcoin.UTXO, feeRate FeeRate) (uint64, error) {
 	size, err := InputSize(utxo.LockingScript)
 	if err != nil {
 		return 0, errors.Wrap(err, "unlock size")
 	}
-	return EstimatedFeeValue(uint64(size), float64(feeRate)), nil
+	return EstimatedFeeValue(uint64(size), feeRate), nil
 }
 
-func UTXOInputSizeAndFee(utxo bitcoin.UTXO, feeRate float32) (int, uint64, error) {
+func UTXOInputSizeAndFee(utxo bitcoin.UTXO, feeRate FeeRate) (int, uint64, error) {
 	size, err := InputSize(utxo.LockingScript)
 	if err != nil {
 		return 0, 0, errors.Wrap(err, "unlock size")
 	}
 
-	return size, EstimatedFeeValue(uint64(size), float64(feeRate)), nil
+	return size, EstimatedFeeValue(uint64(size), feeRate), nil
 }
 
 // LockingScriptInputFee returns the tx fee to spend a locking script in an input in a tx.
-func LockingScriptInputFee(lockingScript bitcoin.Script, feeRate float32) (uint64, error) {
+func LockingScriptInputFee(lockingScript bitcoin.Script, feeRate FeeRate) (uint64, error) {
 	size, err := InputSize(lockingScript)
 	if err != nil {
 		return 0, errors.Wrap(err, "unlock size")
 	}
-	return EstimatedFeeValue(uint64(size), float64(feeRate)), nil
+	return EstimatedFeeValue(uint64(size), feeRate), nil
 }
 
 // AddressOutputFee returns the tx fee to include an address as an output in a tx.
-func AddressOutputFee(ra bitcoin.RawAddress, feeRate float32) (uint64, error) {
+func AddressOutputFee(ra bitcoin.RawAddress, feeRate FeeRate) (uint64, error) {
 	lockingScript, err := ra.LockingScript()
 	if err != nil {
 		return 0, errors.Wrap(err, "locking script")
@@ -444,7 +672,7 @@ func AddressOutputFee(ra bitcoin.RawAddress, feeRate float32) (uint64, error) {
 }
 
 // LockingScriptOutputFee returns the tx fee to include a locking script as an output in a tx.
-func LockingScriptOutputFee(lockingScript bitcoin.Script, feeRate float32) uint64 {
+func LockingScriptOutputFee(lockingScript bitcoin.Script, feeRate FeeRate) uint64 {
 	txout := wire.TxOut{LockingScript: lockingScript}
-	return EstimatedFeeValue(uint64(txout.SerializeSize()), float64(feeRate))
+	return EstimatedFeeValue(uint64(txout.SerializeSize()), feeRate)
 }
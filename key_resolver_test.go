@@ -0,0 +1,167 @@
+package txbuilder
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+)
+
+type testKeyResolver struct {
+	keys     map[string]bitcoin.Key
+	resolves map[string]int
+	lock     sync.Mutex
+}
+
+func (r *testKeyResolver) ResolveKey(ctx context.Context, keyID string) (bitcoin.Key, error) {
+	r.lock.Lock()
+	r.resolves[keyID]++
+	r.lock.Unlock()
+
+	key, ok := r.keys[keyID]
+	if !ok {
+		return bitcoin.Key{}, ErrMissingPrivateKey
+	}
+
+	return key, nil
+}
+
+// countingSigner counts requests for public keys.
+type countingSigner struct {
+	*KeySigner
+	publicKeysCalls int
+}
+
+func (s *countingSigner) PublicKeys(ctx context.Context,
+	keyID string) ([]bitcoin.PublicKey, error) {
+	s.publicKeysCalls++
+	return s.KeySigner.PublicKeys(ctx, keyID)
+}
+
+func Test_SignWithResolver(t *testing.T) {
+	resolver := &testKeyResolver{
+		keys:     make(map[string]bitcoin.Key),
+		resolves: make(map[string]int),
+	}
+	var allKeys, fallbackKeys []bitcoin.Key
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	tx.SetChangeLockingScript(randomLockingScript(), "")
+
+	for i, keyID := range []string{"a", "b", "a", ""} {
+		key, ok := resolver.keys[keyID]
+		if !ok {
+			k, err := bitcoin.GenerateKey(bitcoin.MainNet)
+			if err != nil {
+				t.Fatalf("Failed to generate key : %s", err)
+			}
+			key = k
+			allKeys = append(allKeys, key)
+
+			if len(keyID) == 0 {
+				fallbackKeys = append(fallbackKeys, key)
+			} else {
+				resolver.keys[keyID] = key
+			}
+		}
+
+		lockingScript, _ := key.LockingScript()
+		if err := tx.AddInputUTXO(bitcoin.UTXO{
+			Hash:          *randomTxId(),
+			Index:         uint32(i),
+			Value:         5000,
+			LockingScript: lockingScript,
+			KeyID:         keyID,
+		}); err != nil {
+			t.Fatalf("Failed to add input : %s", err)
+		}
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 15000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	keysTx := tx.Copy()
+
+	publicKeys, err := tx.SignWithResolver(context.Background(), resolver, fallbackKeys)
+	if err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if len(publicKeys) != 3 {
+		t.Fatalf("Wrong public key count : got %d, want %d", len(publicKeys), 3)
+	}
+
+	for keyID, count := range resolver.resolves {
+		if count != 1 {
+			t.Fatalf("Key %s resolved %d times", keyID, count)
+		}
+	}
+
+	if _, err := keysTx.Sign(allKeys); err != nil {
+		t.Fatalf("Failed to sign with keys : %s", err)
+	}
+
+	if !tx.MsgTx.TxHash().Equal(keysTx.MsgTx.TxHash()) {
+		t.Fatalf("Resolver tx doesn't match keys tx : %s != %s", tx.MsgTx.TxHash(),
+			keysTx.MsgTx.TxHash())
+	}
+
+	// Unknown key IDs are not signed.
+	unknownTx := keysTx.Copy()
+	unknownTx.Inputs[1].KeyID = "unknown"
+	unknownTx.MsgTx.TxIn[1].UnlockingScript = nil
+	if _, err := unknownTx.SignOnlyWithSigner(context.Background(),
+		NewResolverSigner(resolver, fallbackKeys)); err != ErrMissingPrivateKey {
+		t.Fatalf("Wrong error : got %v, want %s", err, ErrMissingPrivateKey)
+	}
+}
+
+func Test_Sign_Consolidation(t *testing.T) {
+	const count = 1000
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	keys := make([]bitcoin.Key, count)
+	for i := range keys {
+		key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+		if err != nil {
+			t.Fatalf("Failed to generate key : %s", err)
+		}
+		keys[i] = key
+
+		lockingScript, _ := key.LockingScript()
+		if err := tx.AddInputUTXO(bitcoin.UTXO{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         1000,
+			LockingScript: lockingScript,
+		}); err != nil {
+			t.Fatalf("Failed to add input : %s", err)
+		}
+	}
+
+	if err := tx.AddOutput(randomLockingScript(), 900*count, true, false); err != nil {
+		t.Fatalf("Failed to add output : %s", err)
+	}
+
+	signer := &countingSigner{KeySigner: NewKeySigner(keys)}
+	publicKeys, err := tx.SignWithSigner(context.Background(), signer)
+	if err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if len(publicKeys) != count {
+		t.Fatalf("Wrong public key count : got %d, want %d", len(publicKeys), count)
+	}
+
+	if signer.publicKeysCalls != 1 {
+		t.Fatalf("Public keys requested %d times", signer.publicKeysCalls)
+	}
+
+	if !tx.AllInputsAreSigned() {
+		t.Fatalf("Not all inputs signed")
+	}
+
+	t.Logf("Signed %d inputs, size %d, fee %d", count, tx.MsgTx.SerializeSize(), tx.Fee())
+}
@@ -12,6 +12,30 @@ type InputSupplement struct {
 
 	// Optional identifier for external use to track the key needed to sign the input.
 	KeyID string `json:"key_id,omitempty"`
+
+	// The signature hash type used to sign the input. SigHashForkID is always included. When zero
+	//   SigHashAll is used. Outputs the signature commits to are not modified by fee adjustments.
+	SigHashType SigHashType `json:"sig_hash_type,omitempty"`
+
+	// Signatures from the signers of a multi-PKH input that has not yet been signed by enough
+	//   signers to complete the unlocking script.
+	Signatures []*PartialSignature `json:"signatures,omitempty"`
+
+	// The redeem script of a P2SH input. It is required to sign and estimate the size of P2SH
+	//   inputs. Use SetRedeemScript to check that it matches the locking script.
+	RedeemScript bitcoin.Script `json:"redeem_script,omitempty"`
+
+	// The k value used to sign an R-puzzle (P2RPH) input. It is not serialized since anyone with k
+	//   can spend the input. Use SetRPuzzleK to check that it matches the locking script.
+	RPuzzleK []byte `json:"-"`
+}
+
+// PartialSignature is the signature of one of the signers of a multi-PKH input.
+type PartialSignature struct {
+	PublicKey bitcoin.PublicKey `json:"public_key"`
+
+	// The signature with the sig hash type byte appended, as it is in the unlocking script.
+	Signature bitcoin.Hex `json:"signature"`
 }
 
 // AddressKeyID is an address and a key ID.
@@ -30,6 +54,11 @@ type OutputSupplement struct {
 	//   added to the new amount.
 	IsDust bool `json:"is_dust"`
 
+	// Used by AdjustFee to choose which remainder outputs receive fee corrections when there is
+	//   more than one. When any output is marked only the marked outputs are used, otherwise all
+	//   remainder outputs are. They are split based on the tx's RemainderPolicy.
+	AbsorbsFee bool `json:"absorbs_fee,omitempty"`
+
 	// This output was added by the fee calculation and can be removed by the fee calculation.
 	addedForFee bool
 
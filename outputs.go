@@ -5,30 +5,33 @@ import (
 
 	"github.com/tokenized/pkg/bitcoin"
 	"github.com/tokenized/pkg/wire"
+	"github.com/tokenized/txbuilder/fees"
 
 	"github.com/pkg/errors"
 )
 
-// DustLimit calculates the dust limit
-func DustLimit(outputSize int, feeRate float32) uint64 {
-	if feeRate == 0 {
-		return uint64(1)
-	}
+// DustPolicy determines the minimum value of an output. A FeeRate is the legacy dust policy.
+type DustPolicy = fees.DustPolicy
 
-	dust := float32((outputSize+DustInputSize)*3) * feeRate
-	if dust < 1 {
-		return uint64(1)
-	}
-	return uint64(dust)
+// FixedDustPolicy is a dust policy where every output must be worth at least a fixed number of
+// satoshis.
+type FixedDustPolicy = fees.FixedDustPolicy
+
+// ZeroDustPolicy is a dust policy that allows outputs of any value.
+type ZeroDustPolicy = fees.ZeroDustPolicy
+
+// DustLimit calculates the dust limit
+func DustLimit(outputSize int, dustPolicy DustPolicy) uint64 {
+	return fees.DustLimit(outputSize, dustPolicy)
 }
 
-// DustLimitForOutput calculates the dust limit
-func DustLimitForOutput(output *wire.TxOut, feeRate float32) uint64 {
-	return DustLimit(output.SerializeSize(), feeRate)
+// DustLimitForOutput calculates the dust limit. Data outputs don't have a dust limit.
+func DustLimitForOutput(output *wire.TxOut, dustPolicy DustPolicy) uint64 {
+	return fees.DustLimitForOutput(output, dustPolicy)
 }
 
 // DustLimitForAddress calculates the dust limit
-func DustLimitForAddress(ra bitcoin.RawAddress, feeRate float32) (uint64, error) {
+func DustLimitForAddress(ra bitcoin.RawAddress, dustPolicy DustPolicy) (uint64, error) {
 	lockingScript, err := ra.LockingScript()
 	if err != nil {
 		return 0, errors.Wrap(err, "address locking script")
@@ -36,56 +39,69 @@ func DustLimitForAddress(ra bitcoin.RawAddress, feeRate float32) (uint64, error)
 	output := &wire.TxOut{
 		LockingScript: lockingScript,
 	}
-	return DustLimitForOutput(output, feeRate), nil
+	return DustLimitForOutput(output, dustPolicy), nil
 }
 
 // DustLimitForLockingScript calculates the dust limit
-func DustLimitForLockingScript(lockingScript bitcoin.Script, feeRate float32) uint64 {
+func DustLimitForLockingScript(lockingScript bitcoin.Script, dustPolicy DustPolicy) uint64 {
 	output := &wire.TxOut{
 		LockingScript: lockingScript,
 	}
-	return DustLimitForOutput(output, feeRate)
+	return DustLimitForOutput(output, dustPolicy)
 }
 
 // OutputFeeAndDustForLockingScript returns the tx fee required to include the locking script as an
 // output in a tx and the dust limit of that output.
-func OutputFeeAndDustForLockingScript(lockingScript bitcoin.Script,
-	dustFeeRate, feeRate float32) (uint64, uint64) {
+func OutputFeeAndDustForLockingScript(lockingScript bitcoin.Script, dustPolicy DustPolicy,
+	feeRate FeeRate) (uint64, uint64) {
 
 	output := &wire.TxOut{
 		LockingScript: lockingScript,
 	}
 	outputSize := output.SerializeSize()
 
-	return EstimatedFeeValue(uint64(outputSize), float64(feeRate)), DustLimit(outputSize, dustFeeRate)
+	return EstimatedFeeValue(uint64(outputSize), feeRate), DustLimitForOutput(output, dustPolicy)
 }
 
 // OutputFeeAndDustForAddress returns the tx fee required to include the address as an output in a
 // tx and the dust limit of that output.
-func OutputFeeAndDustForAddress(ra bitcoin.RawAddress, dustFeeRate,
-	feeRate float32) (uint64, uint64, error) {
+func OutputFeeAndDustForAddress(ra bitcoin.RawAddress, dustPolicy DustPolicy,
+	feeRate FeeRate) (uint64, uint64, error) {
 
 	lockingScript, err := ra.LockingScript()
 	if err != nil {
 		return 0, 0, errors.Wrap(err, "address locking script")
 	}
-	f, d := OutputFeeAndDustForLockingScript(lockingScript, dustFeeRate, feeRate)
+	f, d := OutputFeeAndDustForLockingScript(lockingScript, dustPolicy, feeRate)
 	return f, d, nil
 }
 
-func OutputTotalCost(lockingScript bitcoin.Script, feeRate float32) (uint64, uint64, error) {
-	output := &wire.TxOut{
-		LockingScript: lockingScript,
-	}
-	outputSize := uint64(output.SerializeSize())
+// OutputTotalCost calculates the satoshis required in tx fees to include an output with the
+// specified locking script and then to include an input in a tx to spend that output.
+func OutputTotalCost(lockingScript bitcoin.Script, feeRate FeeRate) (uint64, uint64, error) {
+	return fees.OutputTotalCost(lockingScript, feeRate)
+}
 
-	inputSize, err := InputSize(lockingScript)
+// outputTotalCost is OutputTotalCost at the tx's fee rate with the input size estimated by the
+// tx's unlocking sizer. The input fee is zero when the locking script's template is unknown.
+func (tx *TxBuilder) outputTotalCost(lockingScript bitcoin.Script) (uint64, uint64) {
+	outputFee := fees.EstimateFeeValue(OutputSize(lockingScript), tx.FeeRate)
+
+	inputSize, err := tx.inputSize(lockingScript)
 	if err != nil {
-		return EstimatedFeeValue(outputSize, float64(feeRate)), 0, errors.Wrapf(err, "input size")
+		return outputFee, 0
+	}
+
+	return outputFee, fees.EstimateFeeValue(inputSize, tx.FeeRate)
+}
+
+// dustPolicy returns the dust policy used by the tx.
+func (tx *TxBuilder) dustPolicy() DustPolicy {
+	if tx.DustPolicy != nil {
+		return tx.DustPolicy
 	}
 
-	return EstimatedFeeValue(outputSize, float64(feeRate)),
-		EstimatedFeeValue(uint64(inputSize), float64(feeRate)), nil
+	return tx.DustFeeRate
 }
 
 // OutputAddress returns the address that the output is paying to.
@@ -182,7 +198,7 @@ func (tx *TxBuilder) AddOutput(lockScript bitcoin.Script, value uint64,
 		LockingScript: lockScript,
 	}
 
-	outputFee, dust := OutputFeeAndDustForLockingScript(txout.LockingScript, tx.DustFeeRate,
+	outputFee, dust := OutputFeeAndDustForLockingScript(txout.LockingScript, tx.dustPolicy(),
 		tx.FeeRate)
 	if isDust {
 		txout.Value = dust
@@ -211,7 +227,7 @@ func (tx *TxBuilder) InsertOutput(index int, lockScript bitcoin.Script, value ui
 		LockingScript: lockScript,
 	}
 
-	outputFee, dust := OutputFeeAndDustForLockingScript(txout.LockingScript, tx.DustFeeRate,
+	outputFee, dust := OutputFeeAndDustForLockingScript(txout.LockingScript, tx.dustPolicy(),
 		tx.FeeRate)
 	if isDust {
 		txout.Value = dust
@@ -249,7 +265,7 @@ func (tx *TxBuilder) AddValueToOutput(index uint32, value uint64) error {
 	}
 
 	if tx.Outputs[index].IsDust {
-		if value < DustLimitForOutput(tx.MsgTx.TxOut[index], tx.DustFeeRate) {
+		if value < DustLimitForOutput(tx.MsgTx.TxOut[index], tx.dustPolicy()) {
 			return ErrBelowDustValue
 		}
 		tx.Outputs[index].IsDust = false
@@ -266,7 +282,7 @@ func (tx *TxBuilder) SubtractValueFromOutput(index uint32, value uint64) error {
 		return errors.New("Output index out of range")
 	}
 
-	dust := DustLimitForOutput(tx.MsgTx.TxOut[index], tx.DustFeeRate)
+	dust := DustLimitForOutput(tx.MsgTx.TxOut[index], tx.dustPolicy())
 
 	if tx.MsgTx.TxOut[index].Value-dust < value {
 		return fmt.Errorf("Output value too small to subtract : %d - %d (dust %d)",
@@ -284,7 +300,7 @@ func (tx *TxBuilder) SetOutputToDust(index uint32) error {
 	}
 
 	tx.Outputs[index].IsDust = true
-	tx.MsgTx.TxOut[index].Value = DustLimitForOutput(tx.MsgTx.TxOut[index], tx.DustFeeRate)
+	tx.MsgTx.TxOut[index].Value = DustLimitForOutput(tx.MsgTx.TxOut[index], tx.dustPolicy())
 	return nil
 }
 
@@ -0,0 +1,185 @@
+package txbuilder
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/txbuilder/fees"
+
+	"github.com/pkg/errors"
+)
+
+// SetRedeemScript sets the redeem script of a P2SH input. The redeem script must hash to the
+// script hash in the input's locking script. P2PKH and multi-sig redeem scripts can be signed.
+func (tx *TxBuilder) SetRedeemScript(index int, redeemScript bitcoin.Script) error {
+	if index >= len(tx.Inputs) {
+		return errors.New("Input index out of range")
+	}
+
+	if err := checkRedeemScript(tx.Inputs[index].LockingScript, redeemScript); err != nil {
+		return err
+	}
+
+	tx.Inputs[index].RedeemScript = redeemScript
+	return nil
+}
+
+// scriptCode returns the script that signatures for the input commit to. It is the redeem script
+// for P2SH inputs.
+func (input InputSupplement) scriptCode() bitcoin.Script {
+	if len(input.RedeemScript) > 0 {
+		return input.RedeemScript
+	}
+
+	return input.LockingScript
+}
+
+// InputRedeemScript returns the redeem script of the input or nil if it doesn't have one. It
+// implements fees.RedeemScripts so the fees package can estimate the size of P2SH inputs.
+func (tx *TxBuilder) InputRedeemScript(index int) bitcoin.Script {
+	if index >= len(tx.Inputs) {
+		return nil
+	}
+
+	return tx.Inputs[index].RedeemScript
+}
+
+// estimateInputSize returns the estimated size of the input after it is unlocked, using the redeem
+// script for P2SH inputs.
+func (tx *TxBuilder) estimateInputSize(index int) (int, error) {
+	return fees.EstimateTxInputSize(tx, index, tx.unlockingSizer(false))
+}
+
+// signP2SH signs a P2SH input with a P2PKH or multi-sig redeem script and returns the public keys
+// of the keys used.
+func (tx *TxBuilder) signP2SH(index int, publicKeys *publicKeyIndex,
+	sign func(bitcoin.PublicKey) ([]byte, error)) ([]bitcoin.PublicKey, error) {
+
+	input := tx.Inputs[index]
+	if err := checkRedeemScript(input.LockingScript, input.RedeemScript); err != nil {
+		return nil, err
+	}
+
+	redeemScript := input.RedeemScript
+	if redeemScript.IsP2PKH() {
+		ra, err := bitcoin.RawAddressFromLockingScript(redeemScript)
+		if err != nil {
+			return nil, errors.Wrap(err, "address")
+		}
+
+		hash, err := ra.Hash()
+		if err != nil {
+			return nil, errors.Wrap(err, "address hash")
+		}
+
+		publicKey, ok := publicKeys.forHash(hash.Bytes())
+		if !ok {
+			return nil, ErrMissingPrivateKey
+		}
+
+		sig, err := sign(publicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		unlockingScript, err := P2SHUnlockingScript(redeemScript,
+			bitcoin.ConcatScript(bitcoin.PushData(sig), bitcoin.PushData(publicKey.Bytes())))
+		if err != nil {
+			return nil, err
+		}
+
+		tx.MsgTx.TxIn[index].UnlockingScript = unlockingScript
+		return []bitcoin.PublicKey{publicKey}, nil
+	}
+
+	if required, multiSigKeys, err := fees.ParseMultiSig(redeemScript); err == nil {
+		var usedKeys []bitcoin.PublicKey
+		var sigs [][]byte
+		for _, b := range multiSigKeys {
+			if len(sigs) == required {
+				break
+			}
+
+			publicKey, ok := publicKeys.forPublicKey(b)
+			if !ok {
+				continue
+			}
+
+			sig, err := sign(publicKey)
+			if err != nil {
+				return nil, err
+			}
+
+			sigs = append(sigs, sig)
+			usedKeys = append(usedKeys, publicKey)
+		}
+
+		if len(sigs) < required {
+			return nil, errors.Wrapf(ErrMissingPrivateKey, "multi-sig %d of %d: signers %d",
+				required, len(multiSigKeys), len(sigs))
+		}
+
+		unlockingScript, err := P2SHUnlockingScript(redeemScript, MultiSigUnlockingScript(sigs))
+		if err != nil {
+			return nil, err
+		}
+
+		tx.MsgTx.TxIn[index].UnlockingScript = unlockingScript
+		return usedKeys, nil
+	}
+
+	return nil, errors.Wrap(ErrWrongScriptTemplate, "Not P2PKH or multi-sig redeem script")
+}
+
+// P2SHUnlockingScript returns an unlocking script for a P2SH locking script. It is the unlocking
+// script for the redeem script followed by a push of the redeem script.
+// Note: This replaces P2SHUnlockingScript(script []byte), which was never implemented and always
+// returned an error. Callers must now provide the redeem script and its unlocking script.
+func P2SHUnlockingScript(redeemScript, redeemUnlockingScript bitcoin.Script) (bitcoin.Script,
+	error) {
+	// <Redeem Unlocking Script> <RedeemScript>
+	if len(redeemScript) == 0 {
+		return nil, errors.Wrap(ErrMissingInputData, "redeem script")
+	}
+
+	return bitcoin.ConcatScript(redeemUnlockingScript, bitcoin.PushData(redeemScript)), nil
+}
+
+// MultiSigUnlockingScript returns an unlocking script for a multi-sig script. The signatures must
+// be in the same order as their public keys in the multi-sig script.
+func MultiSigUnlockingScript(sigs [][]byte) bitcoin.Script {
+	// OP_FALSE <Signature>...
+	// OP_FALSE is the extra item removed from the stack by OP_CHECKMULTISIG.
+	result := bitcoin.Script{bitcoin.OP_FALSE}
+	for _, sig := range sigs {
+		result = bitcoin.ConcatScript(result, bitcoin.PushData(sig))
+	}
+
+	return result
+}
+
+// checkRedeemScript returns an error if the locking script is not P2SH or the redeem script
+// doesn't match its script hash.
+func checkRedeemScript(lockingScript, redeemScript bitcoin.Script) error {
+	ra, err := bitcoin.RawAddressFromLockingScript(lockingScript)
+	if err != nil {
+		return errors.Wrap(err, "address")
+	}
+
+	if ra.Type() != bitcoin.ScriptTypeSH {
+		return errors.Wrap(ErrWrongScriptTemplate, "Not a P2SH locking script")
+	}
+
+	hash, err := ra.Hash()
+	if err != nil {
+		return errors.Wrap(err, "address hash")
+	}
+
+	if !bytes.Equal(hash.Bytes(), bitcoin.Hash160(redeemScript)) {
+		return errors.Wrap(ErrWrongScriptTemplate, fmt.Sprintf("Redeem script hash : required %x",
+			hash.Bytes()))
+	}
+
+	return nil
+}
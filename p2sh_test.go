@@ -0,0 +1,204 @@
+package txbuilder
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/tokenized/bitcoin_interpreter"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/txbuilder/fees"
+
+	"github.com/pkg/errors"
+)
+
+func p2shLockingScript(redeemScript bitcoin.Script) bitcoin.Script {
+	return bitcoin.ConcatScript(bitcoin.Script{bitcoin.OP_HASH160},
+		bitcoin.PushData(bitcoin.Hash160(redeemScript)), bitcoin.Script{bitcoin.OP_EQUAL})
+}
+
+func multiSigScript(required int, keys []bitcoin.Key) bitcoin.Script {
+	result := bitcoin.Script{bitcoin.OP_1 + byte(required-1)}
+	for _, key := range keys {
+		result = bitcoin.ConcatScript(result, bitcoin.PushData(key.PublicKey().Bytes()))
+	}
+
+	return bitcoin.ConcatScript(result, bitcoin.Script{bitcoin.OP_1 + byte(len(keys)-1),
+		bitcoin.OP_CHECKMULTISIG})
+}
+
+// verifyP2SHInput verifies the unmodified P2SH spend with the interpreter, then verifies the
+// redeem script evaluation separately.
+// The interpreter follows post-genesis rules where P2SH is not special, so the spend itself only
+// runs OP_HASH160 <hash> OP_EQUAL against the pushed redeem script and never evaluates the redeem
+// script. Legacy P2SH outputs are still evaluated by miners, so the hash of the pushed redeem script
+// is checked and the redeem script is run against the rest of the unlocking script.
+func verifyP2SHInput(t *testing.T, tx *TxBuilder, index int) {
+	ctx := context.Background()
+	if err := bitcoin_interpreter.VerifyTx(ctx, tx); err != nil {
+		t.Fatalf("Failed to verify tx : %s", err)
+	}
+
+	redeemScript := tx.Inputs[index].RedeemScript
+	unlockingScript := tx.MsgTx.TxIn[index].UnlockingScript
+	items, err := bitcoin.ParseScriptItems(bytes.NewReader(unlockingScript), -1)
+	if err != nil {
+		t.Fatalf("Failed to parse unlocking script : %s", err)
+	}
+
+	if len(items) < 2 {
+		t.Fatalf("Wrong unlocking script item count : %d", len(items))
+	}
+
+	pushedRedeemScript := items[len(items)-1].Data
+	if !bytes.Equal(pushedRedeemScript, redeemScript) {
+		t.Fatalf("Unlocking script doesn't end with redeem script : %x", []byte(unlockingScript))
+	}
+
+	ra, err := bitcoin.RawAddressFromLockingScript(tx.Inputs[index].LockingScript)
+	if err != nil {
+		t.Fatalf("Failed to get locking script address : %s", err)
+	}
+
+	hash, err := ra.Hash()
+	if err != nil {
+		t.Fatalf("Failed to get locking script hash : %s", err)
+	}
+
+	if !bytes.Equal(hash.Bytes(), bitcoin.Hash160(pushedRedeemScript)) {
+		t.Fatalf("Pushed redeem script doesn't match script hash")
+	}
+
+	// Signatures commit to the redeem script so the redeem script evaluation is verified by using
+	// it as the locking script with the redeem script push removed.
+	redeemPush := bitcoin.PushData(redeemScript)
+	redeemTx := tx.Copy()
+	redeemTx.Inputs[index].LockingScript = redeemScript
+	redeemTx.MsgTx.TxIn[index].UnlockingScript = unlockingScript[:len(unlockingScript)-
+		len(redeemPush)]
+
+	if err := bitcoin_interpreter.VerifyTx(ctx, &redeemTx); err != nil {
+		t.Fatalf("Failed to verify redeem script : %s", err)
+	}
+}
+
+func Test_Sign_P2SH_P2PKH(t *testing.T) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	redeemScript, _ := key.LockingScript()
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	tx.SetChangeLockingScript(randomLockingScript(), "")
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: p2shLockingScript(redeemScript),
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if _, err := tx.EstimateSize(); err == nil {
+		t.Fatalf("Size estimate should fail without redeem script")
+	}
+
+	err = tx.SetRedeemScript(0, randomLockingScript())
+	if errors.Cause(err) != ErrWrongScriptTemplate {
+		t.Fatalf("Wrong redeem script error : got %v, want %s", err, ErrWrongScriptTemplate)
+	}
+
+	if err := tx.SetRedeemScript(0, redeemScript); err != nil {
+		t.Fatalf("Failed to set redeem script : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	estimatedSize, err := tx.EstimateSize()
+	if err != nil {
+		t.Fatalf("Failed to estimate size : %s", err)
+	}
+
+	// The fees package uses the redeem scripts provided by the tx.
+	standardSize, dataSize, err := fees.EstimateSizes(tx, fees.TemplateSizer{})
+	if err != nil {
+		t.Fatalf("Failed to estimate fees package sizes : %s", err)
+	}
+
+	if standardSize+dataSize != estimatedSize {
+		t.Fatalf("Wrong fees package size : got %d, want %d", standardSize+dataSize,
+			estimatedSize)
+	}
+
+	if _, err := tx.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if size := tx.MsgTx.SerializeSize(); size > estimatedSize {
+		t.Fatalf("Size above estimate : got %d, estimated %d", size, estimatedSize)
+	}
+
+	verifyP2SHInput(t, tx, 0)
+}
+
+func Test_Sign_P2SH_MultiSig(t *testing.T) {
+	var keys []bitcoin.Key
+	for i := 0; i < 3; i++ {
+		key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+		if err != nil {
+			t.Fatalf("Failed to generate key : %s", err)
+		}
+		keys = append(keys, key)
+	}
+	redeemScript := multiSigScript(2, keys)
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	tx.SetChangeLockingScript(randomLockingScript(), "")
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: p2shLockingScript(redeemScript),
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := tx.SetRedeemScript(0, redeemScript); err != nil {
+		t.Fatalf("Failed to set redeem script : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if _, err := tx.SignOnly(keys[1:2]); errors.Cause(err) != ErrMissingPrivateKey {
+		t.Fatalf("Wrong sign error : got %v, want %s", err, ErrMissingPrivateKey)
+	}
+
+	if tx.InputIsSigned(0) {
+		t.Fatalf("Input should not be signed with one key")
+	}
+
+	estimatedSize, err := tx.EstimateSize()
+	if err != nil {
+		t.Fatalf("Failed to estimate size : %s", err)
+	}
+
+	usedKeys, err := tx.Sign([]bitcoin.Key{keys[2], keys[0]})
+	if err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if len(usedKeys) != 2 {
+		t.Fatalf("Wrong used key count : got %d, want %d", len(usedKeys), 2)
+	}
+
+	if size := tx.MsgTx.SerializeSize(); size > estimatedSize {
+		t.Fatalf("Size above estimate : got %d, estimated %d", size, estimatedSize)
+	}
+
+	verifyP2SHInput(t, tx, 0)
+}
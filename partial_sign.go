@@ -0,0 +1,457 @@
+package txbuilder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+// SignMultiPKHInput adds signatures to a multi-PKH input for the signers the signer has keys for.
+// The signatures are kept in the input's supplement so they can be transported with the tx and
+// merged with signatures from other parties. When enough signers have signed the unlocking script
+// is completed. Use MissingSigners to find which signers are still needed.
+// The tx must not be modified after partial signatures are added since that invalidates them.
+func (tx *TxBuilder) SignMultiPKHInput(ctx context.Context, index int,
+	signer Signer) ([]bitcoin.PublicKey, error) {
+
+	if index >= len(tx.Inputs) {
+		return nil, errors.New("Input index out of range")
+	}
+
+	input := tx.Inputs[index]
+	publicKeys, err := newSigningKeys(signer).index(ctx, input.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	hashType := input.signatureHashType()
+	shc := &SigHashCache{}
+	sign := func(publicKey bitcoin.PublicKey) ([]byte, error) {
+		hash, err := SignatureHash(tx.MsgTx, index, input.scriptCode(), input.Value, hashType,
+			shc)
+		if err != nil {
+			return nil, errors.Wrap(err, "sig hash")
+		}
+
+		sig, err := signer.Sign(ctx, publicKey, input.KeyID, *hash)
+		if err != nil {
+			return nil, errors.Wrap(err, "sign")
+		}
+
+		return finalizeSignature(sig, hashType)
+	}
+
+	usedKeys, _, err := tx.signMultiPKH(index, publicKeys, sign, shc)
+	return usedKeys, err
+}
+
+// AddPartialSignature adds a signature from one of the signers of a multi-PKH input. The signature
+// must be valid for the tx and use the input's sig hash type. When enough signers have signed the
+// unlocking script is completed. It returns ErrInputAlreadySigned if the unlocking script is
+// already complete.
+func (tx *TxBuilder) AddPartialSignature(index int, sig PartialSignature) error {
+	if index >= len(tx.Inputs) {
+		return errors.New("Input index out of range")
+	}
+
+	if tx.InputIsSigned(index) {
+		return errors.Wrapf(ErrInputAlreadySigned, "input %d", index)
+	}
+
+	input := tx.Inputs[index]
+	required, hashes, err := multiPKHSigners(input.LockingScript)
+	if err != nil {
+		return err
+	}
+
+	hash, _ := bitcoin.NewHash20(bitcoin.Hash160(sig.PublicKey.Bytes()))
+	if !containsHash(hashes, *hash) {
+		return errors.Wrap(ErrWrongPrivateKey, "not a signer")
+	}
+
+	shc := &SigHashCache{}
+	if !tx.partialSignatureIsValid(index, sig, shc) {
+		return errors.Wrap(ErrInvalidSignature, sig.PublicKey.String())
+	}
+
+	input.setPartialSignature(sig)
+
+	tx.completeMultiPKH(index, required, hashes, tx.validPartialSignatures(index, shc))
+	return nil
+}
+
+// MergePartialSignatures adds the partial signatures from another copy of the tx that was signed
+// by other parties. When the other copy has already completed the unlocking script of a multi-PKH
+// input its signatures are checked and the unlocking script is copied.
+func (tx *TxBuilder) MergePartialSignatures(other *TxBuilder) error {
+	if len(other.Inputs) != len(tx.Inputs) || len(other.MsgTx.TxIn) != len(tx.MsgTx.TxIn) {
+		return errors.New("Different inputs")
+	}
+
+	for index, input := range other.Inputs {
+		otherOutpoint := other.MsgTx.TxIn[index].PreviousOutPoint
+		outpoint := tx.MsgTx.TxIn[index].PreviousOutPoint
+		if !otherOutpoint.Hash.Equal(&outpoint.Hash) || otherOutpoint.Index != outpoint.Index {
+			return fmt.Errorf("Different outpoint for input %d", index)
+		}
+
+		if tx.InputIsSigned(index) {
+			continue
+		}
+
+		if other.InputIsSigned(index) {
+			if _, _, err := input.LockingScript.MultiPKHCounts(); err != nil {
+				continue // not a multi-PKH input
+			}
+
+			// The partial signatures were removed when the unlocking script was completed.
+			if err := tx.setMultiPKHUnlockingScript(index,
+				other.MsgTx.TxIn[index].UnlockingScript); err != nil {
+				return errors.Wrapf(err, "input %d", index)
+			}
+			continue
+		}
+
+		for _, sig := range input.Signatures {
+			if tx.InputIsSigned(index) {
+				break // earlier signatures completed the unlocking script
+			}
+
+			if err := tx.AddPartialSignature(index, *sig); err != nil {
+				return errors.Wrapf(err, "input %d", index)
+			}
+		}
+	}
+
+	return nil
+}
+
+// setMultiPKHUnlockingScript sets the unlocking script of a multi-PKH input to a completed
+// unlocking script after checking that it contains enough valid signatures from the input's
+// signers in the right positions.
+func (tx *TxBuilder) setMultiPKHUnlockingScript(index int, unlockingScript bitcoin.Script) error {
+	required, hashes, err := multiPKHSigners(tx.Inputs[index].LockingScript)
+	if err != nil {
+		return err
+	}
+
+	sigs, err := multiPKHUnlockingSignatures(unlockingScript, len(hashes))
+	if err != nil {
+		return err
+	}
+
+	shc := &SigHashCache{}
+	count := 0
+	for i, sig := range sigs {
+		if sig == nil {
+			continue
+		}
+
+		hash, _ := bitcoin.NewHash20(bitcoin.Hash160(sig.PublicKey.Bytes()))
+		if !hash.Equal(&hashes[i]) {
+			return errors.Wrap(ErrWrongPrivateKey, "not a signer")
+		}
+
+		if !tx.partialSignatureIsValid(index, *sig, shc) {
+			return errors.Wrap(ErrInvalidSignature, sig.PublicKey.String())
+		}
+
+		count++
+	}
+
+	if count < required {
+		return errors.Wrapf(ErrInvalidSignature, "%d of %d required signatures", count, required)
+	}
+
+	tx.MsgTx.TxIn[index].UnlockingScript = append(bitcoin.Script(nil), unlockingScript...)
+	tx.Inputs[index].Signatures = nil
+	return nil
+}
+
+// MissingSigners returns the number of additional signatures needed to complete a multi-PKH input
+// and the public key hashes of the signers that have not signed yet.
+func (tx *TxBuilder) MissingSigners(index int) (int, []bitcoin.Hash20, error) {
+	if index >= len(tx.Inputs) {
+		return 0, nil, errors.New("Input index out of range")
+	}
+
+	required, hashes, err := multiPKHSigners(tx.Inputs[index].LockingScript)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if tx.InputIsSigned(index) {
+		return 0, nil, nil
+	}
+
+	valid := tx.validPartialSignatures(index, &SigHashCache{})
+	var missing []bitcoin.Hash20
+	for _, hash := range hashes {
+		if _, ok := valid[hash]; !ok {
+			missing = append(missing, hash)
+		}
+	}
+
+	needed := 0
+	if len(valid) < required {
+		needed = required - len(valid)
+	}
+
+	return needed, missing, nil
+}
+
+// signMultiPKH signs a multi-PKH input with the available keys for signers that don't already have
+// a valid partial signature. The signatures are added to the input's partial signatures and the
+// unlocking script is completed if there are enough. It returns the public keys used and true if
+// the unlocking script was completed.
+func (tx *TxBuilder) signMultiPKH(index int, publicKeys *publicKeyIndex,
+	sign func(bitcoin.PublicKey) ([]byte, error),
+	shc *SigHashCache) ([]bitcoin.PublicKey, bool, error) {
+
+	input := tx.Inputs[index]
+	required, hashes, err := multiPKHSigners(input.LockingScript)
+	if err != nil {
+		return nil, false, err
+	}
+
+	valid := tx.validPartialSignatures(index, shc)
+
+	var usedKeys []bitcoin.PublicKey
+	for _, hash := range hashes {
+		if len(valid) >= required {
+			break
+		}
+
+		if _, ok := valid[hash]; ok {
+			continue
+		}
+
+		publicKey, ok := publicKeys.forHash(hash[:])
+		if !ok {
+			continue
+		}
+
+		sigBytes, err := sign(publicKey)
+		if err != nil {
+			return nil, false, err
+		}
+
+		sig := PartialSignature{
+			PublicKey: publicKey,
+			Signature: sigBytes,
+		}
+		input.setPartialSignature(sig)
+		valid[hash] = &sig
+
+		usedKeys = append(usedKeys, publicKey)
+	}
+
+	return usedKeys, tx.completeMultiPKH(index, required, hashes, valid), nil
+}
+
+// completeMultiPKH sets the unlocking script of a multi-PKH input if there are enough signatures.
+// The first required signers, in the order of the locking script, are used. The partial signatures
+// are removed since they are contained in the unlocking script.
+func (tx *TxBuilder) completeMultiPKH(index, required int, hashes []bitcoin.Hash20,
+	valid map[bitcoin.Hash20]*PartialSignature) bool {
+
+	if len(valid) < required {
+		return false
+	}
+
+	publicKeys := make([][]byte, len(hashes))
+	sigs := make([][]byte, len(hashes))
+	count := 0
+	for i, hash := range hashes {
+		if count == required {
+			break
+		}
+
+		sig, ok := valid[hash]
+		if !ok {
+			continue
+		}
+
+		publicKeys[i] = sig.PublicKey.Bytes()
+		sigs[i] = sig.Signature
+		count++
+	}
+
+	unlockingScript, err := P2MultiPKHUnlockingScript(uint16(required), publicKeys, sigs)
+	if err != nil {
+		return false
+	}
+
+	tx.MsgTx.TxIn[index].UnlockingScript = unlockingScript
+	tx.Inputs[index].Signatures = nil
+	return true
+}
+
+// validPartialSignatures returns the partial signatures of the input that are valid for the
+// current tx, by public key hash.
+func (tx *TxBuilder) validPartialSignatures(index int,
+	shc *SigHashCache) map[bitcoin.Hash20]*PartialSignature {
+
+	result := make(map[bitcoin.Hash20]*PartialSignature)
+	for _, sig := range tx.Inputs[index].Signatures {
+		if !tx.partialSignatureIsValid(index, *sig, shc) {
+			continue
+		}
+
+		hash, _ := bitcoin.NewHash20(bitcoin.Hash160(sig.PublicKey.Bytes()))
+		result[*hash] = sig
+	}
+
+	return result
+}
+
+// partialSignatureIsValid returns true if the signature is valid for the input of the current tx.
+// The signature must use the input's sig hash type since fee adjustments only preserve signatures
+// that commit to what the input's sig hash type specifies.
+func (tx *TxBuilder) partialSignatureIsValid(index int, sig PartialSignature,
+	shc *SigHashCache) bool {
+
+	// Signatures from co-signers must be strict DER with a low S value to be standard.
+	_, _, hashType, err := ParseUnlockingSignature(sig.Signature)
+	if err != nil {
+		return false
+	}
+
+	input := tx.Inputs[index]
+	if hashType != input.signatureHashType() {
+		return false
+	}
+
+	signature, err := bitcoin.SignatureFromBytes(sig.Signature[:len(sig.Signature)-1])
+	if err != nil {
+		return false
+	}
+
+	hash, err := SignatureHash(tx.MsgTx, index, input.scriptCode(), input.Value, hashType, shc)
+	if err != nil {
+		return false
+	}
+
+	return signature.Verify(*hash, sig.PublicKey)
+}
+
+// setPartialSignature adds the signature, replacing any previous signature from the same key.
+func (input *InputSupplement) setPartialSignature(sig PartialSignature) {
+	for i, existing := range input.Signatures {
+		if existing.PublicKey.Equal(sig.PublicKey) {
+			input.Signatures[i] = &sig
+			return
+		}
+	}
+
+	input.Signatures = append(input.Signatures, &sig)
+}
+
+// multiPKHSigners returns the required signer count and the public key hashes of the signers of a
+// multi-PKH locking script in the order they are in the script.
+func multiPKHSigners(lockingScript bitcoin.Script) (int, []bitcoin.Hash20, error) {
+	required, total, err := lockingScript.MultiPKHCounts()
+	if err != nil {
+		return 0, nil, errors.Wrap(ErrWrongScriptTemplate, "Not P2MultiPKH locking script")
+	}
+
+	scriptItems, err := bitcoin.ParseScriptItems(bytes.NewReader(lockingScript), -1)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "parse locking script")
+	}
+
+	hashes := make([]bitcoin.Hash20, 0, total)
+	for _, scriptItem := range scriptItems {
+		if scriptItem.Type != bitcoin.ScriptItemTypePushData ||
+			len(scriptItem.Data) != bitcoin.Hash20Size {
+			continue
+		}
+
+		hash, _ := bitcoin.NewHash20(scriptItem.Data)
+		hashes = append(hashes, *hash)
+	}
+
+	if uint32(len(hashes)) != total {
+		return 0, nil, errors.Wrap(ErrWrongScriptTemplate, "P2MultiPKH signer count")
+	}
+
+	return int(required), hashes, nil
+}
+
+// multiPKHUnlockingSignatures returns the signatures in a multi-PKH unlocking script in the order of
+// the signers in the locking script. Signers that didn't sign are nil.
+func multiPKHUnlockingSignatures(unlockingScript bitcoin.Script,
+	total int) ([]*PartialSignature, error) {
+
+	items, err := bitcoin.ParseScriptItems(bytes.NewReader(unlockingScript), -1)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse unlocking script")
+	}
+
+	// The signers are in reverse order since they are popped off of the stack. Each signer is either
+	// OP_FALSE or a signature, a public key, and OP_TRUE.
+	result := make([]*PartialSignature, total)
+	signer := total - 1
+	for i := 0; i < len(items); i++ {
+		if signer < 0 {
+			return nil, errors.Wrap(ErrWrongScriptTemplate, "P2MultiPKH signer count")
+		}
+
+		if items[i].Type != bitcoin.ScriptItemTypePushData || len(items[i].Data) == 0 {
+			signer--
+			continue
+		}
+
+		if i+2 >= len(items) || items[i+1].Type != bitcoin.ScriptItemTypePushData {
+			return nil, errors.Wrap(ErrWrongScriptTemplate, "P2MultiPKH signer public key")
+		}
+
+		publicKey, err := bitcoin.PublicKeyFromBytes(items[i+1].Data)
+		if err != nil {
+			return nil, errors.Wrap(err, "public key")
+		}
+
+		result[signer] = &PartialSignature{
+			PublicKey: publicKey,
+			Signature: append(bitcoin.Hex(nil), items[i].Data...),
+		}
+		signer--
+		i += 2
+	}
+
+	if signer != -1 {
+		return nil, errors.Wrap(ErrWrongScriptTemplate, "P2MultiPKH signer count")
+	}
+
+	return result, nil
+}
+
+func containsHash(hashes []bitcoin.Hash20, hash bitcoin.Hash20) bool {
+	for _, h := range hashes {
+		if h.Equal(&hash) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func copyPartialSignatures(sigs []*PartialSignature) []*PartialSignature {
+	if sigs == nil {
+		return nil
+	}
+
+	result := make([]*PartialSignature, len(sigs))
+	for i, sig := range sigs {
+		result[i] = &PartialSignature{
+			PublicKey: sig.PublicKey,
+			Signature: append(bitcoin.Hex(nil), sig.Signature...),
+		}
+	}
+
+	return result
+}
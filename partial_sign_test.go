@@ -0,0 +1,317 @@
+package txbuilder
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/tokenized/bitcoin_interpreter"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+func Test_SignMultiPKHInput_TwoOfThree(t *testing.T) {
+	ctx := context.Background()
+
+	var keys []bitcoin.Key
+	var pkhs [][]byte
+	for i := 0; i < 3; i++ {
+		key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+		if err != nil {
+			t.Fatalf("Failed to generate key : %s", err)
+		}
+		keys = append(keys, key)
+		pkhs = append(pkhs, bitcoin.Hash160(key.PublicKey().Bytes()))
+	}
+
+	ra, err := bitcoin.NewRawAddressMultiPKH(2, pkhs)
+	if err != nil {
+		t.Fatalf("Failed to create multi-PKH address : %s", err)
+	}
+	lockingScript, _ := ra.LockingScript()
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 9500, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	// First signer signs and sends the tx to the third signer.
+	publicKeys, err := tx.SignMultiPKHInput(ctx, 0, NewKeySigner(keys[:1]))
+	if err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if len(publicKeys) != 1 || !publicKeys[0].Equal(keys[0].PublicKey()) {
+		t.Fatalf("Wrong public keys : %v", publicKeys)
+	}
+
+	if tx.InputIsSigned(0) {
+		t.Fatalf("Input should not be signed with one signature")
+	}
+
+	needed, missing, err := tx.MissingSigners(0)
+	if err != nil {
+		t.Fatalf("Failed to get missing signers : %s", err)
+	}
+
+	if needed != 1 || len(missing) != 2 {
+		t.Fatalf("Wrong missing signers : needed %d, missing %d", needed, len(missing))
+	}
+
+	b, err := json.Marshal(tx)
+	if err != nil {
+		t.Fatalf("Failed to marshal tx : %s", err)
+	}
+
+	received := &TxBuilder{}
+	if err := json.Unmarshal(b, received); err != nil {
+		t.Fatalf("Failed to unmarshal tx : %s", err)
+	}
+
+	// Third signer completes the input and sends the tx back to the first signer, which merges it.
+	thirdTx := received.Copy()
+	if _, err := thirdTx.SignMultiPKHInput(ctx, 0, NewKeySigner(keys[2:])); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if !thirdTx.InputIsSigned(0) {
+		t.Fatalf("Input should be signed by the third signer")
+	}
+
+	if err := received.MergePartialSignatures(&thirdTx); err != nil {
+		t.Fatalf("Failed to merge signatures : %s", err)
+	}
+
+	if !received.InputIsSigned(0) {
+		t.Fatalf("Input should be signed")
+	}
+
+	if len(received.Inputs[0].Signatures) != 0 {
+		t.Fatalf("Partial signatures should be removed")
+	}
+
+	needed, missing, err = received.MissingSigners(0)
+	if err != nil {
+		t.Fatalf("Failed to get missing signers : %s", err)
+	}
+
+	if needed != 0 || len(missing) != 0 {
+		t.Fatalf("Wrong missing signers : needed %d, missing %d", needed, len(missing))
+	}
+
+	if err := bitcoin_interpreter.VerifyTx(ctx, received); err != nil {
+		t.Fatalf("Failed to verify tx : %s", err)
+	}
+
+	// Signing with the same two keys at once produces the same tx.
+	if _, err := tx.SignOnly([]bitcoin.Key{keys[0], keys[2]}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if !tx.MsgTx.TxHash().Equal(received.MsgTx.TxHash()) {
+		t.Fatalf("Merged tx doesn't match tx signed by both keys")
+	}
+}
+
+func Test_MergePartialSignatures_ThreeOfFive(t *testing.T) {
+	ctx := context.Background()
+
+	var keys []bitcoin.Key
+	var pkhs [][]byte
+	for i := 0; i < 5; i++ {
+		key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+		if err != nil {
+			t.Fatalf("Failed to generate key : %s", err)
+		}
+		keys = append(keys, key)
+		pkhs = append(pkhs, bitcoin.Hash160(key.PublicKey().Bytes()))
+	}
+
+	ra, err := bitcoin.NewRawAddressMultiPKH(3, pkhs)
+	if err != nil {
+		t.Fatalf("Failed to create multi-PKH address : %s", err)
+	}
+	lockingScript, _ := ra.LockingScript()
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 9000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	// Two parties each sign for two signers, so neither can complete the input alone.
+	first := tx.Copy()
+	if _, err := first.SignMultiPKHInput(ctx, 0, NewKeySigner(keys[:2])); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	second := tx.Copy()
+	if _, err := second.SignMultiPKHInput(ctx, 0, NewKeySigner(keys[2:4])); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if first.InputIsSigned(0) || second.InputIsSigned(0) {
+		t.Fatalf("Input should not be signed with two signatures")
+	}
+
+	// The first merged signature completes the input and the second isn't needed.
+	if err := first.MergePartialSignatures(&second); err != nil {
+		t.Fatalf("Failed to merge signatures : %s", err)
+	}
+
+	if !first.InputIsSigned(0) {
+		t.Fatalf("Input should be signed")
+	}
+
+	if err := bitcoin_interpreter.VerifyTx(ctx, &first); err != nil {
+		t.Fatalf("Failed to verify tx : %s", err)
+	}
+
+	// The second party merges the completed tx.
+	if err := second.MergePartialSignatures(&first); err != nil {
+		t.Fatalf("Failed to merge completed tx : %s", err)
+	}
+
+	if !second.MsgTx.TxHash().Equal(first.MsgTx.TxHash()) {
+		t.Fatalf("Merged tx doesn't match completed tx")
+	}
+
+	// A completed unlocking script with an invalid signature is rejected.
+	third := tx.Copy()
+	corrupt := first.Copy()
+	unlockingScript := append(bitcoin.Script(nil), first.MsgTx.TxIn[0].UnlockingScript...)
+	unlockingScript[len(unlockingScript)-40] ^= 0x01 // in the S value of the first signature
+	corrupt.MsgTx.TxIn[0].UnlockingScript = unlockingScript
+	if err := third.MergePartialSignatures(&corrupt); err == nil {
+		t.Fatalf("Merge should fail with invalid unlocking script")
+	}
+
+	if third.InputIsSigned(0) {
+		t.Fatalf("Input should not be signed after failed merge")
+	}
+}
+
+func Test_AddPartialSignature_Invalid(t *testing.T) {
+	var keys []bitcoin.Key
+	var pkhs [][]byte
+	for i := 0; i < 2; i++ {
+		key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+		if err != nil {
+			t.Fatalf("Failed to generate key : %s", err)
+		}
+		keys = append(keys, key)
+		pkhs = append(pkhs, bitcoin.Hash160(key.PublicKey().Bytes()))
+	}
+
+	ra, err := bitcoin.NewRawAddressMultiPKH(2, pkhs)
+	if err != nil {
+		t.Fatalf("Failed to create multi-PKH address : %s", err)
+	}
+	lockingScript, _ := ra.LockingScript()
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 9500, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	// Missing keys are reported but the signature produced is kept.
+	if _, err := tx.SignOnly(keys[:1]); errors.Cause(err) != ErrMissingPrivateKey {
+		t.Fatalf("Wrong error : got %v, want %s", err, ErrMissingPrivateKey)
+	}
+
+	if len(tx.Inputs[0].Signatures) != 1 {
+		t.Fatalf("Wrong partial signature count : got %d, want %d", len(tx.Inputs[0].Signatures),
+			1)
+	}
+
+	// Signatures for a different tx are rejected.
+	otherTx := tx.Copy()
+	otherTx.Inputs[0].Signatures = nil
+	otherTx.MsgTx.TxOut[0].Value--
+	if _, err := otherTx.SignMultiPKHInput(context.Background(), 0,
+		NewKeySigner(keys[1:])); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if err := tx.AddPartialSignature(0,
+		*otherTx.Inputs[0].Signatures[0]); errors.Cause(err) != ErrInvalidSignature {
+		t.Fatalf("Wrong error : got %v, want %s", err, ErrInvalidSignature)
+	}
+
+	// Signatures from keys that aren't signers are rejected.
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+
+	if err := tx.AddPartialSignature(0, PartialSignature{
+		PublicKey: key.PublicKey(),
+		Signature: otherTx.Inputs[0].Signatures[0].Signature,
+	}); errors.Cause(err) != ErrWrongPrivateKey {
+		t.Fatalf("Wrong error : got %v, want %s", err, ErrWrongPrivateKey)
+	}
+
+	// Signatures with a different sig hash type than the input's are rejected.
+	hashType := SigHashSingle | SigHashForkID
+	hash, err := SignatureHash(tx.MsgTx, 0, lockingScript, 10000, hashType, &SigHashCache{})
+	if err != nil {
+		t.Fatalf("Failed to create sig hash : %s", err)
+	}
+
+	sig, err := keys[1].Sign(*hash)
+	if err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if err := tx.AddPartialSignature(0, PartialSignature{
+		PublicKey: keys[1].PublicKey(),
+		Signature: append(sig.Bytes(), byte(hashType)),
+	}); errors.Cause(err) != ErrInvalidSignature {
+		t.Fatalf("Wrong error : got %v, want %s", err, ErrInvalidSignature)
+	}
+
+	if tx.InputIsSigned(0) {
+		t.Fatalf("Input should not be signed")
+	}
+
+	// Signatures for inputs that are already signed are rejected.
+	if _, err := tx.SignOnly(keys[1:]); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if !tx.InputIsSigned(0) {
+		t.Fatalf("Input should be signed")
+	}
+
+	if err := tx.AddPartialSignature(0,
+		*otherTx.Inputs[0].Signatures[0]); errors.Cause(err) != ErrInputAlreadySigned {
+		t.Fatalf("Wrong error : got %v, want %s", err, ErrInputAlreadySigned)
+	}
+}
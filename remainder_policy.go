@@ -0,0 +1,274 @@
+package txbuilder
+
+import (
+	"math/bits"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// RemainderPolicy specifies how fee adjustments are split between remainder outputs when there is
+// more than one.
+type RemainderPolicy uint8
+
+const (
+	// RemainderPolicyFirst puts fee adjustments in the first remainder output. Fee increases that
+	// are more than it can cover continue into the following remainder outputs. This is the
+	// default.
+	RemainderPolicyFirst = RemainderPolicy(0)
+
+	// RemainderPolicyLargest puts fee adjustments in the largest remainder output. Fee increases
+	// that are more than it can cover continue into the next largest.
+	RemainderPolicyLargest = RemainderPolicy(1)
+
+	// RemainderPolicyProportional splits fee adjustments between all remainder outputs in
+	// proportion to their values.
+	RemainderPolicyProportional = RemainderPolicy(2)
+)
+
+func (p RemainderPolicy) String() string {
+	switch p {
+	case RemainderPolicyFirst:
+		return "first"
+	case RemainderPolicyLargest:
+		return "largest"
+	case RemainderPolicyProportional:
+		return "proportional"
+	default:
+		return "unknown"
+	}
+}
+
+// remainderIndexes returns the indexes of the outputs that absorb fee adjustments in the order
+// specified by the remainder policy. If any remainder outputs are marked AbsorbsFee then only those
+// are included. Outputs committed to by input signatures are not included.
+func (tx *TxBuilder) remainderIndexes() []int {
+	committed, _ := tx.committedOutputs()
+
+	var all, absorbs []int
+	for i, output := range tx.Outputs {
+		if !output.IsRemainder || committed[i] {
+			continue
+		}
+
+		all = append(all, i)
+		if output.AbsorbsFee {
+			absorbs = append(absorbs, i)
+		}
+	}
+
+	result := all
+	if len(absorbs) > 0 {
+		result = absorbs
+	}
+
+	if tx.RemainderPolicy == RemainderPolicyLargest {
+		sort.SliceStable(result, func(i, j int) bool {
+			return tx.MsgTx.TxOut[result[i]].Value > tx.MsgTx.TxOut[result[j]].Value
+		})
+	}
+
+	return result
+}
+
+// remainderShares splits the amount between the outputs at the indexes based on the remainder
+// policy. indexes must be in the order returned by remainderIndexes.
+func (tx *TxBuilder) remainderShares(indexes []int, amount uint64) []uint64 {
+	result := make([]uint64, len(indexes))
+	if len(indexes) == 0 {
+		return result
+	}
+
+	if tx.RemainderPolicy != RemainderPolicyProportional {
+		result[0] = amount
+		return result
+	}
+
+	total := uint64(0)
+	for _, index := range indexes {
+		total += tx.MsgTx.TxOut[index].Value
+	}
+
+	if total == 0 {
+		result[0] = amount
+		return result
+	}
+
+	// amount * value / total split so the multiplication can't overflow and the high bits are
+	// always less than the divisor.
+	quotient := amount / total
+	remainder := amount % total
+	allocated := uint64(0)
+	for i, index := range indexes {
+		value := tx.MsgTx.TxOut[index].Value
+		hi, lo := bits.Mul64(remainder, value)
+		share, _ := bits.Div64(hi, lo, total)
+		result[i] = quotient*value + share
+		allocated += result[i]
+	}
+
+	// Rounding leftovers go to the first output.
+	result[0] += amount - allocated
+	return result
+}
+
+// removeFeeFromRemainders takes the amount out of the remainder outputs based on the remainder
+// policy. A remainder output that would drop below its dust limit is removed and any of its value
+// that isn't needed goes to the other remainder outputs. The last remainder output is only removed
+// if it was added by fee adjustment, otherwise it is reduced down to its dust limit. Outputs are not
+// modified when there isn't enough value. It returns true if an output was removed.
+func (tx *TxBuilder) removeFeeFromRemainders(amount uint64) (bool, error) {
+	indexes := tx.remainderIndexes()
+	if len(indexes) == 0 {
+		return false, errors.Wrap(ErrInsufficientValue, "No existing change for tx fee")
+	}
+
+	previous := tx.saveOutputs()
+	removed := make(map[int]bool)
+	leftover := uint64(0)
+	for amount > 0 {
+		var open []int
+		for _, index := range indexes {
+			if !removed[index] && (tx.MsgTx.TxOut[index].Value > tx.remainderDustLimit(index) ||
+				tx.remainderCanBeRemoved(indexes, removed, index)) {
+				open = append(open, index)
+			}
+		}
+
+		if len(open) == 0 {
+			break
+		}
+
+		shares := tx.remainderShares(open, amount)
+		for i, index := range open {
+			txout := tx.MsgTx.TxOut[index]
+			take := shares[i]
+			dust := tx.remainderDustLimit(index)
+			if txout.Value >= dust && txout.Value-dust >= take {
+				txout.Value -= take
+				amount -= take
+				continue
+			}
+
+			if tx.remainderCanBeRemoved(indexes, removed, index) {
+				// The whole value of the output is available when it is removed.
+				if txout.Value > take {
+					leftover += txout.Value - take
+					amount -= take
+				} else {
+					amount -= txout.Value
+				}
+				removed[index] = true
+				continue
+			}
+
+			if txout.Value > dust {
+				amount -= txout.Value - dust
+				txout.Value = dust
+			}
+		}
+
+		// Value left from removed outputs pays for the rest of the amount first.
+		if leftover > amount {
+			leftover -= amount
+			amount = 0
+		} else {
+			amount -= leftover
+			leftover = 0
+		}
+	}
+
+	if amount > 0 {
+		previous.restore(tx)
+		return false, errors.Wrap(ErrInsufficientValue, "Not enough change for tx fee")
+	}
+
+	if len(removed) == 0 {
+		return false, nil
+	}
+
+	removeIndexes := make([]int, 0, len(removed))
+	for index := range removed {
+		removeIndexes = append(removeIndexes, index)
+	}
+	tx.removeOutputs(removeIndexes)
+
+	if leftover > 0 {
+		if indexes := tx.remainderIndexes(); len(indexes) > 0 {
+			tx.addFeeToRemainders(indexes, leftover)
+		} else {
+			tx.DroppedChange += leftover
+		}
+	}
+
+	return true, nil
+}
+
+// remainderCanBeRemoved returns true if the remainder output can be removed to pay for a fee
+// increase. Removing it must not change the outputs committed to by input signatures, and it must
+// not be the last remainder output unless it was added by fee adjustment.
+func (tx *TxBuilder) remainderCanBeRemoved(indexes []int, removed map[int]bool, index int) bool {
+	if !tx.outputCanBeRemoved(index) {
+		return false
+	}
+
+	if tx.Outputs[index].addedForFee {
+		return true
+	}
+
+	return len(indexes)-len(removed) > 1
+}
+
+// addFeeToRemainders puts the amount into the remainder outputs based on the remainder policy.
+func (tx *TxBuilder) addFeeToRemainders(indexes []int, amount uint64) {
+	shares := tx.remainderShares(indexes, amount)
+	for i, index := range indexes {
+		tx.MsgTx.TxOut[index].Value += shares[i]
+	}
+}
+
+// remainderDustLimit returns the value a remainder output must stay at or above to be kept.
+// Outputs added by fee adjustment must also be worth more than the cost of including and spending
+// them.
+func (tx *TxBuilder) remainderDustLimit(index int) uint64 {
+	txout := tx.MsgTx.TxOut[index]
+	result := DustLimitForOutput(txout, tx.dustPolicy())
+
+	if tx.Outputs[index].addedForFee {
+		outputFee, inputFee := tx.outputTotalCost(txout.LockingScript)
+		if outputFee+inputFee > result {
+			result = outputFee + inputFee
+		}
+	}
+
+	return result
+}
+
+// outputCanBeRemoved returns true if removing the output doesn't change the outputs committed to by
+// input signatures. Removing an output moves the outputs after it to a lower index.
+func (tx *TxBuilder) outputCanBeRemoved(index int) bool {
+	committed, allCommitted := tx.committedOutputs()
+	if allCommitted {
+		return false
+	}
+
+	for i := index; i < len(committed); i++ {
+		if committed[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// removeOutputs removes the outputs at the specified indexes.
+func (tx *TxBuilder) removeOutputs(indexes []int) {
+	sorted := make([]int, len(indexes))
+	copy(sorted, indexes)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+
+	for _, index := range sorted {
+		tx.MsgTx.TxOut = append(tx.MsgTx.TxOut[:index], tx.MsgTx.TxOut[index+1:]...)
+		tx.Outputs = append(tx.Outputs[:index], tx.Outputs[index+1:]...)
+	}
+}
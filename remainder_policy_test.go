@@ -0,0 +1,251 @@
+package txbuilder
+
+import (
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+)
+
+func remainderPolicyTestTx(t *testing.T, policy RemainderPolicy,
+	dustFeeRate float32) *TxBuilder {
+
+	tx := NewTxBuilder(0.5, dustFeeRate)
+	tx.RemainderPolicy = policy
+
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         20000,
+		LockingScript: randomLockingScript(),
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	for _, value := range []uint64{1000, 5000, 200} {
+		if err := tx.AddPaymentOutput(randomAddress(), value, true); err != nil {
+			t.Fatalf("Failed to add remainder : %s", err)
+		}
+	}
+
+	return tx
+}
+
+func outputValues(tx *TxBuilder) []uint64 {
+	var result []uint64
+	for _, txout := range tx.MsgTx.TxOut {
+		result = append(result, txout.Value)
+	}
+	return result
+}
+
+func Test_RemainderPolicy_IncreaseFee(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      RemainderPolicy
+		dustFeeRate float32
+		amount      int64
+		values      []uint64
+		done        bool
+	}{
+		{
+			name:        "first",
+			policy:      RemainderPolicyFirst,
+			dustFeeRate: 0.25,
+			amount:      500,
+			values:      []uint64{5000, 500, 5000, 200},
+		},
+		{
+			name:        "first overflow",
+			policy:      RemainderPolicyFirst,
+			dustFeeRate: 0.25,
+			amount:      1500,
+			values:      []uint64{5000, 4500, 200},
+			done:        true,
+		},
+		{
+			name:        "largest",
+			policy:      RemainderPolicyLargest,
+			dustFeeRate: 0.25,
+			amount:      1500,
+			values:      []uint64{5000, 1000, 3500, 200},
+		},
+		{
+			name:        "proportional",
+			policy:      RemainderPolicyProportional,
+			dustFeeRate: 0.25,
+			amount:      1500,
+			values:      []uint64{5000, 757, 3791, 152},
+		},
+		{
+			name:        "proportional below dust",
+			policy:      RemainderPolicyProportional,
+			dustFeeRate: 1.0,
+			amount:      1500,
+			values:      []uint64{5000, 783, 3917},
+			done:        true,
+		},
+		{
+			name:        "proportional removes dust",
+			policy:      RemainderPolicyProportional,
+			dustFeeRate: 0.25,
+			amount:      2000,
+			values:      []uint64{5000, 699, 3501},
+			done:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := remainderPolicyTestTx(t, tt.policy, tt.dustFeeRate)
+			previousFee := tx.Fee()
+
+			done, err := tx.AdjustFee(tt.amount)
+			if err != nil {
+				t.Fatalf("Failed to adjust fee : %s", err)
+			}
+
+			values := outputValues(tx)
+			t.Logf("Values : %v", values)
+
+			if done != tt.done {
+				t.Errorf("Wrong done : got %t, want %t", done, tt.done)
+			}
+
+			if len(values) != len(tt.values) {
+				t.Fatalf("Wrong output count : got %d, want %d", len(values), len(tt.values))
+			}
+
+			for i, value := range values {
+				if value != tt.values[i] {
+					t.Errorf("Wrong output %d value : got %d, want %d", i, value, tt.values[i])
+				}
+			}
+
+			if tx.Fee() < previousFee+uint64(tt.amount) {
+				t.Errorf("Fee not increased enough : got %d, want %d", tx.Fee(),
+					previousFee+uint64(tt.amount))
+			}
+		})
+	}
+}
+
+func Test_RemainderPolicy_DecreaseFee(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RemainderPolicy
+		values []uint64
+	}{
+		{
+			name:   "first",
+			policy: RemainderPolicyFirst,
+			values: []uint64{5000, 1620, 5000, 200},
+		},
+		{
+			name:   "largest",
+			policy: RemainderPolicyLargest,
+			values: []uint64{5000, 1000, 5620, 200},
+		},
+		{
+			name:   "proportional",
+			policy: RemainderPolicyProportional,
+			values: []uint64{5000, 1100, 5500, 220},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := remainderPolicyTestTx(t, tt.policy, 0.25)
+
+			if _, err := tx.AdjustFee(-620); err != nil {
+				t.Fatalf("Failed to adjust fee : %s", err)
+			}
+
+			values := outputValues(tx)
+			t.Logf("Values : %v", values)
+
+			for i, value := range values {
+				if value != tt.values[i] {
+					t.Errorf("Wrong output %d value : got %d, want %d", i, value, tt.values[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_RemainderPolicy_RemoveBelowDust(t *testing.T) {
+	tx := NewTxBuilder(0.5, 0.25)
+
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         20000,
+		LockingScript: randomLockingScript(),
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	for _, value := range []uint64{1000, 300, 5000} {
+		if err := tx.AddPaymentOutput(randomAddress(), value, true); err != nil {
+			t.Fatalf("Failed to add remainder : %s", err)
+		}
+	}
+	previousFee := tx.Fee()
+
+	// The first remainder is consumed and removed. The second only has 300 so it is removed too and
+	// the 100 it has left goes to the last remainder.
+	done, err := tx.AdjustFee(1200)
+	if err != nil {
+		t.Fatalf("Failed to adjust fee : %s", err)
+	}
+
+	values := outputValues(tx)
+	t.Logf("Values : %v", values)
+
+	if !done {
+		t.Errorf("Adjustment should be done after removing an output")
+	}
+
+	want := []uint64{5000, 5100}
+	if len(values) != len(want) {
+		t.Fatalf("Wrong output count : got %d, want %d", len(values), len(want))
+	}
+
+	for i, value := range values {
+		if value != want[i] {
+			t.Errorf("Wrong output %d value : got %d, want %d", i, value, want[i])
+		}
+	}
+
+	if tx.Fee() != previousFee+1200 {
+		t.Errorf("Wrong fee : got %d, want %d", tx.Fee(), previousFee+1200)
+	}
+
+	if tx.DroppedChange != 0 {
+		t.Errorf("Wrong dropped change : got %d, want %d", tx.DroppedChange, 0)
+	}
+}
+
+func Test_RemainderPolicy_InsufficientValue(t *testing.T) {
+	tx := remainderPolicyTestTx(t, RemainderPolicyProportional, 0.25)
+	before := outputValues(tx)
+
+	// The last remainder output can only be reduced to its dust limit.
+	if _, err := tx.AdjustFee(6300); err == nil {
+		t.Fatalf("Adjust fee should fail with more than remainder value above dust")
+	}
+
+	after := outputValues(tx)
+	for i := range before {
+		if before[i] != after[i] {
+			t.Fatalf("Output %d modified : got %d, want %d", i, after[i], before[i])
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package txbuilder
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/wire"
+	"github.com/tokenized/txbuilder/fees"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/pkg/errors"
+)
+
+// KSigner is implemented by signers that can sign with a specified k value. It is required to sign
+// R-puzzle (P2RPH) inputs since the r of the signature must match the puzzle.
+type KSigner interface {
+	// SignWithK returns the DER encoded signature of the sig hash using the private key for the
+	// public key and the k value.
+	SignWithK(ctx context.Context, publicKey bitcoin.PublicKey, keyID string, k []byte,
+		sigHash bitcoin.Hash32) ([]byte, error)
+}
+
+// SetRPuzzleK sets the k value used to sign an R-puzzle input. The r value derived from k must
+// match the r hash in the input's locking script. k is not serialized with the tx since anyone
+// with k can spend the input.
+func (tx *TxBuilder) SetRPuzzleK(index int, k []byte) error {
+	if index >= len(tx.Inputs) {
+		return errors.New("Input index out of range")
+	}
+
+	if err := checkRPuzzleK(tx.Inputs[index].LockingScript, k); err != nil {
+		return err
+	}
+
+	tx.Inputs[index].RPuzzleK = k
+	return nil
+}
+
+// RPuzzleR returns the r value derived from k, DER encoded as it is in a signature. It is the
+// value hashed by an R-puzzle locking script.
+func RPuzzleR(k []byte) ([]byte, error) {
+	r, err := rFromK(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return derInteger(r), nil
+}
+
+// RPuzzleLockingScript returns an R-puzzle (P2RPH) locking script that can be unlocked by a
+// signature using k, from any key.
+func RPuzzleLockingScript(k []byte) (bitcoin.Script, error) {
+	r, err := RPuzzleR(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return bitcoin.ConcatScript(fees.RPuzzleScriptPrefix, bitcoin.PushData(bitcoin.Hash160(r)),
+		fees.RPuzzleScriptSuffix), nil
+}
+
+// SignWithK returns the DER encoded low S signature of the sig hash using the key and k instead of
+// a deterministic k.
+func SignWithK(key bitcoin.Key, k []byte, sigHash bitcoin.Hash32) ([]byte, error) {
+	r, err := rFromK(k)
+	if err != nil {
+		return nil, err
+	}
+
+	kInverse := new(big.Int).ModInverse(new(big.Int).SetBytes(k), curveOrder)
+	d := new(big.Int).SetBytes(key.Number())
+	z := new(big.Int).SetBytes(sigHash.Bytes())
+
+	// s = k^-1 * (z + r * d) mod n
+	s := new(big.Int).Mul(r, d)
+	s.Add(s, z)
+	s.Mul(s, kInverse)
+	s.Mod(s, curveOrder)
+	if s.Sign() == 0 {
+		return nil, errors.New("Invalid k for sig hash")
+	}
+
+	if s.Cmp(halfCurveOrder) > 0 {
+		s.Sub(curveOrder, s) // low S
+	}
+
+	result := encodeDER(r, s)
+
+	sig, err := bitcoin.SignatureFromBytes(result)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse signature")
+	}
+
+	if !sig.Verify(sigHash, key.PublicKey()) {
+		return nil, ErrInvalidSignature
+	}
+
+	return result, nil
+}
+
+// P2RPHUnlockingScript returns an unlocking script for an R-puzzle (P2RPH) locking script signed
+// by the key using k.
+// Note: This replaces P2RPHUnlockingScript(k []byte), which was never implemented and always
+// returned an error.
+func P2RPHUnlockingScript(key bitcoin.Key, k []byte, tx *wire.MsgTx, index int,
+	lockScript []byte, value uint64, hashType SigHashType, hashCache *SigHashCache) ([]byte, error) {
+	// <Signature(containing r)> <PublicKey>
+	hash, err := SignatureHash(tx, index, lockScript, value, hashType, hashCache)
+	if err != nil {
+		return nil, errors.Wrap(err, "sig hash")
+	}
+
+	sig, err := SignWithK(key, k, *hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign")
+	}
+
+	unlockingSig, err := finalizeSignature(sig, hashType)
+	if err != nil {
+		return nil, err
+	}
+
+	return bitcoin.ConcatScript(bitcoin.PushData(unlockingSig),
+		bitcoin.PushData(key.PublicKey().Bytes())), nil
+}
+
+// SignWithK returns the DER encoded signature of the sig hash using the private key for the public
+// key and k.
+func (s *KeySigner) SignWithK(ctx context.Context, publicKey bitcoin.PublicKey, keyID string,
+	k []byte, sigHash bitcoin.Hash32) ([]byte, error) {
+
+	key, ok := s.byPublicKey[string(publicKey.Bytes())]
+	if !ok {
+		return nil, ErrMissingPrivateKey
+	}
+
+	return SignWithK(key, k, sigHash)
+}
+
+// SignWithK returns the DER encoded signature of the sig hash using the key for the key ID, or the
+// fallback key for the public key when keyID is empty, and k.
+func (s *ResolverSigner) SignWithK(ctx context.Context, publicKey bitcoin.PublicKey,
+	keyID string, k []byte, sigHash bitcoin.Hash32) ([]byte, error) {
+
+	if len(keyID) == 0 {
+		return s.keys.SignWithK(ctx, publicKey, keyID, k, sigHash)
+	}
+
+	key, err := s.resolve(ctx, keyID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve %s", keyID)
+	}
+
+	return SignWithK(key, k, sigHash)
+}
+
+// signRPuzzle signs an R-puzzle input with the input's k and any key available for the input. It
+// returns the public key of the key used.
+func (tx *TxBuilder) signRPuzzle(ctx context.Context, index int, publicKeys *publicKeyIndex,
+	signer Signer, hashType SigHashType, shc *SigHashCache) ([]bitcoin.PublicKey, error) {
+
+	input := tx.Inputs[index]
+	if len(input.RPuzzleK) == 0 {
+		return nil, errors.Wrap(ErrMissingPrivateKey, "r-puzzle k")
+	}
+
+	if err := checkRPuzzleK(input.LockingScript, input.RPuzzleK); err != nil {
+		return nil, err
+	}
+
+	kSigner, ok := signer.(KSigner)
+	if !ok {
+		return nil, errors.Wrap(ErrMissingPrivateKey, "signer can't sign with k")
+	}
+
+	publicKey, ok := publicKeys.first()
+	if !ok {
+		return nil, ErrMissingPrivateKey
+	}
+
+	hash, err := SignatureHash(tx.MsgTx, index, input.LockingScript, input.Value, hashType, shc)
+	if err != nil {
+		return nil, errors.Wrap(err, "sig hash")
+	}
+
+	sig, err := kSigner.SignWithK(ctx, publicKey, input.KeyID, input.RPuzzleK, *hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign")
+	}
+
+	unlockingSig, err := finalizeSignature(sig, hashType)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.MsgTx.TxIn[index].UnlockingScript = bitcoin.ConcatScript(bitcoin.PushData(unlockingSig),
+		bitcoin.PushData(publicKey.Bytes()))
+
+	return []bitcoin.PublicKey{publicKey}, nil
+}
+
+// checkRPuzzleK returns an error if the locking script is not an R-puzzle or the r derived from k
+// doesn't match its r hash.
+func checkRPuzzleK(lockingScript bitcoin.Script, k []byte) error {
+	rHash, err := fees.ParseRPuzzle(lockingScript)
+	if err != nil {
+		return errors.Wrap(ErrWrongScriptTemplate, "Not an R-puzzle locking script")
+	}
+
+	r, err := RPuzzleR(k)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(rHash, bitcoin.Hash160(r)) {
+		return errors.Wrap(ErrWrongPrivateKey, "k doesn't match r hash")
+	}
+
+	return nil
+}
+
+// rFromK returns r, the x coordinate of k*G mod n.
+func rFromK(k []byte) (*big.Int, error) {
+	kValue := new(big.Int).SetBytes(k)
+	if kValue.Sign() == 0 || kValue.Cmp(curveOrder) >= 0 {
+		return nil, errors.New("k out of range")
+	}
+
+	x, _ := btcec.S256().ScalarBaseMult(kValue.Bytes())
+	r := new(big.Int).Mod(x, curveOrder)
+	if r.Sign() == 0 {
+		return nil, errors.New("Invalid k")
+	}
+
+	return r, nil
+}
@@ -0,0 +1,99 @@
+package txbuilder
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/tokenized/bitcoin_interpreter"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+func Test_Sign_RPuzzle(t *testing.T) {
+	kKey, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate k : %s", err)
+	}
+	k := kKey.Number()
+
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+
+	lockingScript, err := RPuzzleLockingScript(k)
+	if err != nil {
+		t.Fatalf("Failed to create locking script : %s", err)
+	}
+
+	unlockingSize, err := UnlockingScriptSize(lockingScript)
+	if err != nil {
+		t.Fatalf("Failed to get unlocking size : %s", err)
+	}
+
+	if unlockingSize != MaximumP2RPHSigScriptSize {
+		t.Fatalf("Wrong unlocking size : got %d, want %d", unlockingSize,
+			MaximumP2RPHSigScriptSize)
+	}
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	tx.SetChangeLockingScript(randomLockingScript(), "")
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if _, err := tx.SignOnly([]bitcoin.Key{key}); errors.Cause(err) != ErrMissingPrivateKey {
+		t.Fatalf("Wrong sign error without k : got %v, want %s", err, ErrMissingPrivateKey)
+	}
+
+	otherK, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	err = tx.SetRPuzzleK(0, otherK.Number())
+	if errors.Cause(err) != ErrWrongPrivateKey {
+		t.Fatalf("Wrong set k error : got %v, want %s", err, ErrWrongPrivateKey)
+	}
+
+	if err := tx.SetRPuzzleK(0, k); err != nil {
+		t.Fatalf("Failed to set k : %s", err)
+	}
+
+	estimatedSize, err := tx.EstimateSize()
+	if err != nil {
+		t.Fatalf("Failed to estimate size : %s", err)
+	}
+
+	// Any key can unlock an R-puzzle.
+	if _, err := tx.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if size := tx.MsgTx.SerializeSize(); size > estimatedSize {
+		t.Fatalf("Size above estimate : got %d, estimated %d", size, estimatedSize)
+	}
+
+	if err := bitcoin_interpreter.VerifyTx(context.Background(), tx); err != nil {
+		t.Fatalf("Failed to verify tx : %s", err)
+	}
+
+	// The unlocking script function produces the same signature since k is fixed.
+	unlockingScript, err := P2RPHUnlockingScript(key, k, tx.MsgTx, 0, lockingScript, 10000,
+		SigHashAll|SigHashForkID, &SigHashCache{})
+	if err != nil {
+		t.Fatalf("Failed to create unlocking script : %s", err)
+	}
+
+	if !bytes.Equal(unlockingScript, tx.MsgTx.TxIn[0].UnlockingScript) {
+		t.Fatalf("Wrong unlocking script : \ngot  %x\nwant %x", unlockingScript,
+			[]byte(tx.MsgTx.TxIn[0].UnlockingScript))
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/tokenized/pkg/bitcoin"
 	"github.com/tokenized/pkg/wire"
@@ -32,15 +33,21 @@ const (
 // for signing tx inputs.
 // This allows validation to re-use previous hashing computation, reducing the complexity of
 // validating SigHashAll inputs rom  O(N^2) to O(N).
+// It is safe for concurrent use, so inputs can be signed in parallel with the same cache.
 type SigHashCache struct {
 	hashPrevOuts []byte
 	hashSequence []byte
 	hashOutputs  []byte
+
+	lock sync.Mutex
 }
 
 // Clear resets all the hashes. This should be used if anything in the transaction changes and the
 // signatures need to be recalculated.
 func (shc *SigHashCache) Clear() {
+	shc.lock.Lock()
+	defer shc.lock.Unlock()
+
 	shc.hashPrevOuts = nil
 	shc.hashSequence = nil
 	shc.hashOutputs = nil
@@ -49,12 +56,18 @@ func (shc *SigHashCache) Clear() {
 // ClearOutputs resets the outputs hash. This should be used if anything in the transaction outputs
 // changes and the signatures need to be recalculated.
 func (shc *SigHashCache) ClearOutputs() {
+	shc.lock.Lock()
+	defer shc.lock.Unlock()
+
 	shc.hashOutputs = nil
 }
 
 // HashPrevOuts calculates a single hash of all the previous outputs (txid:index) referenced within
 // the specified transaction.
 func (shc *SigHashCache) HashPrevOuts(tx *wire.MsgTx) []byte {
+	shc.lock.Lock()
+	defer shc.lock.Unlock()
+
 	if shc.hashPrevOuts != nil {
 		return shc.hashPrevOuts
 	}
@@ -71,6 +84,9 @@ func (shc *SigHashCache) HashPrevOuts(tx *wire.MsgTx) []byte {
 // HashSequence computes an aggregated hash of each of the sequence numbers within the inputs of the
 // passed transaction.
 func (shc *SigHashCache) HashSequence(tx *wire.MsgTx) []byte {
+	shc.lock.Lock()
+	defer shc.lock.Unlock()
+
 	if shc.hashSequence != nil {
 		return shc.hashSequence
 	}
@@ -87,6 +103,9 @@ func (shc *SigHashCache) HashSequence(tx *wire.MsgTx) []byte {
 // HashOutputs computes a hash digest of all outputs created by the transaction encoded using the
 // wire format.
 func (shc *SigHashCache) HashOutputs(tx *wire.MsgTx) []byte {
+	shc.lock.Lock()
+	defer shc.lock.Unlock()
+
 	if shc.hashOutputs != nil {
 		return shc.hashOutputs
 	}
@@ -0,0 +1,222 @@
+package txbuilder
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+// verifyP2PKHInput checks the P2PKH unlocking script signature of the input against the current tx
+// and returns the hash type it was signed with.
+func verifyP2PKHInput(t *testing.T, tx *TxBuilder, index int) SigHashType {
+	items, err := bitcoin.ParseScriptItems(bytes.NewReader(tx.MsgTx.TxIn[index].UnlockingScript),
+		-1)
+	if err != nil {
+		t.Fatalf("Failed to parse unlocking script : %s", err)
+	}
+
+	if len(items) != 2 {
+		t.Fatalf("Wrong unlocking script item count : got %d, want %d", len(items), 2)
+	}
+
+	sigBytes := items[0].Data
+	hashType := SigHashType(sigBytes[len(sigBytes)-1])
+
+	sig, err := bitcoin.SignatureFromBytes(sigBytes[:len(sigBytes)-1])
+	if err != nil {
+		t.Fatalf("Failed to parse signature : %s", err)
+	}
+
+	publicKey, err := bitcoin.PublicKeyFromBytes(items[1].Data)
+	if err != nil {
+		t.Fatalf("Failed to parse public key : %s", err)
+	}
+
+	hash, err := SignatureHash(tx.MsgTx, index, tx.Inputs[index].LockingScript,
+		tx.Inputs[index].Value, hashType, &SigHashCache{})
+	if err != nil {
+		t.Fatalf("Failed to create sig hash : %s", err)
+	}
+
+	if !sig.Verify(*hash, publicKey) {
+		t.Fatalf("Input %d signature is not valid", index)
+	}
+
+	return hashType
+}
+
+func Test_Sign_SigHashSingle(t *testing.T) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	lockingScript, _ := key.LockingScript()
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	tx.SetChangeLockingScript(randomLockingScript(), "")
+
+	// Swap leg input and the output it pays for.
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+	tx.Inputs[0].SigHashType = SigHashSingle | SigHashAnyOneCanPay
+
+	if err := tx.AddOutput(randomLockingScript(), 10000, true, false); err != nil {
+		t.Fatalf("Failed to add output : %s", err)
+	}
+
+	// Funding input and change.
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         1,
+		Value:         5000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := tx.AddOutput(randomLockingScript(), 4500, true, false); err != nil {
+		t.Fatalf("Failed to add output : %s", err)
+	}
+
+	if _, err := tx.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	t.Logf("Tx : %s", tx.String(bitcoin.MainNet))
+
+	if tx.MsgTx.TxOut[0].Value != 10000 {
+		t.Fatalf("Committed output modified : got %d, want %d", tx.MsgTx.TxOut[0].Value, 10000)
+	}
+
+	if tx.Fee() < tx.EstimatedFee() {
+		t.Fatalf("Fee too low : got %d, want at least %d", tx.Fee(), tx.EstimatedFee())
+	}
+
+	if hashType := verifyP2PKHInput(t, tx, 0); hashType != SigHashSingle|SigHashAnyOneCanPay|
+		SigHashForkID {
+		t.Fatalf("Wrong hash type : got 0x%02x, want 0x%02x", hashType,
+			SigHashSingle|SigHashAnyOneCanPay|SigHashForkID)
+	}
+
+	if hashType := verifyP2PKHInput(t, tx, 1); hashType != SigHashAll|SigHashForkID {
+		t.Fatalf("Wrong hash type : got 0x%02x, want 0x%02x", hashType, SigHashAll|SigHashForkID)
+	}
+
+	// The swap leg signature stays valid when the other outputs change.
+	tx.MsgTx.TxOut[1].Value--
+	verifyP2PKHInput(t, tx, 0)
+}
+
+func Test_Sign_SigHashAnyOneCanPay(t *testing.T) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	lockingScript, _ := key.LockingScript()
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	tx.SetChangeLockingScript(randomLockingScript(), "")
+
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+	tx.Inputs[0].SigHashType = SigHashAll | SigHashAnyOneCanPay
+
+	if err := tx.AddOutput(randomLockingScript(), 6000, true, false); err != nil {
+		t.Fatalf("Failed to add output : %s", err)
+	}
+
+	if _, err := tx.Sign([]bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	// The outputs are committed so the excess isn't moved to the remainder or a new change output.
+	if len(tx.MsgTx.TxOut) != 1 {
+		t.Fatalf("Wrong output count : got %d, want %d", len(tx.MsgTx.TxOut), 1)
+	}
+
+	if tx.MsgTx.TxOut[0].Value != 6000 {
+		t.Fatalf("Committed output modified : got %d, want %d", tx.MsgTx.TxOut[0].Value, 6000)
+	}
+
+	verifyP2PKHInput(t, tx, 0)
+
+	// Funding added by another party doesn't invalidate the signature.
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         1,
+		Value:         1000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	verifyP2PKHInput(t, tx, 0)
+
+	// Fee increases can't be taken from committed outputs.
+	committedTx := NewTxBuilderWithFeeRates(500, 250)
+	if err := committedTx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+	committedTx.Inputs[0].SigHashType = SigHashAll | SigHashAnyOneCanPay
+
+	if err := committedTx.AddOutput(randomLockingScript(), 10000, true, false); err != nil {
+		t.Fatalf("Failed to add output : %s", err)
+	}
+
+	if _, err := committedTx.Sign([]bitcoin.Key{key}); errors.Cause(err) != ErrInsufficientValue {
+		t.Fatalf("Wrong error : got %v, want %s", err, ErrInsufficientValue)
+	}
+}
+
+func Test_InputSupplement_SigHashType_JSON(t *testing.T) {
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: randomLockingScript(),
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+	tx.Inputs[0].SigHashType = SigHashNone | SigHashAnyOneCanPay
+
+	b, err := json.Marshal(tx)
+	if err != nil {
+		t.Fatalf("Failed to marshal tx : %s", err)
+	}
+
+	read := &TxBuilder{}
+	if err := json.Unmarshal(b, read); err != nil {
+		t.Fatalf("Failed to unmarshal tx : %s", err)
+	}
+
+	if read.Inputs[0].SigHashType != SigHashNone|SigHashAnyOneCanPay {
+		t.Fatalf("Wrong sig hash type : got 0x%02x, want 0x%02x", read.Inputs[0].SigHashType,
+			SigHashNone|SigHashAnyOneCanPay)
+	}
+
+	if c := tx.Copy(); c.Inputs[0].SigHashType != tx.Inputs[0].SigHashType {
+		t.Fatalf("Sig hash type not copied")
+	}
+}
@@ -2,10 +2,14 @@ package txbuilder
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"runtime"
+	"sync"
 
 	"github.com/tokenized/pkg/bitcoin"
 	"github.com/tokenized/pkg/wire"
+	"github.com/tokenized/txbuilder/fees"
 
 	"github.com/pkg/errors"
 )
@@ -55,28 +59,51 @@ func (tx *TxBuilder) SignP2PKHInput(index int, key bitcoin.Key, hashCache *SigHa
 	}
 
 	tx.MsgTx.TxIn[index].UnlockingScript, err = P2PKHUnlockingScript(key, tx.MsgTx, index,
-		tx.Inputs[index].LockingScript, tx.Inputs[index].Value, SigHashAll+SigHashForkID, hashCache)
+		tx.Inputs[index].LockingScript, tx.Inputs[index].Value,
+		tx.Inputs[index].signatureHashType(), hashCache)
 
 	return err
 }
 
 // Sign estimates and updates the fee, signs all inputs, and corrects the fee if necessary.
 // keys is a slice of all keys required to sign all inputs. They do not have to be in any order.
-//
-// TODO Upgrade to sign more than just P2PKH inputs.
 func (tx *TxBuilder) Sign(keys []bitcoin.Key) ([]bitcoin.Key, error) {
+	signer := NewKeySigner(keys)
+	publicKeys, err := tx.SignWithSigner(context.Background(), signer)
+	return signer.Keys(publicKeys), err
+}
+
+// SignWithResolver is the same as Sign, but the keys for inputs with a KeyID are provided by the
+// resolver. keys are used for inputs without a KeyID. It returns the public keys of the keys used.
+func (tx *TxBuilder) SignWithResolver(ctx context.Context, resolver KeyResolver,
+	keys []bitcoin.Key) ([]bitcoin.PublicKey, error) {
+	return tx.SignWithSigner(ctx, NewResolverSigner(resolver, keys))
+}
+
+// SignWithSigner is the same as Sign, but the signatures are created by the signer so the private
+// keys don't need to be provided. It returns the public keys of the keys used.
+func (tx *TxBuilder) SignWithSigner(ctx context.Context,
+	signer Signer) ([]bitcoin.PublicKey, error) {
+
+	if err := tx.CheckFeeExpiry(); err != nil {
+		return nil, err
+	}
+
 	// Update fee to estimated amount
-	estimatedFee := EstimatedFeeValue(uint64(tx.EstimatedSize()), float64(tx.FeeRate))
+	estimatedFee, err := tx.EstimateFee()
+	if err != nil {
+		return nil, errors.Wrap(err, "estimate fee")
+	}
 	inputValue := tx.InputValue()
 	outputValue := tx.OutputValue(true)
 	shc := SigHashCache{}
+	signingKeys := newSigningKeys(signer)
 
 	if inputValue < outputValue+estimatedFee {
 		return nil, errors.Wrap(ErrInsufficientValue, fmt.Sprintf("%d/%d", inputValue,
 			outputValue+estimatedFee))
 	}
 
-	var err error
 	done := false
 
 	currentFee := int64(inputValue) - int64(outputValue)
@@ -89,28 +116,28 @@ func (tx *TxBuilder) Sign(keys []bitcoin.Key) ([]bitcoin.Key, error) {
 		return nil, err
 	}
 
-	attempt := 3 // Max of 3 fee adjustment attempts
-	for {
+	// The fee was set for the maximum size of the signatures, so the signed tx can only be smaller
+	// and the inputs are normally signed once. A second signing pass is only needed when the
+	// estimate was too low, for example for unknown templates with FallbackToP2PKH, was much too
+	// high, or the fee is outside of the fee limits. Then the fee is set for the signed size plus
+	// the size the signatures could grow by when they are replaced, so a third pass is never needed.
+	indexes := make([]int, len(tx.Inputs))
+	for index := range tx.Inputs {
+		indexes[index] = index
+	}
+
+	for pass := 0; ; pass++ {
 		shc.ClearOutputs()
-		var result []bitcoin.Key
 
 		// Sign all inputs
-		missingKey := false
-		for index, _ := range tx.Inputs {
-			signKeys, err := tx.signInput(index, keys, shc)
-			if err != nil {
-				if errors.Cause(err) == ErrMissingPrivateKey {
-					missingKey = true
-					continue
-				}
-				return nil, errors.Wrap(err, fmt.Sprintf("sign input %d", index))
-			}
-
-			result = appendKeys(result, signKeys...)
+		result, missingKey, err := tx.signInputs(ctx, indexes, signingKeys, &shc)
+		if err != nil {
+			return nil, err
 		}
 
-		// Check fee and adjust if too low
-		targetFee := int64(EstimatedFeeValue(uint64(tx.MsgTx.SerializeSize()), float64(tx.FeeRate)))
+		// Check fee and adjust if necessary
+		size := tx.MsgTx.SerializeSize()
+		targetFee := int64(tx.FeeForSize(uint64(size)))
 		inputValue = tx.InputValue()
 		outputValue = tx.OutputValue(false)
 		changeValue := tx.changeSum()
@@ -121,132 +148,249 @@ func (tx *TxBuilder) Sign(keys []bitcoin.Key) ([]bitcoin.Key, error) {
 				outputValue+uint64(targetFee)))
 		}
 
-		if currentFee == targetFee { // exact target fee rate achieved
+		if tx.feeIsAcceptable(currentFee, targetFee) {
 			if missingKey {
-				return result, ErrMissingPrivateKey
+				return result.list, ErrMissingPrivateKey
 			}
-			return result, nil
+			return result.list, nil
 		}
 
-		if done { // no more adjustments can be made
+		if done || pass > 0 { // no more adjustments can be made
 			if currentFee < targetFee {
 				return nil, errors.Wrap(ErrInsufficientValue, fmt.Sprintf("%d/%d", inputValue,
 					outputValue+uint64(targetFee)))
 			}
-			if missingKey {
-				return result, ErrMissingPrivateKey
-			}
-			return result, nil
-		}
-
-		if currentFee >= targetFee { // above target fee rate
-			if attempt <= 0 { // too many adjustements already
-				if missingKey {
-					return result, ErrMissingPrivateKey
-				}
-				return result, nil
+			if err := tx.CheckFeeLimits(uint64(currentFee)); err != nil {
+				return nil, err
 			}
-
-			feeDiff := currentFee - targetFee
-			if float32(feeDiff)/float32(targetFee) < 0.05 || feeDiff <= 3 {
-				// Current fee is within 5% of target fee or within 3 satoshis
-				if missingKey {
-					return result, ErrMissingPrivateKey
-				}
-				return result, nil
+			if missingKey {
+				return result.list, ErrMissingPrivateKey
 			}
+			return result.list, nil
 		}
 
-		done, err = tx.AdjustFee(targetFee - currentFee)
+		paddedFee := int64(tx.FeeForSize(uint64(size + tx.signatureSizeVariance())))
+		done, err = tx.AdjustFee(paddedFee - currentFee)
 		if err != nil {
 			if errors.Cause(err) == ErrInsufficientValue {
 				return nil, errors.Wrap(ErrInsufficientValue, fmt.Sprintf("%d/%d", inputValue,
-					outputValue+uint64(targetFee)))
+					outputValue+uint64(paddedFee)))
 			}
 			return nil, err
 		}
+	}
+}
+
+// feeIsAcceptable returns true if the fee of the signed tx doesn't need to be adjusted. It must be
+// at least the target fee, within the fee limits, and within 5% or 3 satoshis of the target fee.
+// An exact target fee must be matched.
+func (tx *TxBuilder) feeIsAcceptable(currentFee, targetFee int64) bool {
+	if currentFee == targetFee {
+		return true // exact target fee rate achieved
+	}
+
+	if currentFee < targetFee || tx.TargetFee != 0 {
+		return false
+	}
+
+	if tx.CheckFeeLimits(uint64(currentFee)) != nil {
+		return false
+	}
+
+	feeDiff := currentFee - targetFee
+	return float32(feeDiff)/float32(targetFee) < 0.05 || feeDiff <= 3
+}
+
+// signatureSizeVariance returns the number of bytes the signed inputs could grow by if they are
+// signed again. Signatures vary in length, so each could be replaced by a signature of the maximum
+// size.
+func (tx *TxBuilder) signatureSizeVariance() int {
+	result := 0
+	for _, txin := range tx.MsgTx.TxIn {
+		items, err := bitcoin.ParseScriptItems(bytes.NewReader(txin.UnlockingScript), -1)
+		if err != nil {
+			continue
+		}
+
+		for _, item := range items {
+			if item.Type != bitcoin.ScriptItemTypePushData || len(item.Data) >= MaxSignatureSize {
+				continue
+			}
 
-		attempt--
+			if CheckUnlockingSignature(item.Data) == nil {
+				result += MaxSignatureSize - len(item.Data)
+			}
+		}
 	}
+
+	return result
 }
 
 // SignOnly signs any unsigned inputs in the tx.
 // It does not adjust the fee or make any other modifications to the tx like Sign.
 func (tx *TxBuilder) SignOnly(keys []bitcoin.Key) ([]bitcoin.Key, error) {
-	shc := SigHashCache{}
-	var result []bitcoin.Key
-	missingKey := false
-	for index, _ := range tx.Inputs {
+	signer := NewKeySigner(keys)
+	publicKeys, err := tx.SignOnlyWithSigner(context.Background(), signer)
+	return signer.Keys(publicKeys), err
+}
+
+// SignOnlyWithSigner is the same as SignOnly, but the signatures are created by the signer so the
+// private keys don't need to be provided. It returns the public keys of the keys used.
+func (tx *TxBuilder) SignOnlyWithSigner(ctx context.Context,
+	signer Signer) ([]bitcoin.PublicKey, error) {
+
+	var indexes []int
+	for index := range tx.Inputs {
 		if len(tx.MsgTx.TxIn[index].UnlockingScript) > 0 {
 			continue // already signed
 		}
+		indexes = append(indexes, index)
+	}
 
-		signKeys, err := tx.signInput(index, keys, shc)
-		if err != nil {
-			if errors.Cause(err) == ErrMissingPrivateKey {
+	result, missingKey, err := tx.signInputs(ctx, indexes, newSigningKeys(signer),
+		&SigHashCache{})
+	if err != nil {
+		return nil, err
+	}
+
+	if missingKey {
+		return result.list, ErrMissingPrivateKey
+	}
+	return result.list, nil
+}
+
+// signInputs signs the inputs at the indexes with a pool of SignWorkers goroutines. The public
+// keys used are returned in input order so the result doesn't depend on the order the inputs are
+// signed. missingKey is true if any input couldn't be signed because a key wasn't available. The
+// error for the first input, by index, that failed for another reason is returned.
+func (tx *TxBuilder) signInputs(ctx context.Context, indexes []int, signingKeys *signingKeys,
+	shc *SigHashCache) (usedPublicKeys, bool, error) {
+
+	type signResult struct {
+		publicKeys []bitcoin.PublicKey
+		err        error
+	}
+	results := make([]signResult, len(indexes))
+
+	workers := tx.signWorkers(len(indexes))
+	if workers <= 1 {
+		for i, index := range indexes {
+			results[i].publicKeys, results[i].err = tx.signInput(ctx, index, signingKeys, shc)
+		}
+	} else {
+		jobs := make(chan int)
+		var wait sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				for i := range jobs {
+					results[i].publicKeys, results[i].err = tx.signInput(ctx, indexes[i],
+						signingKeys, shc)
+				}
+			}()
+		}
+
+		for i := range indexes {
+			jobs <- i
+		}
+		close(jobs)
+		wait.Wait()
+	}
+
+	var used usedPublicKeys
+	missingKey := false
+	for i, result := range results {
+		if result.err != nil {
+			if errors.Cause(result.err) == ErrMissingPrivateKey {
 				missingKey = true
 				continue
 			}
-			return nil, errors.Wrap(err, fmt.Sprintf("sign input %d", index))
+			return usedPublicKeys{}, false, errors.Wrap(result.err,
+				fmt.Sprintf("sign input %d", indexes[i]))
 		}
 
-		result = appendKeys(result, signKeys...)
+		used.add(result.publicKeys...)
 	}
 
-	if missingKey {
-		return result, ErrMissingPrivateKey
+	return used, missingKey, nil
+}
+
+// signWorkers returns the number of goroutines used to sign the specified number of inputs.
+func (tx *TxBuilder) signWorkers(count int) int {
+	workers := tx.SignWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	if workers > count {
+		return count
 	}
-	return result, nil
+
+	return workers
 }
 
-func appendKeys(list []bitcoin.Key, keys ...bitcoin.Key) []bitcoin.Key {
-	result := list
-	for _, key := range keys {
-		found := false
-		for _, k := range list {
-			if k.Equal(key) {
-				found = true
-				break
-			}
+// signInput signs an input of the tx and returns the public keys of the keys used.
+func (tx *TxBuilder) signInput(ctx context.Context, index int, signingKeys *signingKeys,
+	shc *SigHashCache) ([]bitcoin.PublicKey, error) {
+
+	input := tx.Inputs[index]
+	lockingScript := input.LockingScript
+	value := input.Value
+	hashType := input.signatureHashType()
+
+	publicKeys, err := signingKeys.index(ctx, input.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	sign := func(publicKey bitcoin.PublicKey) ([]byte, error) {
+		hash, err := SignatureHash(tx.MsgTx, index, input.scriptCode(), value, hashType, shc)
+		if err != nil {
+			return nil, errors.Wrap(err, "sig hash")
 		}
 
-		if !found {
-			result = append(result, key)
+		sig, err := signingKeys.signer.Sign(ctx, publicKey, input.KeyID, *hash)
+		if err != nil {
+			return nil, errors.Wrap(err, "sign")
 		}
-	}
 
-	return result
-}
+		return finalizeSignature(sig, hashType)
+	}
 
-// signInput signs an input of the tx and returns the keys used.
-func (tx *TxBuilder) signInput(index int, keys []bitcoin.Key,
-	shc SigHashCache) ([]bitcoin.Key, error) {
+	if len(input.RedeemScript) > 0 {
+		return tx.signP2SH(index, publicKeys, sign)
+	}
 
-	lockingScript := tx.Inputs[index].LockingScript
-	value := tx.Inputs[index].Value
+	if _, err := fees.ParseRPuzzle(lockingScript); err == nil {
+		return tx.signRPuzzle(ctx, index, publicKeys, signingKeys.signer, hashType, shc)
+	}
 
 	if lockingScript.IsP2PKH() {
-		for _, key := range keys {
-			keyLockingScript, err := key.LockingScript()
-			if err != nil {
-				return nil, errors.Wrap(err, "key locking script")
-			}
+		ra, err := bitcoin.RawAddressFromLockingScript(lockingScript)
+		if err != nil {
+			return nil, errors.Wrap(err, "address")
+		}
 
-			if !keyLockingScript.Equal(lockingScript) {
-				continue
-			}
+		hash, err := ra.Hash()
+		if err != nil {
+			return nil, errors.Wrap(err, "address hash")
+		}
 
-			unlockingScript, err := P2PKHUnlockingScript(key, tx.MsgTx, index, lockingScript,
-				value, SigHashAll+SigHashForkID, &shc)
-			if err != nil {
-				return nil, errors.Wrap(err, "unlock script")
-			}
-			tx.MsgTx.TxIn[index].UnlockingScript = unlockingScript
+		publicKey, ok := publicKeys.forHash(hash.Bytes())
+		if !ok {
+			return nil, ErrMissingPrivateKey
+		}
 
-			return []bitcoin.Key{key}, nil
+		sig, err := sign(publicKey)
+		if err != nil {
+			return nil, err
 		}
 
-		return nil, ErrMissingPrivateKey
+		tx.MsgTx.TxIn[index].UnlockingScript = bitcoin.ConcatScript(bitcoin.PushData(sig),
+			bitcoin.PushData(publicKey.Bytes()))
+
+		return []bitcoin.PublicKey{publicKey}, nil
 	}
 
 	if lockingScript.IsP2PK() {
@@ -264,107 +408,78 @@ func (tx *TxBuilder) signInput(index int, keys []bitcoin.Key,
 			return nil, bitcoin.ErrUnknownScriptTemplate
 		}
 
-		pubKeyBytes := make([][]byte, len(keys))
-		for i, key := range keys {
-			pubKeyBytes[i] = key.PublicKey().Bytes()
+		publicKey, ok := publicKeys.forPublicKey(pubKeyItem.Data)
+		if !ok {
+			return nil, ErrMissingPrivateKey
 		}
 
-		for i, key := range keys {
-			if !bytes.Equal(pubKeyBytes[i], pubKeyItem.Data) {
-				continue
-			}
-
-			unlockingScript, err := P2PKUnlockingScript(key, tx.MsgTx, index, lockingScript,
-				value, SigHashAll+SigHashForkID, &shc)
-			if err != nil {
-				return nil, errors.Wrap(err, "unlock script")
-			}
-			tx.MsgTx.TxIn[index].UnlockingScript = unlockingScript
-
-			return []bitcoin.Key{key}, nil
+		sig, err := sign(publicKey)
+		if err != nil {
+			return nil, err
 		}
 
-		return nil, ErrMissingPrivateKey
+		tx.MsgTx.TxIn[index].UnlockingScript = bitcoin.PushData(sig)
+
+		return []bitcoin.PublicKey{publicKey}, nil
 	}
 
 	if required, total, err := lockingScript.MultiPKHCounts(); err == nil {
-		pubKeyHashes := make([][]byte, len(keys))
-		for i, key := range keys {
-			pubKeyHashes[i] = bitcoin.Hash160(key.PublicKey().Bytes())
+		usedKeys, completed, err := tx.signMultiPKH(index, publicKeys, sign, shc)
+		if err != nil {
+			return nil, err
 		}
 
-		scriptItems, err := bitcoin.ParseScriptItems(bytes.NewReader(lockingScript), -1)
-		if err != nil {
-			return nil, errors.Wrap(err, "parse locking script")
+		if !completed {
+			// The signatures are kept as partial signatures so other parties can complete it.
+			return usedKeys, errors.Wrapf(ErrMissingPrivateKey, "multi-pkh %d of %d: signers %d",
+				required, total, len(tx.Inputs[index].Signatures))
 		}
 
-		var usedKeys []bitcoin.Key
-		count := uint32(0)
-		signedCount := uint32(0)
-		completed := false
-		var subUnlockingScripts []bitcoin.Script
-		for _, scriptItem := range scriptItems {
-			if scriptItem.Type != bitcoin.ScriptItemTypePushData {
-				continue
-			}
+		return usedKeys, nil
+	}
 
-			foundKey := false
-			for i, key := range keys {
-				if !bytes.Equal(pubKeyHashes[i], scriptItem.Data) {
-					continue
-				}
+	return nil, errors.Wrap(ErrWrongScriptTemplate, "Not P2MultiPKH, P2PKH, P2PK, P2RPH, or P2SH with redeem script locking script")
+}
 
-				subUnlockingScript, err := P2PKHUnlockingScript(key, tx.MsgTx, index, lockingScript,
-					value, SigHashAll+SigHashForkID, &shc)
-				if err != nil {
-					return nil, errors.Wrap(err, "unlock script")
-				}
+// signatureHashType returns the hash type used to sign the input.
+func (input InputSupplement) signatureHashType() SigHashType {
+	if input.SigHashType == 0 {
+		return SigHashAll + SigHashForkID
+	}
 
-				subUnlockingScript = append(subUnlockingScript, bitcoin.OP_TRUE)
-				subUnlockingScripts = append(subUnlockingScripts, subUnlockingScript)
+	return input.SigHashType | SigHashForkID
+}
 
-				usedKeys = append(usedKeys, key)
-				foundKey = true
-				break
-			}
+// committedOutputs returns which outputs are committed to by signatures that don't sign all
+// outputs in the normal way, so fee adjustments must not modify them. allCommitted is true when an
+// input commits to all outputs with SigHashAnyOneCanPay, so outputs can't be added or removed.
+// Only the indexes of outputs committed to by SigHashSingle are not allowed to change.
+func (tx *TxBuilder) committedOutputs() (committed []bool, allCommitted bool) {
+	committed = make([]bool, len(tx.MsgTx.TxOut))
+	for index, input := range tx.Inputs {
+		if input.SigHashType == 0 {
+			continue // SigHashAll inputs are re-signed when outputs change
+		}
 
-			count++
-			if foundKey {
-				signedCount++
-				if signedCount == required {
-					// Mark any remaining signers as not provided.
-					for count < total {
-						subUnlockingScripts = append(subUnlockingScripts,
-							bitcoin.Script{bitcoin.OP_FALSE})
-						count++
-					}
-
-					completed = true
-					break
-				}
-			} else {
-				subUnlockingScripts = append(subUnlockingScripts,
-					bitcoin.Script{bitcoin.OP_FALSE})
+		switch input.SigHashType & sigHashTypeMask {
+		case SigHashAll:
+			if input.SigHashType&SigHashAnyOneCanPay == 0 {
+				continue
 			}
-		}
 
-		if completed {
-			// Reverse sub-unlocking scripts into final script.
-			unlockingScript := &bytes.Buffer{}
-			l := len(subUnlockingScripts)
-			for i := l - 1; i >= 0; i-- {
-				unlockingScript.Write(subUnlockingScripts[i])
+			for i := range committed {
+				committed[i] = true
 			}
+			allCommitted = true
 
-			tx.MsgTx.TxIn[index].UnlockingScript = bitcoin.Script(unlockingScript.Bytes())
-			return usedKeys, nil
-		} else {
-			return nil, errors.Wrapf(ErrMissingPrivateKey, "multi-pkg %d of %d: signers %d",
-				required, total, signedCount)
+		case SigHashSingle:
+			if index < len(committed) {
+				committed[index] = true
+			}
 		}
 	}
 
-	return nil, errors.Wrap(ErrWrongScriptTemplate, "Not P2MultiPKH, P2PKH, or P2PK locking script")
+	return committed, allCommitted
 }
 
 func P2PKHUnlockingScript(key bitcoin.Key, tx *wire.MsgTx, index int,
@@ -408,11 +523,6 @@ func P2PKUnlockingScript(key bitcoin.Key, tx *wire.MsgTx, index int,
 	return buf.Bytes(), nil
 }
 
-func P2SHUnlockingScript(script []byte) ([]byte, error) {
-	// <RedeemScript>...
-	return nil, errors.New("SH Unlocking Script Not Implemented") // TODO Implement SH unlocking script
-}
-
 // P2MultiPKHUnlockingScript returns an unlocking script for a P2MultiPKH locking script.
 // Provide all public keys in order. Signatures should be the same length as the public keys and
 // have empty entries when that key didn't sign.
@@ -451,14 +561,9 @@ func P2MultiPKHUnlockingScript(required uint16, pubKeys [][]byte, sigs [][]byte)
 	return buf.Bytes(), nil
 }
 
-func P2RPHUnlockingScript(k []byte) ([]byte, error) {
-	// <PublicKey> <Signature(containing r)>
-	// k is 256 bit number used to calculate sig with r
-	return nil, errors.New("RPH Unlocking Script Not Implemented") // TODO Implement RPH unlocking script
-}
-
 // InputSignature returns the serialized ECDSA signature for the input index of the specified
-// transaction, with hashType appended to it.
+// transaction, with hashType appended to it. The signature is normalized to a low S value and
+// checked to be strict DER.
 func InputSignature(key bitcoin.Key, tx *wire.MsgTx, index int, lockScript []byte,
 	value uint64, hashType SigHashType, hashCache *SigHashCache) ([]byte, error) {
 
@@ -472,5 +577,5 @@ func InputSignature(key bitcoin.Key, tx *wire.MsgTx, index int, lockScript []byt
 		return nil, fmt.Errorf("cannot sign tx input: %s", err)
 	}
 
-	return append(sig.Bytes(), byte(hashType)), nil
+	return finalizeSignature(sig.Bytes(), hashType)
 }
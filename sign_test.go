@@ -0,0 +1,159 @@
+package txbuilder
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+)
+
+// consolidationTx returns a tx spending inputCount P2PKH UTXOs of the keys to a single output.
+func consolidationTx(t testing.TB, keys []bitcoin.Key, inputCount int) *TxBuilder {
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	for i := 0; i < inputCount; i++ {
+		lockingScript, _ := keys[i%len(keys)].LockingScript()
+		if err := tx.AddInputUTXO(bitcoin.UTXO{
+			Hash:          *randomTxId(),
+			Index:         uint32(i),
+			Value:         10000,
+			LockingScript: lockingScript,
+		}); err != nil {
+			t.Fatalf("Failed to add input : %s", err)
+		}
+	}
+
+	if err := tx.AddOutput(randomLockingScript(), tx.InputValue(), true, false); err != nil {
+		t.Fatalf("Failed to add output : %s", err)
+	}
+
+	return tx
+}
+
+func generateKeys(t testing.TB, count int) []bitcoin.Key {
+	var result []bitcoin.Key
+	for i := 0; i < count; i++ {
+		key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+		if err != nil {
+			t.Fatalf("Failed to generate key : %s", err)
+		}
+		result = append(result, key)
+	}
+
+	return result
+}
+
+func Test_Sign_ParallelDeterministic(t *testing.T) {
+	keys := generateKeys(t, 10)
+	sequential := consolidationTx(t, keys, 200)
+	sequential.SignWorkers = 1
+	parallel := sequential.Copy()
+	parallel.SignWorkers = 8
+
+	sequentialKeys, err := sequential.Sign(keys)
+	if err != nil {
+		t.Fatalf("Failed to sign sequentially : %s", err)
+	}
+
+	parallelKeys, err := parallel.Sign(keys)
+	if err != nil {
+		t.Fatalf("Failed to sign in parallel : %s", err)
+	}
+
+	if !sequential.MsgTx.TxHash().Equal(parallel.MsgTx.TxHash()) {
+		t.Fatalf("Parallel signing produced a different tx")
+	}
+
+	if len(sequentialKeys) != len(parallelKeys) {
+		t.Fatalf("Wrong key count : got %d, want %d", len(parallelKeys), len(sequentialKeys))
+	}
+
+	for i := range sequentialKeys {
+		if !sequentialKeys[i].PublicKey().Equal(parallelKeys[i].PublicKey()) {
+			t.Fatalf("Key %d is in a different order", i)
+		}
+	}
+}
+
+// testCountingSigner is a signer that counts the signatures it creates.
+type testCountingSigner struct {
+	*KeySigner
+	count int64
+}
+
+func (s *testCountingSigner) Sign(ctx context.Context, publicKey bitcoin.PublicKey,
+	keyID string, sigHash bitcoin.Hash32) ([]byte, error) {
+
+	atomic.AddInt64(&s.count, 1)
+	return s.KeySigner.Sign(ctx, publicKey, keyID, sigHash)
+}
+
+func Test_Sign_SignsInputsOnce(t *testing.T) {
+	keys := generateKeys(t, 10)
+	tx := consolidationTx(t, keys, 200)
+	signer := &testCountingSigner{KeySigner: NewKeySigner(keys)}
+
+	if _, err := tx.SignWithSigner(context.Background(), signer); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if signer.count != int64(len(tx.Inputs)) {
+		t.Fatalf("Wrong signature count : got %d, want %d", signer.count, len(tx.Inputs))
+	}
+
+	fee := tx.Fee()
+	targetFee := tx.FeeForSize(uint64(tx.MsgTx.SerializeSize()))
+	if fee < targetFee {
+		t.Fatalf("Fee below target : got %d, want %d", fee, targetFee)
+	}
+}
+
+func benchmarkSign(b *testing.B, inputCount, workers int) {
+	keys := generateKeys(b, 10)
+	template := consolidationTx(b, keys, inputCount)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tx := template.Copy()
+		tx.SignWorkers = workers
+		b.StartTimer()
+
+		if _, err := tx.Sign(keys); err != nil {
+			b.Fatalf("Failed to sign : %s", err)
+		}
+	}
+}
+
+// Benchmark_SignCount reports the signatures created per input, which is 1 when the fee doesn't
+// need to be adjusted after signing.
+func Benchmark_SignCount(b *testing.B) {
+	keys := generateKeys(b, 10)
+	template := consolidationTx(b, keys, 100)
+	signer := &testCountingSigner{KeySigner: NewKeySigner(keys)}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tx := template.Copy()
+		b.StartTimer()
+
+		if _, err := tx.SignWithSigner(context.Background(), signer); err != nil {
+			b.Fatalf("Failed to sign : %s", err)
+		}
+	}
+
+	b.ReportMetric(float64(signer.count)/float64(b.N*len(template.Inputs)), "sigs/input")
+}
+
+func Benchmark_Sign(b *testing.B) {
+	for _, inputCount := range []int{100, 1000} {
+		for _, workers := range []int{1, 0} {
+			name := fmt.Sprintf("inputs_%d_workers_%d", inputCount, workers)
+			b.Run(name, func(b *testing.B) {
+				benchmarkSign(b, inputCount, workers)
+			})
+		}
+	}
+}
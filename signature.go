@@ -0,0 +1,188 @@
+package txbuilder
+
+import (
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MinDERSignatureSize and MaxDERSignatureSize are the sizes of strict DER encoded signatures
+	// without the sig hash type byte.
+	MinDERSignatureSize = 8
+	MaxDERSignatureSize = 72
+)
+
+var (
+	curveOrder     = btcec.S256().Params().N
+	halfCurveOrder = new(big.Int).Rsh(curveOrder, 1)
+)
+
+// CheckSignature returns an error if the DER signature, without the sig hash type byte, is not
+// strict DER encoded or has a high S value. These signatures are non-standard and are rejected by
+// miners.
+func CheckSignature(sig []byte) error {
+	_, s, err := parseStrictDER(sig)
+	if err != nil {
+		return err
+	}
+
+	if s.Cmp(halfCurveOrder) > 0 {
+		return ErrHighS
+	}
+
+	return nil
+}
+
+// CheckUnlockingSignature returns an error if the signature, as it is in an unlocking script with
+// the sig hash type byte appended, is not strict DER, has a high S value, or has an invalid sig
+// hash type. Use it to check signatures received from external signers and co-signers.
+func CheckUnlockingSignature(sig []byte) error {
+	_, _, _, err := ParseUnlockingSignature(sig)
+	return err
+}
+
+// ParseUnlockingSignature splits a signature, as it is in an unlocking script with the sig hash
+// type byte appended, into r, s, and the sig hash type. It returns an error if the signature is not
+// strict DER, has a high S value, or has an invalid sig hash type.
+func ParseUnlockingSignature(sig []byte) (*big.Int, *big.Int, SigHashType, error) {
+	l := len(sig)
+	if l == 0 {
+		return nil, nil, 0, errors.Wrap(ErrNonStrictDER, "empty")
+	}
+
+	hashType := SigHashType(sig[l-1])
+	if hashType&SigHashForkID == 0 {
+		return nil, nil, 0, errors.Wrapf(ErrInvalidSignature, "missing fork id: %#x", hashType)
+	}
+
+	baseType := hashType & sigHashTypeMask
+	if baseType < SigHashAll || baseType > SigHashSingle ||
+		hashType&^(sigHashTypeMask|SigHashForkID|SigHashAnyOneCanPay) != 0 {
+		return nil, nil, 0, errors.Wrapf(ErrInvalidSignature, "sig hash type: %#x", hashType)
+	}
+
+	r, s, err := parseStrictDER(sig[:l-1])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if s.Cmp(halfCurveOrder) > 0 {
+		return nil, nil, 0, ErrHighS
+	}
+
+	return r, s, hashType, nil
+}
+
+// NormalizeSignature returns the DER signature, without the sig hash type byte, with a low S
+// value. A signature with a high S value is equally valid with S replaced by N - S. It returns an
+// error if the signature is not strict DER.
+func NormalizeSignature(sig []byte) ([]byte, error) {
+	r, s, err := parseStrictDER(sig)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Cmp(halfCurveOrder) <= 0 {
+		return sig, nil
+	}
+
+	return encodeDER(r, new(big.Int).Sub(curveOrder, s)), nil
+}
+
+// finalizeSignature normalizes the DER signature to a low S value, checks it is strict DER, and
+// appends the sig hash type byte so it can be put in an unlocking script.
+func finalizeSignature(sig []byte, hashType SigHashType) ([]byte, error) {
+	normalized, err := NormalizeSignature(sig)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidSignature, err.Error())
+	}
+
+	result := make([]byte, len(normalized), len(normalized)+1)
+	copy(result, normalized)
+	return append(result, byte(hashType)), nil
+}
+
+// parseStrictDER returns r and s from a strict DER (BIP 66) encoded signature without the sig hash
+// type byte.
+//
+//	0x30 <total length> 0x02 <r length> <r> 0x02 <s length> <s>
+func parseStrictDER(sig []byte) (*big.Int, *big.Int, error) {
+	l := len(sig)
+	if l < MinDERSignatureSize || l > MaxDERSignatureSize {
+		return nil, nil, errors.Wrapf(ErrNonStrictDER, "size %d", l)
+	}
+
+	if sig[0] != 0x30 || int(sig[1]) != l-2 {
+		return nil, nil, errors.Wrap(ErrNonStrictDER, "sequence")
+	}
+
+	rLength := int(sig[3])
+	if 5+rLength >= l {
+		return nil, nil, errors.Wrap(ErrNonStrictDER, "r length")
+	}
+
+	sLength := int(sig[5+rLength])
+	if rLength+sLength+6 != l {
+		return nil, nil, errors.Wrap(ErrNonStrictDER, "s length")
+	}
+
+	r, err := parseStrictDERInteger(sig[2 : 4+rLength])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "r")
+	}
+
+	s, err := parseStrictDERInteger(sig[4+rLength:])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "s")
+	}
+
+	if r.Sign() == 0 || r.Cmp(curveOrder) >= 0 || s.Sign() == 0 || s.Cmp(curveOrder) >= 0 {
+		return nil, nil, errors.Wrap(ErrNonStrictDER, "out of range")
+	}
+
+	return r, s, nil
+}
+
+// parseStrictDERInteger parses a DER integer, including the type and length, that must be
+// positive and minimally encoded.
+func parseStrictDERInteger(b []byte) (*big.Int, error) {
+	if len(b) < 3 || b[0] != 0x02 || int(b[1]) != len(b)-2 {
+		return nil, ErrNonStrictDER
+	}
+
+	value := b[2:]
+	if value[0]&0x80 != 0 {
+		return nil, errors.Wrap(ErrNonStrictDER, "negative")
+	}
+
+	if len(value) > 1 && value[0] == 0x00 && value[1]&0x80 == 0 {
+		return nil, errors.Wrap(ErrNonStrictDER, "padding")
+	}
+
+	return new(big.Int).SetBytes(value), nil
+}
+
+// encodeDER returns the DER encoded signature for r and s.
+func encodeDER(r, s *big.Int) []byte {
+	rBytes := derInteger(r)
+	sBytes := derInteger(s)
+	result := make([]byte, 0, 6+len(rBytes)+len(sBytes))
+	result = append(result, 0x30, byte(4+len(rBytes)+len(sBytes)))
+	result = append(result, 0x02, byte(len(rBytes)))
+	result = append(result, rBytes...)
+	result = append(result, 0x02, byte(len(sBytes)))
+	return append(result, sBytes...)
+}
+
+// derInteger returns the DER integer encoding of the positive value, without the type and length.
+// A zero byte is prepended when the high bit is set so it isn't negative.
+func derInteger(value *big.Int) []byte {
+	b := value.Bytes()
+	if len(b) == 0 || b[0]&0x80 != 0 {
+		return append([]byte{0x00}, b...)
+	}
+
+	return b
+}
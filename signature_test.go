@@ -0,0 +1,239 @@
+package txbuilder
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+// highSSignature returns the signature with S replaced by N - S, which is equally valid, but
+// non-standard.
+func highSSignature(t *testing.T, sig []byte) []byte {
+	r, s, err := parseStrictDER(sig)
+	if err != nil {
+		t.Fatalf("Failed to parse signature : %s", err)
+	}
+
+	return encodeDER(r, new(big.Int).Sub(curveOrder, s))
+}
+
+// testMalleatingSigner is a signer that returns high S signatures or the result of modify.
+type testMalleatingSigner struct {
+	*KeySigner
+	modify func(sig []byte) []byte
+}
+
+func (s *testMalleatingSigner) Sign(ctx context.Context, publicKey bitcoin.PublicKey,
+	keyID string, sigHash bitcoin.Hash32) ([]byte, error) {
+
+	sig, err := s.KeySigner.Sign(ctx, publicKey, keyID, sigHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.modify(sig), nil
+}
+
+func Test_Signature_HighS(t *testing.T) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+
+	sig, err := key.Sign(*randomTxId())
+	if err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+	lowS := sig.Bytes()
+
+	if err := CheckSignature(lowS); err != nil {
+		t.Fatalf("Low S signature should be valid : %s", err)
+	}
+
+	highS := highSSignature(t, lowS)
+	if err := CheckSignature(highS); errors.Cause(err) != ErrHighS {
+		t.Fatalf("Wrong high S error : got %v, want %s", err, ErrHighS)
+	}
+
+	hashType := SigHashAll | SigHashForkID
+	if err := CheckUnlockingSignature(append(highS, byte(hashType))); errors.Cause(err) != ErrHighS {
+		t.Fatalf("Wrong high S unlocking error : got %v, want %s", err, ErrHighS)
+	}
+
+	normalized, err := NormalizeSignature(highS)
+	if err != nil {
+		t.Fatalf("Failed to normalize : %s", err)
+	}
+
+	if !bytes.Equal(normalized, lowS) {
+		t.Fatalf("Wrong normalized signature : \ngot  %x\nwant %x", normalized, lowS)
+	}
+
+	r, s, parsedHashType, err := ParseUnlockingSignature(append(lowS, byte(hashType)))
+	if err != nil {
+		t.Fatalf("Failed to parse unlocking signature : %s", err)
+	}
+
+	if parsedHashType != hashType {
+		t.Fatalf("Wrong hash type : got %#x, want %#x", parsedHashType, hashType)
+	}
+
+	if !bytes.Equal(encodeDER(r, s), lowS) {
+		t.Fatalf("Wrong r and s")
+	}
+}
+
+func Test_Signature_NonStrictDER(t *testing.T) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+
+	sig, err := key.Sign(*randomTxId())
+	if err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+	der := sig.Bytes()
+	rLength := int(der[3])
+
+	// Unnecessary zero padding on r.
+	padded := append([]byte{0x30, der[1] + 1, 0x02, byte(rLength + 1), 0x00}, der[4:]...)
+
+	// Wrong sequence length.
+	wrongLength := append([]byte{}, der...)
+	wrongLength[1]++
+
+	// Trailing data after s.
+	trailing := append(append([]byte{}, der...), 0x00)
+
+	for _, invalid := range [][]byte{padded, wrongLength, trailing, der[:7], nil} {
+		if err := CheckSignature(invalid); errors.Cause(err) != ErrNonStrictDER {
+			t.Fatalf("Wrong error for %x : got %v, want %s", invalid, err, ErrNonStrictDER)
+		}
+	}
+
+	if err := CheckUnlockingSignature(append(append([]byte{}, der...),
+		byte(SigHashAll))); errors.Cause(err) != ErrInvalidSignature {
+		t.Fatalf("Wrong error for missing fork id : got %v, want %s", err, ErrInvalidSignature)
+	}
+}
+
+func Test_Sign_ExternalSignerSignatures(t *testing.T) {
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	lockingScript, _ := key.LockingScript()
+
+	newTx := func() *TxBuilder {
+		tx := NewTxBuilderWithFeeRates(500, 250)
+		tx.SetChangeLockingScript(randomLockingScript(), "")
+		if err := tx.AddInputUTXO(bitcoin.UTXO{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         10000,
+			LockingScript: lockingScript,
+		}); err != nil {
+			t.Fatalf("Failed to add input : %s", err)
+		}
+
+		if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+			t.Fatalf("Failed to add payment : %s", err)
+		}
+
+		return tx
+	}
+
+	// High S signatures from the signer are normalized.
+	tx := newTx()
+	if _, err := tx.SignWithSigner(context.Background(), &testMalleatingSigner{
+		KeySigner: NewKeySigner([]bitcoin.Key{key}),
+		modify:    func(sig []byte) []byte { return highSSignature(t, sig) },
+	}); err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	hashType := verifyP2PKHInput(t, tx, 0)
+	items, _ := bitcoin.ParseScriptItems(bytes.NewReader(tx.MsgTx.TxIn[0].UnlockingScript), -1)
+	if err := CheckUnlockingSignature(items[0].Data); err != nil {
+		t.Fatalf("Signature should be low S : %s", err)
+	}
+
+	if hashType != SigHashAll|SigHashForkID {
+		t.Fatalf("Wrong hash type : got %#x, want %#x", hashType, SigHashAll|SigHashForkID)
+	}
+
+	// Non DER signatures from the signer are rejected.
+	tx = newTx()
+	_, err = tx.SignWithSigner(context.Background(), &testMalleatingSigner{
+		KeySigner: NewKeySigner([]bitcoin.Key{key}),
+		modify:    func(sig []byte) []byte { return append(sig, 0x00) },
+	})
+	if errors.Cause(err) != ErrInvalidSignature {
+		t.Fatalf("Wrong sign error : got %v, want %s", err, ErrInvalidSignature)
+	}
+}
+
+func Test_AddPartialSignature_HighS(t *testing.T) {
+	var keys []bitcoin.Key
+	var pkhs [][]byte
+	for i := 0; i < 2; i++ {
+		key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+		if err != nil {
+			t.Fatalf("Failed to generate key : %s", err)
+		}
+		keys = append(keys, key)
+		pkhs = append(pkhs, bitcoin.Hash160(key.PublicKey().Bytes()))
+	}
+
+	ra, err := bitcoin.NewRawAddressMultiPKH(2, pkhs)
+	if err != nil {
+		t.Fatalf("Failed to create multi-PKH address : %s", err)
+	}
+	lockingScript, _ := ra.LockingScript()
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 9500, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	hashType := SigHashAll | SigHashForkID
+	hash, err := SignatureHash(tx.MsgTx, 0, lockingScript, 10000, hashType, &SigHashCache{})
+	if err != nil {
+		t.Fatalf("Failed to create sig hash : %s", err)
+	}
+
+	sig, err := keys[1].Sign(*hash)
+	if err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	err = tx.AddPartialSignature(0, PartialSignature{
+		PublicKey: keys[1].PublicKey(),
+		Signature: append(highSSignature(t, sig.Bytes()), byte(hashType)),
+	})
+	if errors.Cause(err) != ErrInvalidSignature {
+		t.Fatalf("Wrong high S error : got %v, want %s", err, ErrInvalidSignature)
+	}
+
+	if err := tx.AddPartialSignature(0, PartialSignature{
+		PublicKey: keys[1].PublicKey(),
+		Signature: append(sig.Bytes(), byte(hashType)),
+	}); err != nil {
+		t.Fatalf("Failed to add partial signature : %s", err)
+	}
+}
@@ -0,0 +1,362 @@
+package txbuilder
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+// Signer creates signatures for tx inputs without the private keys being provided to the
+// TxBuilder, for example by a signing service backed by an HSM. Inputs are signed concurrently
+// unless TxBuilder.SignWorkers is one, so implementations must be safe for concurrent use.
+type Signer interface {
+	// PublicKeys returns the public keys the signer can sign with. When keyID is not empty it is the
+	// KeyID of the input being signed and the signer can return only the keys for it. Signers that
+	// don't use key IDs return all of their keys.
+	PublicKeys(ctx context.Context, keyID string) ([]bitcoin.PublicKey, error)
+
+	// Sign returns the DER encoded signature of the sig hash, as returned by SignatureHash, using
+	// the private key for the public key. keyID is the KeyID of the input being signed.
+	Sign(ctx context.Context, publicKey bitcoin.PublicKey, keyID string,
+		sigHash bitcoin.Hash32) ([]byte, error)
+}
+
+// KeyResolver returns the private key for a KeyID. Different key IDs are resolved concurrently, so
+// implementations must be safe for concurrent use.
+type KeyResolver interface {
+	// ResolveKey returns the key for the key ID or ErrMissingPrivateKey if it isn't available.
+	ResolveKey(ctx context.Context, keyID string) (bitcoin.Key, error)
+}
+
+// KeySigner is a Signer containing private keys in memory. It ignores key IDs. Keys are indexed
+// by public key so signing doesn't compare every key.
+type KeySigner struct {
+	publicKeys  []bitcoin.PublicKey
+	byPublicKey map[string]bitcoin.Key
+}
+
+// NewKeySigner returns a signer containing the keys.
+func NewKeySigner(keys []bitcoin.Key) *KeySigner {
+	result := &KeySigner{
+		publicKeys:  make([]bitcoin.PublicKey, len(keys)),
+		byPublicKey: make(map[string]bitcoin.Key, len(keys)),
+	}
+
+	for i, key := range keys {
+		publicKey := key.PublicKey()
+		result.publicKeys[i] = publicKey
+		result.byPublicKey[string(publicKey.Bytes())] = key
+	}
+
+	return result
+}
+
+// PublicKeys returns the public keys for all of the private keys.
+func (s *KeySigner) PublicKeys(ctx context.Context, keyID string) ([]bitcoin.PublicKey, error) {
+	return s.publicKeys, nil
+}
+
+// Sign returns the DER encoded signature of the sig hash using the private key for the public key.
+func (s *KeySigner) Sign(ctx context.Context, publicKey bitcoin.PublicKey, keyID string,
+	sigHash bitcoin.Hash32) ([]byte, error) {
+
+	key, ok := s.byPublicKey[string(publicKey.Bytes())]
+	if !ok {
+		return nil, ErrMissingPrivateKey
+	}
+
+	sig, err := key.Sign(sigHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign")
+	}
+
+	return sig.Bytes(), nil
+}
+
+// Keys returns the keys for the public keys in the order of the public keys.
+func (s *KeySigner) Keys(publicKeys []bitcoin.PublicKey) []bitcoin.Key {
+	if publicKeys == nil {
+		return nil
+	}
+
+	result := make([]bitcoin.Key, 0, len(publicKeys))
+	for _, publicKey := range publicKeys {
+		if key, ok := s.byPublicKey[string(publicKey.Bytes())]; ok {
+			result = append(result, key)
+		}
+	}
+
+	return result
+}
+
+// ResolverSigner is a Signer that gets the keys for inputs with a KeyID from a KeyResolver and
+// uses a set of keys for inputs without a KeyID. Each key ID is resolved once and different key IDs
+// are resolved concurrently.
+type ResolverSigner struct {
+	resolver KeyResolver
+	keys     *KeySigner
+
+	resolved map[string]*resolvedKey
+	lock     sync.Mutex
+}
+
+// resolvedKey is the result of resolving a key ID. done is closed when key and err are set.
+type resolvedKey struct {
+	done chan struct{}
+	key  bitcoin.Key
+	err  error
+}
+
+// NewResolverSigner returns a signer that resolves keys by KeyID and falls back to the keys for
+// inputs without a KeyID.
+func NewResolverSigner(resolver KeyResolver, keys []bitcoin.Key) *ResolverSigner {
+	return &ResolverSigner{
+		resolver: resolver,
+		keys:     NewKeySigner(keys),
+		resolved: make(map[string]*resolvedKey),
+	}
+}
+
+// PublicKeys returns the public key for the key ID, or all of the fallback keys when keyID is
+// empty.
+func (s *ResolverSigner) PublicKeys(ctx context.Context,
+	keyID string) ([]bitcoin.PublicKey, error) {
+
+	if len(keyID) == 0 {
+		return s.keys.PublicKeys(ctx, keyID)
+	}
+
+	key, err := s.resolve(ctx, keyID)
+	if err != nil {
+		if errors.Cause(err) == ErrMissingPrivateKey {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "resolve %s", keyID)
+	}
+
+	return []bitcoin.PublicKey{key.PublicKey()}, nil
+}
+
+// Sign returns the DER encoded signature of the sig hash using the key for the key ID, or the
+// fallback key for the public key when keyID is empty.
+func (s *ResolverSigner) Sign(ctx context.Context, publicKey bitcoin.PublicKey, keyID string,
+	sigHash bitcoin.Hash32) ([]byte, error) {
+
+	if len(keyID) == 0 {
+		return s.keys.Sign(ctx, publicKey, keyID, sigHash)
+	}
+
+	key, err := s.resolve(ctx, keyID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve %s", keyID)
+	}
+
+	sig, err := key.Sign(sigHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "sign")
+	}
+
+	return sig.Bytes(), nil
+}
+
+// resolve returns the key for the key ID. The lock isn't held while the resolver is called, so
+// other key IDs can be resolved at the same time. Calls for a key ID that is being resolved wait
+// for the result. Failures are not kept so the key ID is resolved again by the next call.
+func (s *ResolverSigner) resolve(ctx context.Context, keyID string) (bitcoin.Key, error) {
+	s.lock.Lock()
+	if resolved, ok := s.resolved[keyID]; ok {
+		s.lock.Unlock()
+
+		select {
+		case <-resolved.done:
+			return resolved.key, resolved.err
+		case <-ctx.Done():
+			return bitcoin.Key{}, ctx.Err()
+		}
+	}
+
+	resolved := &resolvedKey{done: make(chan struct{})}
+	s.resolved[keyID] = resolved
+	s.lock.Unlock()
+
+	resolved.key, resolved.err = s.resolver.ResolveKey(ctx, keyID)
+	if resolved.err != nil {
+		s.lock.Lock()
+		delete(s.resolved, keyID)
+		s.lock.Unlock()
+	}
+
+	close(resolved.done)
+	return resolved.key, resolved.err
+}
+
+// signingKeys caches the public keys available from a signer for each key ID, indexed by public
+// key and public key hash, so each input can find its keys without comparing every key. Signers
+// that ignore key IDs are indexed once and key IDs that have the same keys share an index. It is
+// safe for concurrent use and the lock isn't held while the signer is called.
+type signingKeys struct {
+	signer        Signer
+	ignoresKeyIDs bool
+	byKeyID       map[string]*pendingKeys
+	byKeySet      map[bitcoin.Hash32]*publicKeyIndex
+	lock          sync.Mutex
+}
+
+// pendingKeys is the result of getting the public keys for a key ID. done is closed when index and
+// err are set.
+type pendingKeys struct {
+	done  chan struct{}
+	index *publicKeyIndex
+	err   error
+}
+
+type publicKeyIndex struct {
+	list        []bitcoin.PublicKey
+	byPublicKey map[string]bitcoin.PublicKey
+	byHash      map[bitcoin.Hash20]bitcoin.PublicKey
+}
+
+func newSigningKeys(signer Signer) *signingKeys {
+	_, ignoresKeyIDs := signer.(*KeySigner)
+	return &signingKeys{
+		signer:        signer,
+		ignoresKeyIDs: ignoresKeyIDs,
+		byKeyID:       make(map[string]*pendingKeys),
+		byKeySet:      make(map[bitcoin.Hash32]*publicKeyIndex),
+	}
+}
+
+// index returns the public keys available for the key ID. Calls for a key ID that is being
+// retrieved wait for the result. Failures are not kept so the next call tries again.
+func (k *signingKeys) index(ctx context.Context, keyID string) (*publicKeyIndex, error) {
+	if k.ignoresKeyIDs {
+		keyID = ""
+	}
+
+	k.lock.Lock()
+	if pending, ok := k.byKeyID[keyID]; ok {
+		k.lock.Unlock()
+
+		select {
+		case <-pending.done:
+			return pending.index, pending.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	pending := &pendingKeys{done: make(chan struct{})}
+	k.byKeyID[keyID] = pending
+	k.lock.Unlock()
+
+	publicKeys, err := k.signer.PublicKeys(ctx, keyID)
+	if err != nil {
+		pending.err = errors.Wrap(err, "public keys")
+
+		k.lock.Lock()
+		delete(k.byKeyID, keyID)
+		k.lock.Unlock()
+
+		close(pending.done)
+		return nil, pending.err
+	}
+
+	keySet := publicKeySetHash(publicKeys)
+	index := newPublicKeyIndex(publicKeys)
+
+	// Key IDs with the same keys share the index.
+	k.lock.Lock()
+	if existing, ok := k.byKeySet[keySet]; ok {
+		index = existing
+	} else {
+		k.byKeySet[keySet] = index
+	}
+	k.lock.Unlock()
+
+	pending.index = index
+	close(pending.done)
+	return index, nil
+}
+
+func newPublicKeyIndex(publicKeys []bitcoin.PublicKey) *publicKeyIndex {
+	result := &publicKeyIndex{
+		list:        publicKeys,
+		byPublicKey: make(map[string]bitcoin.PublicKey, len(publicKeys)),
+		byHash:      make(map[bitcoin.Hash20]bitcoin.PublicKey, len(publicKeys)),
+	}
+
+	for _, publicKey := range publicKeys {
+		b := publicKey.Bytes()
+		result.byPublicKey[string(b)] = publicKey
+
+		hash, _ := bitcoin.NewHash20(bitcoin.Hash160(b))
+		result.byHash[*hash] = publicKey
+	}
+
+	return result
+}
+
+// publicKeySetHash returns a hash of the public keys in order so lists of keys can be compared
+// without comparing every key.
+func publicKeySetHash(publicKeys []bitcoin.PublicKey) bitcoin.Hash32 {
+	hasher := sha256.New()
+	for _, publicKey := range publicKeys {
+		hasher.Write(publicKey.Bytes())
+	}
+
+	var result bitcoin.Hash32
+	copy(result[:], hasher.Sum(nil))
+	return result
+}
+
+// forHash returns the public key with the public key hash.
+func (i *publicKeyIndex) forHash(hash []byte) (bitcoin.PublicKey, bool) {
+	h, err := bitcoin.NewHash20(hash)
+	if err != nil {
+		return bitcoin.PublicKey{}, false
+	}
+
+	publicKey, ok := i.byHash[*h]
+	return publicKey, ok
+}
+
+// first returns the first public key available.
+func (i *publicKeyIndex) first() (bitcoin.PublicKey, bool) {
+	if len(i.list) == 0 {
+		return bitcoin.PublicKey{}, false
+	}
+
+	return i.list[0], true
+}
+
+// forPublicKey returns the public key matching the serialized public key.
+func (i *publicKeyIndex) forPublicKey(b []byte) (bitcoin.PublicKey, bool) {
+	publicKey, ok := i.byPublicKey[string(b)]
+	return publicKey, ok
+}
+
+// usedPublicKeys is the list of public keys used to sign a tx, without duplicates.
+type usedPublicKeys struct {
+	list []bitcoin.PublicKey
+	seen map[string]bool
+}
+
+func (u *usedPublicKeys) add(publicKeys ...bitcoin.PublicKey) {
+	if u.seen == nil {
+		u.seen = make(map[string]bool)
+	}
+
+	for _, publicKey := range publicKeys {
+		b := string(publicKey.Bytes())
+		if u.seen[b] {
+			continue
+		}
+
+		u.seen[b] = true
+		u.list = append(u.list, publicKey)
+	}
+}
@@ -0,0 +1,295 @@
+package txbuilder
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tokenized/pkg/bitcoin"
+)
+
+// testRemoteSigner simulates a signing service that holds keys by key ID.
+type testRemoteSigner struct {
+	keys  map[string]bitcoin.Key
+	signs int
+	lock  sync.Mutex
+}
+
+func (s *testRemoteSigner) PublicKeys(ctx context.Context,
+	keyID string) ([]bitcoin.PublicKey, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	key, ok := s.keys[keyID]
+	if !ok {
+		return nil, nil
+	}
+
+	return []bitcoin.PublicKey{key.PublicKey()}, nil
+}
+
+func (s *testRemoteSigner) Sign(ctx context.Context, publicKey bitcoin.PublicKey, keyID string,
+	sigHash bitcoin.Hash32) ([]byte, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	key, ok := s.keys[keyID]
+	if !ok || !key.PublicKey().Equal(publicKey) {
+		return nil, ErrMissingPrivateKey
+	}
+
+	s.lock.Lock()
+	s.signs++
+	s.lock.Unlock()
+	sig, err := key.Sign(sigHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return sig.Bytes(), nil
+}
+
+func Test_SignWithSigner(t *testing.T) {
+	signer := &testRemoteSigner{keys: make(map[string]bitcoin.Key)}
+	var keys []bitcoin.Key
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	tx.SetChangeLockingScript(randomLockingScript(), "")
+
+	for _, keyID := range []string{"m/0/1", "m/0/2"} {
+		key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+		if err != nil {
+			t.Fatalf("Failed to generate key : %s", err)
+		}
+		signer.keys[keyID] = key
+		keys = append(keys, key)
+
+		lockingScript, _ := key.LockingScript()
+		if err := tx.AddInputUTXO(bitcoin.UTXO{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         5000,
+			LockingScript: lockingScript,
+			KeyID:         keyID,
+		}); err != nil {
+			t.Fatalf("Failed to add input : %s", err)
+		}
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 8000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	keysTx := tx.Copy()
+
+	publicKeys, err := tx.SignWithSigner(context.Background(), signer)
+	if err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	if len(publicKeys) != 2 {
+		t.Fatalf("Wrong public key count : got %d, want %d", len(publicKeys), 2)
+	}
+
+	if signer.signs < 2 {
+		t.Fatalf("Signer not used for all inputs : %d signatures", signer.signs)
+	}
+
+	// Signatures are deterministic so signing with the keys directly must produce the same tx.
+	usedKeys, err := keysTx.Sign(keys)
+	if err != nil {
+		t.Fatalf("Failed to sign with keys : %s", err)
+	}
+
+	if len(usedKeys) != 2 || !usedKeys[0].Equal(keys[0]) || !usedKeys[1].Equal(keys[1]) {
+		t.Fatalf("Wrong keys used : %v", usedKeys)
+	}
+
+	if !tx.MsgTx.TxHash().Equal(keysTx.MsgTx.TxHash()) {
+		t.Fatalf("Signer tx doesn't match keys tx : %s != %s", tx.MsgTx.TxHash(),
+			keysTx.MsgTx.TxHash())
+	}
+}
+
+func Test_SignOnlyWithSigner_MissingKey(t *testing.T) {
+	signer := &testRemoteSigner{keys: make(map[string]bitcoin.Key)}
+
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	signer.keys["known"] = key
+	lockingScript, _ := key.LockingScript()
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	for _, keyID := range []string{"known", "unknown"} {
+		if err := tx.AddInputUTXO(bitcoin.UTXO{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         5000,
+			LockingScript: lockingScript,
+			KeyID:         keyID,
+		}); err != nil {
+			t.Fatalf("Failed to add input : %s", err)
+		}
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 9000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tx.SignOnlyWithSigner(ctx, signer); err == nil {
+		t.Fatalf("Sign should fail with canceled context")
+	}
+
+	publicKeys, err := tx.SignOnlyWithSigner(context.Background(), signer)
+	if err != ErrMissingPrivateKey {
+		t.Fatalf("Wrong error : got %v, want %s", err, ErrMissingPrivateKey)
+	}
+
+	if len(publicKeys) != 1 || !publicKeys[0].Equal(key.PublicKey()) {
+		t.Fatalf("Wrong public keys : %v", publicKeys)
+	}
+
+	if !tx.InputIsSigned(0) || tx.InputIsSigned(1) {
+		t.Fatalf("Only the input with the known key ID should be signed")
+	}
+}
+
+func Test_SigningKeys_IndexedOnce(t *testing.T) {
+	ctx := context.Background()
+	keys := generateKeys(t, 3)
+
+	signingKeys := newSigningKeys(NewKeySigner(keys))
+	first, err := signingKeys.index(ctx, "m/0/1")
+	if err != nil {
+		t.Fatalf("Failed to index keys : %s", err)
+	}
+
+	second, err := signingKeys.index(ctx, "m/0/2")
+	if err != nil {
+		t.Fatalf("Failed to index keys : %s", err)
+	}
+
+	if first != second || len(signingKeys.byKeyID) != 1 {
+		t.Fatalf("Key signer keys should be indexed once")
+	}
+
+	// Key IDs with the same keys share an index.
+	signer := &testRemoteSigner{keys: map[string]bitcoin.Key{
+		"m/0/1": keys[0],
+		"m/0/2": keys[0],
+		"m/0/3": keys[1],
+	}}
+	signingKeys = newSigningKeys(signer)
+	indexes := make(map[*publicKeyIndex]bool)
+	for _, keyID := range []string{"m/0/1", "m/0/2", "m/0/3"} {
+		index, err := signingKeys.index(ctx, keyID)
+		if err != nil {
+			t.Fatalf("Failed to index keys : %s", err)
+		}
+		indexes[index] = true
+	}
+
+	if len(indexes) != 2 {
+		t.Fatalf("Wrong index count : got %d, want %d", len(indexes), 2)
+	}
+
+	if _, ok := indexes[signingKeys.byKeyID["m/0/3"].index]; !ok {
+		t.Fatalf("Missing index for m/0/3")
+	}
+}
+
+// testBlockingSigner is a signer where getting public keys for a key ID blocks until the key ID's
+// channel is closed.
+type testBlockingSigner struct {
+	testRemoteSigner
+	blocks map[string]chan struct{}
+	calls  map[string]int
+}
+
+func (s *testBlockingSigner) PublicKeys(ctx context.Context,
+	keyID string) ([]bitcoin.PublicKey, error) {
+
+	s.lock.Lock()
+	s.calls[keyID]++
+	block := s.blocks[keyID]
+	s.lock.Unlock()
+
+	if block != nil {
+		<-block
+	}
+
+	return s.testRemoteSigner.PublicKeys(ctx, keyID)
+}
+
+func Test_SigningKeys_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	keys := generateKeys(t, 2)
+
+	signer := &testBlockingSigner{
+		testRemoteSigner: testRemoteSigner{keys: map[string]bitcoin.Key{
+			"slow": keys[0],
+			"fast": keys[1],
+		}},
+		blocks: map[string]chan struct{}{"slow": make(chan struct{})},
+		calls:  make(map[string]int),
+	}
+	signingKeys := newSigningKeys(signer)
+
+	var wait sync.WaitGroup
+	slowIndexes := make([]*publicKeyIndex, 3)
+	for i := range slowIndexes {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			index, err := signingKeys.index(ctx, "slow")
+			if err != nil {
+				t.Errorf("Failed to index slow keys : %s", err)
+			}
+			slowIndexes[i] = index
+		}(i)
+	}
+
+	// Wait until the slow key ID is being retrieved.
+	for {
+		signer.lock.Lock()
+		started := signer.calls["slow"] > 0
+		signer.lock.Unlock()
+
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Another key ID isn't blocked by the slow one.
+	fast, err := signingKeys.index(ctx, "fast")
+	if err != nil {
+		t.Fatalf("Failed to index fast keys : %s", err)
+	}
+
+	if _, ok := fast.forPublicKey(keys[1].PublicKey().Bytes()); !ok {
+		t.Fatalf("Missing fast public key")
+	}
+
+	close(signer.blocks["slow"])
+	wait.Wait()
+
+	for i, index := range slowIndexes {
+		if index == nil || index != slowIndexes[0] {
+			t.Fatalf("Wrong slow index %d", i)
+		}
+	}
+
+	if signer.calls["slow"] != 1 {
+		t.Fatalf("Wrong slow call count : got %d, want %d", signer.calls["slow"], 1)
+	}
+}
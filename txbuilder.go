@@ -2,7 +2,9 @@ package txbuilder
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/tokenized/pkg/bitcoin"
 	"github.com/tokenized/pkg/wire"
@@ -42,22 +44,105 @@ var (
 
 	// ErrMissingInputData means that data required to include an input in a tx was not provided.
 	ErrMissingInputData = errors.New("Missing Input Data")
+
+	// ErrNoExactMatch means that no subset of the UTXOs funds the tx within the tolerance.
+	ErrNoExactMatch = errors.New("No Exact Match")
+
+	// ErrInvalidSignature means that a signature provided for an input is not valid for the tx.
+	ErrInvalidSignature = errors.New("Invalid Signature")
+
+	// ErrFeeQuoteExpired means that the fee quote the tx's fee rates came from has expired.
+	ErrFeeQuoteExpired = errors.New("Fee Quote Expired")
+
+	// ErrNonStrictDER means that a signature is not strict DER encoded.
+	ErrNonStrictDER = errors.New("Signature Not Strict DER")
+
+	// ErrHighS means that a signature has a high S value, which is non-standard.
+	ErrHighS = errors.New("Signature High S")
+
+	// ErrInputAlreadySigned means that a signature was provided for an input that already has a
+	// complete unlocking script.
+	ErrInputAlreadySigned = errors.New("Input Already Signed")
 )
 
+// FeeAboveMaximumError means that the tx fee would be more than the tx's MaxFee.
+type FeeAboveMaximumError struct {
+	Fee     uint64
+	Maximum uint64
+}
+
+// FeeBelowMinimumError means that the tx fee would be less than the tx's MinFee.
+type FeeBelowMinimumError struct {
+	Fee     uint64
+	Minimum uint64
+}
+
 type TxBuilder struct {
 	MsgTx        *wire.MsgTx
 	Inputs       []*InputSupplement  // Input Data that is not in wire.MsgTx
 	Outputs      []*OutputSupplement // Output Data that is not in wire.MsgTx
 	ChangeScript bitcoin.Script      // The script to pay extra bitcoins to if a change output isn't specified
-	FeeRate      float32             // The target fee rate in sat/byte
+	FeeRate      FeeRate             `json:"FeeRateSatPerKB"` // The target fee rate in sat/kB
 	SendMax      bool                // When set, AddFunding will add all UTXOs given
 
 	// The fee rate used by miners to calculate dust. It is currently maintained as a different rate
-	// than min accept and min propagate. Currently 1.0
-	DustFeeRate float32
+	// than min accept and min propagate. Currently 1000 sat/kB
+	// It is only used when DustPolicy is nil.
+	DustFeeRate FeeRate `json:"DustFeeRateSatPerKB"`
+
+	// Determines the minimum value of outputs. When nil the legacy policy based on DustFeeRate is
+	// used. It is not serialized, so it must be set again on a deserialized tx, otherwise the
+	// DustFeeRate policy is used.
+	DustPolicy DustPolicy `json:"-"`
 
 	// Optional identifier for external use to track the key needed to spend change
 	ChangeKeyID string
+
+	// The fee rate for data bytes, which are the locking scripts of false OP_RETURN outputs. When
+	// nil FeeRate is used for all bytes. A zero rate means data bytes are free.
+	DataFeeRate *FeeRate `json:"DataFeeRateSatPerKB,omitempty"`
+
+	// Specifies how fee adjustments are split between remainder outputs.
+	RemainderPolicy RemainderPolicy
+
+	// When non-zero the tx fee is set to exactly this many satoshis instead of being calculated
+	// from FeeRate.
+	TargetFee uint64
+
+	// When non-zero the tx fee is never more than MaxFee satoshis.
+	MaxFee uint64
+
+	// When non-zero the tx fee is never less than MinFee satoshis.
+	MinFee uint64
+
+	// When non-zero the fee rates came from a fee quote that expires at this time. Funding and
+	// signing fail after it.
+	FeeExpiry time.Time
+
+	// When set, inputs with unknown script templates are estimated as P2PKH instead of returning an
+	// error from size and fee estimates.
+	FallbackToP2PKH bool
+
+	// Estimates the unlocking script sizes of the tx's inputs and change outputs. When nil the
+	// templates registered with RegisterUnlockingSize and the built in templates are used. It is
+	// not serialized.
+	UnlockingSizer fees.UnlockingSizer `json:"-"`
+
+	// Chooses the UTXOs used by AddFunding and AddFundingBreakChange. When nil the UTXOs are used
+	// in the order they are provided.
+	CoinSelector CoinSelector `json:"-"`
+
+	// The UTXOs spent by the last funding call and why they were selected.
+	CoinSelection *CoinSelection
+
+	// The value left to the miner by the last funding or fee adjustment because it was too small
+	// for a change output. Each funding or fee adjustment replaces it rather than adding to it,
+	// since value dropped earlier is included in the fee the later adjustment starts from.
+	DroppedChange uint64
+
+	// The maximum number of inputs signed concurrently. When zero the number of CPUs is used. One
+	// signs inputs sequentially. Signers must be safe for concurrent use when it isn't one.
+	SignWorkers int `json:"-"`
 }
 
 type TransactionWithOutputs interface {
@@ -72,8 +157,45 @@ type TransactionWithOutputs interface {
 	Output(index int) *wire.TxOut
 }
 
-// NewTxBuilder returns a new TxBuilder with the specified change address.
+// UnmarshalJSON reads a TxBuilder. Fee rates were previously serialized as floating point
+// satoshis per byte under the keys FeeRate and DustFeeRate. They are converted to satoshis per 1000
+// bytes when the new keys are not present.
+func (tx *TxBuilder) UnmarshalJSON(b []byte) error {
+	type txBuilderFields TxBuilder // prevent recursion into this function
+	var fields struct {
+		*txBuilderFields
+		LegacyFeeRate     *float32 `json:"FeeRate"`
+		LegacyDustFeeRate *float32 `json:"DustFeeRate"`
+	}
+	fields.txBuilderFields = (*txBuilderFields)(tx)
+
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return err
+	}
+
+	if _, exists := keys["FeeRateSatPerKB"]; !exists && fields.LegacyFeeRate != nil {
+		tx.FeeRate = NewFeeRate(*fields.LegacyFeeRate)
+	}
+	if _, exists := keys["DustFeeRateSatPerKB"]; !exists && fields.LegacyDustFeeRate != nil {
+		tx.DustFeeRate = NewFeeRate(*fields.LegacyDustFeeRate)
+	}
+
+	return nil
+}
+
+// NewTxBuilder returns a new TxBuilder with fee rates specified in satoshis per byte.
 func NewTxBuilder(feeRate, dustFeeRate float32) *TxBuilder {
+	return NewTxBuilderWithFeeRates(NewFeeRate(feeRate), NewFeeRate(dustFeeRate))
+}
+
+// NewTxBuilderWithFeeRates returns a new TxBuilder with fee rates specified in satoshis per 1000
+// bytes.
+func NewTxBuilderWithFeeRates(feeRate, dustFeeRate FeeRate) *TxBuilder {
 	tx := wire.MsgTx{Version: DefaultVersion, LockTime: 0}
 	result := TxBuilder{
 		MsgTx:       &tx,
@@ -83,15 +205,49 @@ func NewTxBuilder(feeRate, dustFeeRate float32) *TxBuilder {
 	return &result
 }
 
+// NewTxBuilderFromFeeModel returns a new TxBuilder with the fee rates, minimum fee, and expiry of a
+// fee model, like one parsed from a miner's fee quote.
+func NewTxBuilderFromFeeModel(model FeeModel, dustFeeRate FeeRate) (*TxBuilder, error) {
+	if model.IsExpired(time.Now()) {
+		return nil, errors.Wrap(ErrFeeQuoteExpired, model.Expiry.String())
+	}
+
+	result := NewTxBuilderWithFeeRates(model.Standard, dustFeeRate)
+	result.SetDataFeeRate(model.Data)
+	result.MinFee = model.MinFee
+	result.FeeExpiry = model.Expiry
+	return result, nil
+}
+
 func (tx TxBuilder) Copy() TxBuilder {
 	result := TxBuilder{
-		Inputs:       make([]*InputSupplement, len(tx.Inputs)),
-		Outputs:      make([]*OutputSupplement, len(tx.Outputs)),
-		ChangeScript: tx.ChangeScript.Copy(),
-		FeeRate:      tx.FeeRate,
-		SendMax:      tx.SendMax,
-		DustFeeRate:  tx.DustFeeRate,
-		ChangeKeyID:  CopyString(tx.ChangeKeyID),
+		Inputs:          make([]*InputSupplement, len(tx.Inputs)),
+		Outputs:         make([]*OutputSupplement, len(tx.Outputs)),
+		ChangeScript:    tx.ChangeScript.Copy(),
+		FeeRate:         tx.FeeRate,
+		SendMax:         tx.SendMax,
+		DustFeeRate:     tx.DustFeeRate,
+		DustPolicy:      tx.DustPolicy,
+		ChangeKeyID:     CopyString(tx.ChangeKeyID),
+		RemainderPolicy: tx.RemainderPolicy,
+		TargetFee:       tx.TargetFee,
+		MaxFee:          tx.MaxFee,
+		MinFee:          tx.MinFee,
+		FeeExpiry:       tx.FeeExpiry,
+		FallbackToP2PKH: tx.FallbackToP2PKH,
+		UnlockingSizer:  tx.UnlockingSizer,
+		CoinSelector:    tx.CoinSelector,
+		DroppedChange:   tx.DroppedChange,
+		SignWorkers:     tx.SignWorkers,
+	}
+
+	if tx.DataFeeRate != nil {
+		result.SetDataFeeRate(*tx.DataFeeRate)
+	}
+
+	if tx.CoinSelection != nil {
+		c := tx.CoinSelection.Copy()
+		result.CoinSelection = &c
 	}
 
 	copyMsgTx := tx.MsgTx.Copy()
@@ -115,6 +271,10 @@ func (input InputSupplement) Copy() InputSupplement {
 		LockingScript: input.LockingScript.Copy(),
 		Value:         input.Value,
 		KeyID:         CopyString(input.KeyID),
+		SigHashType:   input.SigHashType,
+		Signatures:    copyPartialSignatures(input.Signatures),
+		RedeemScript:  input.RedeemScript.Copy(),
+		RPuzzleK:      append([]byte(nil), input.RPuzzleK...),
 	}
 }
 
@@ -122,11 +282,20 @@ func (output OutputSupplement) Copy() OutputSupplement {
 	return OutputSupplement{
 		IsRemainder: output.IsRemainder,
 		IsDust:      output.IsDust,
+		AbsorbsFee:  output.AbsorbsFee,
 		addedForFee: output.addedForFee,
 		KeyID:       CopyString(output.KeyID),
 	}
 }
 
+func (e FeeAboveMaximumError) Error() string {
+	return fmt.Sprintf("Fee Above Maximum: %d > %d", e.Fee, e.Maximum)
+}
+
+func (e FeeBelowMinimumError) Error() string {
+	return fmt.Sprintf("Fee Below Minimum: %d < %d", e.Fee, e.Minimum)
+}
+
 func CopyString(s string) string {
 	result := make([]byte, len(s))
 	copy(result, s)
@@ -139,8 +308,8 @@ func NewTxBuilderFromTransactionWithOutputs(feeRate, dustFeeRate float32,
 	inputCount := tx.InputCount()
 	result := TxBuilder{
 		MsgTx:       tx.GetMsgTx(),
-		FeeRate:     feeRate,
-		DustFeeRate: dustFeeRate,
+		FeeRate:     NewFeeRate(feeRate),
+		DustFeeRate: NewFeeRate(dustFeeRate),
 		Inputs:      make([]*InputSupplement, inputCount),
 	}
 
@@ -179,8 +348,8 @@ func NewTxBuilderFromWire(feeRate, dustFeeRate float32, tx *wire.MsgTx,
 
 	result := TxBuilder{
 		MsgTx:       tx,
-		FeeRate:     feeRate,
-		DustFeeRate: dustFeeRate,
+		FeeRate:     NewFeeRate(feeRate),
+		DustFeeRate: NewFeeRate(dustFeeRate),
 		Inputs:      make([]*InputSupplement, len(tx.TxIn)),
 	}
 
@@ -221,8 +390,8 @@ func NewTxBuilderFromWireUTXOs(feeRate, dustFeeRate float32, tx *wire.MsgTx,
 
 	result := TxBuilder{
 		MsgTx:       tx,
-		FeeRate:     feeRate,
-		DustFeeRate: dustFeeRate,
+		FeeRate:     NewFeeRate(feeRate),
+		DustFeeRate: NewFeeRate(dustFeeRate),
 		Inputs:      make([]*InputSupplement, len(tx.TxIn)),
 	}
 
@@ -309,6 +478,9 @@ func (tx *TxBuilder) String(net bitcoin.Network) string {
 		if tx.Outputs[i].IsDust {
 			result += fmt.Sprintf("    IsDust\n")
 		}
+		if tx.Outputs[i].AbsorbsFee {
+			result += fmt.Sprintf("    AbsorbsFee\n")
+		}
 		result += "\n"
 	}
 	result += fmt.Sprintf("  LockTime: %d\n", tx.MsgTx.LockTime)
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"testing"
 
+	"github.com/tokenized/bitcoin_interpreter/agent_bitcoin_transfer"
 	"github.com/tokenized/pkg/bitcoin"
 	"github.com/tokenized/pkg/wire"
 
@@ -17,7 +19,7 @@ import (
 func Test_DustLimit(t *testing.T) {
 	tests := []struct {
 		dustFeeRateString string
-		dustFeeRate       float32
+		dustFeeRate       FeeRate
 		dust              uint64
 	}{
 		{
@@ -32,22 +34,22 @@ func Test_DustLimit(t *testing.T) {
 		},
 		{
 			dustFeeRateString: "0.25",
-			dustFeeRate:       0.25,
-			dust:              136,
+			dustFeeRate:       250,
+			dust:              137,
 		},
 		{
 			dustFeeRateString: "0.5",
-			dustFeeRate:       0.5,
+			dustFeeRate:       500,
 			dust:              273,
 		},
 		{
 			dustFeeRateString: "1.0",
-			dustFeeRate:       1.0,
+			dustFeeRate:       1000,
 			dust:              546,
 		},
 		{
 			dustFeeRateString: "1",
-			dustFeeRate:       1,
+			dustFeeRate:       1000,
 			dust:              546,
 		},
 	}
@@ -59,10 +61,10 @@ func Test_DustLimit(t *testing.T) {
 				return
 			}
 
-			dustFeeRate := float32(dustFeeRate64)
+			dustFeeRate := NewFeeRate(float32(dustFeeRate64))
 
 			if dustFeeRate != tt.dustFeeRate {
-				t.Errorf("Wrong dust fee rate : got %f, want %f", dustFeeRate, tt.dustFeeRate)
+				t.Errorf("Wrong dust fee rate : got %d, want %d", dustFeeRate, tt.dustFeeRate)
 			}
 
 			dust := DustLimit(P2PKHOutputSize, dustFeeRate)
@@ -875,3 +877,186 @@ func test_Sign_LowFee_Payload(t *testing.T) error {
 
 	return errors.New("Failed")
 }
+
+func mixedTemplateLockingScripts(t *testing.T) map[string]bitcoin.Script {
+	result := make(map[string]bitcoin.Script)
+
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+
+	ra, err := bitcoin.NewRawAddressPublicKey(key.PublicKey())
+	if err != nil {
+		t.Fatalf("Failed to create P2PK address : %s", err)
+	}
+	result["p2pk"], _ = ra.LockingScript()
+
+	result["p2pkh"] = randomLockingScript()
+
+	var pkhs [][]byte
+	for i := 0; i < 3; i++ {
+		rb := make([]byte, 20)
+		rand.Read(rb)
+		pkhs = append(pkhs, rb)
+	}
+	ra, err = bitcoin.NewRawAddressMultiPKH(2, pkhs)
+	if err != nil {
+		t.Fatalf("Failed to create multi-PKH address : %s", err)
+	}
+	result["multi_pkh"], _ = ra.LockingScript()
+
+	agentScript, err := agent_bitcoin_transfer.CreateScript(randomLockingScript(),
+		randomLockingScript(), randomLockingScript(), 1000, randomLockingScript(), 800000)
+	if err != nil {
+		t.Fatalf("Failed to create agent bitcoin transfer script : %s", err)
+	}
+	result["agent_bitcoin_transfer"] = agentScript
+
+	return result
+}
+
+func Test_AddFunding_MixedTemplates(t *testing.T) {
+	scripts := mixedTemplateLockingScripts(t)
+
+	var utxos []bitcoin.UTXO
+	for _, name := range []string{"p2pk", "multi_pkh", "agent_bitcoin_transfer", "p2pkh"} {
+		utxos = append(utxos, bitcoin.UTXO{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         2000,
+			LockingScript: scripts[name],
+		})
+	}
+
+	for _, feeRate := range []float32{0.05, 0.5, 1.0} {
+		t.Run(fmt.Sprintf("%.2f", feeRate), func(t *testing.T) {
+			tx := NewTxBuilder(feeRate, feeRate)
+			tx.SetChangeLockingScript(scripts["multi_pkh"], "")
+
+			if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+				t.Fatalf("Failed to add payment : %s", err)
+			}
+
+			if err := tx.AddFunding(utxos); err != nil {
+				t.Fatalf("Failed to add funding : %s", err)
+			}
+
+			t.Logf(tx.String(bitcoin.MainNet))
+
+			// Each input's real size is included in the estimate.
+			expectedSize := BaseTxSize + wire.VarIntSerializeSize(uint64(len(tx.MsgTx.TxIn))) +
+				wire.VarIntSerializeSize(uint64(len(tx.MsgTx.TxOut)))
+			for _, input := range tx.Inputs {
+				inputSize, err := InputSize(input.LockingScript)
+				if err != nil {
+					t.Fatalf("Failed to get input size : %s", err)
+				}
+				expectedSize += inputSize
+			}
+			for _, txout := range tx.MsgTx.TxOut {
+				expectedSize += txout.SerializeSize()
+			}
+
+			if tx.EstimatedSize() != expectedSize {
+				t.Fatalf("Wrong estimated size : got %d, want %d", tx.EstimatedSize(),
+					expectedSize)
+			}
+
+			if tx.Fee() < tx.EstimatedFee() {
+				t.Fatalf("Fee too low : got %d, want %d", tx.Fee(), tx.EstimatedFee())
+			}
+
+			changeOutputFee, _ := tx.changeOutputCost()
+			changeDust := DustLimitForLockingScript(scripts["multi_pkh"], tx.DustFeeRate)
+			if tx.Fee() > tx.EstimatedFee()+changeOutputFee+changeDust {
+				t.Fatalf("Fee too high : got %d, want %d", tx.Fee(), tx.EstimatedFee())
+			}
+		})
+	}
+}
+
+func Test_ChangeOutputSizes(t *testing.T) {
+	scripts := mixedTemplateLockingScripts(t)
+
+	for name, lockingScript := range scripts {
+		t.Run(name, func(t *testing.T) {
+			tx := NewTxBuilder(0.5, 0.25)
+
+			// No change script so the first input's template is used.
+			if err := tx.AddInputUTXO(bitcoin.UTXO{
+				Hash:          *randomTxId(),
+				Index:         0,
+				Value:         2000,
+				LockingScript: lockingScript,
+			}); err != nil {
+				t.Fatalf("Failed to add input : %s", err)
+			}
+
+			inputSize, err := InputSize(lockingScript)
+			if err != nil {
+				t.Fatalf("Failed to get input size : %s", err)
+			}
+
+			outputSize, changeInputSize := tx.changeOutputSizes()
+			if outputSize != OutputSize(lockingScript) {
+				t.Errorf("Wrong output size : got %d, want %d", outputSize,
+					OutputSize(lockingScript))
+			}
+			if changeInputSize != inputSize {
+				t.Errorf("Wrong input size : got %d, want %d", changeInputSize, inputSize)
+			}
+
+			// Change script takes priority over inputs.
+			tx.SetChangeLockingScript(scripts["p2pk"], "")
+			outputSize, changeInputSize = tx.changeOutputSizes()
+			if outputSize != P2PKOutputSize {
+				t.Errorf("Wrong output size : got %d, want %d", outputSize, P2PKOutputSize)
+			}
+			if changeInputSize != MaximumP2PKInputSize {
+				t.Errorf("Wrong input size : got %d, want %d", changeInputSize,
+					MaximumP2PKInputSize)
+			}
+		})
+	}
+
+	// P2PKH is only assumed when nothing else is known.
+	tx := NewTxBuilder(0.5, 0.25)
+	outputSize, inputSize := tx.changeOutputSizes()
+	if outputSize != P2PKHOutputSize || inputSize != MaximumP2PKHInputSize {
+		t.Errorf("Wrong default sizes : got %d/%d, want %d/%d", outputSize, inputSize,
+			P2PKHOutputSize, MaximumP2PKHInputSize)
+	}
+}
+
+func Test_UnmarshalJSON_FeeRates(t *testing.T) {
+	// Fee rates serialized in sat/byte before they were changed to sat/kB.
+	legacy := []byte(`{"FeeRate":0.05,"DustFeeRate":1}`)
+	tx := &TxBuilder{}
+	if err := json.Unmarshal(legacy, tx); err != nil {
+		t.Fatalf("Failed to unmarshal legacy tx : %s", err)
+	}
+
+	if tx.FeeRate != 50 || tx.DustFeeRate != 1000 || tx.DataFeeRate != nil {
+		t.Fatalf("Wrong legacy fee rates : got %s/%s/%v, want 50/1000 sat/kB", tx.FeeRate,
+			tx.DustFeeRate, tx.DataFeeRate)
+	}
+
+	tx = NewTxBuilderWithFeeRates(50, 250)
+	tx.SetDataFeeRate(1)
+	b, err := json.Marshal(tx)
+	if err != nil {
+		t.Fatalf("Failed to marshal tx : %s", err)
+	}
+
+	read := &TxBuilder{}
+	if err := json.Unmarshal(b, read); err != nil {
+		t.Fatalf("Failed to unmarshal tx : %s", err)
+	}
+
+	if read.FeeRate != 50 || read.DustFeeRate != 250 || read.DataFeeRate == nil ||
+		*read.DataFeeRate != 1 {
+		t.Fatalf("Wrong fee rates : got %s/%s/%v, want 50/250/1 sat/kB", read.FeeRate,
+			read.DustFeeRate, read.DataFeeRate)
+	}
+}
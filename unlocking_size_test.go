@@ -0,0 +1,206 @@
+package txbuilder
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/txbuilder/fees"
+
+	"github.com/pkg/errors"
+)
+
+var customContractMarker = []byte("txbuilder custom contract")
+
+const customContractUnlockingSize = 500
+
+func init() {
+	RegisterUnlockingSize(isCustomContractScript,
+		func(lockingScript bitcoin.Script) (int, error) {
+			return customContractUnlockingSize, nil
+		})
+}
+
+func isCustomContractScript(lockingScript bitcoin.Script) bool {
+	return bytes.HasPrefix(lockingScript, bitcoin.PushData(customContractMarker))
+}
+
+func customContractScript() bitcoin.Script {
+	result := bitcoin.PushData(customContractMarker)
+	result = append(result, bitcoin.OP_DROP)
+	return append(result, randomLockingScript()...)
+}
+
+func Test_EstimateSize_UnknownTemplate(t *testing.T) {
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: bitcoin.Script{bitcoin.OP_TRUE},
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 5000, true); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if _, err := tx.EstimateSize(); errors.Cause(err) != bitcoin.ErrUnknownScriptTemplate {
+		t.Fatalf("Wrong estimate error : got %v, want %s", err,
+			bitcoin.ErrUnknownScriptTemplate)
+	}
+
+	if err := tx.CalculateFee(); errors.Cause(err) != bitcoin.ErrUnknownScriptTemplate {
+		t.Fatalf("Wrong calculate fee error : got %v, want %s", err,
+			bitcoin.ErrUnknownScriptTemplate)
+	}
+
+	tx.FallbackToP2PKH = true
+	size, err := tx.EstimateSize()
+	if err != nil {
+		t.Fatalf("Failed to estimate size with fallback : %s", err)
+	}
+
+	if size != tx.EstimatedSize() {
+		t.Fatalf("Wrong fallback size : got %d, want %d", size, tx.EstimatedSize())
+	}
+
+	if err := tx.CalculateFee(); err != nil {
+		t.Fatalf("Failed to calculate fee with fallback : %s", err)
+	}
+}
+
+func Test_EstimateSize_RegisteredTemplate(t *testing.T) {
+	lockingScript := customContractScript()
+
+	unlockingSize, err := UnlockingScriptSize(lockingScript)
+	if err != nil {
+		t.Fatalf("Failed to get unlocking size : %s", err)
+	}
+
+	if unlockingSize != customContractUnlockingSize {
+		t.Fatalf("Wrong unlocking size : got %d, want %d", unlockingSize,
+			customContractUnlockingSize)
+	}
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	tx.SetChangeLockingScript(randomLockingScript(), "")
+
+	if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.AddFunding([]bitcoin.UTXO{
+		{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         10000,
+			LockingScript: lockingScript,
+		},
+	}); err != nil {
+		t.Fatalf("Failed to add funding : %s", err)
+	}
+
+	size, err := tx.EstimateSize()
+	if err != nil {
+		t.Fatalf("Failed to estimate size : %s", err)
+	}
+
+	wantSize := BaseTxSize + 1 + 1 + fees.InputSizeForUnlockingScriptSize(customContractUnlockingSize)
+	for _, txout := range tx.MsgTx.TxOut {
+		wantSize += txout.SerializeSize()
+	}
+
+	if size != wantSize {
+		t.Fatalf("Wrong size : got %d, want %d", size, wantSize)
+	}
+
+	if tx.Fee() != tx.FeeRate.Fee(size) {
+		t.Fatalf("Wrong fee : got %d, want %d", tx.Fee(), tx.FeeRate.Fee(size))
+	}
+}
+
+func Test_UnlockingSizeRegistry(t *testing.T) {
+	registry := fees.NewUnlockingSizeRegistry()
+	lockingScript := bitcoin.Script{bitcoin.OP_TRUE}
+
+	if _, err := registry.UnlockingSize(lockingScript); errors.Cause(err) != bitcoin.ErrUnknownScriptTemplate {
+		t.Fatalf("Wrong error : got %v, want %s", err, bitcoin.ErrUnknownScriptTemplate)
+	}
+
+	registry.Register(func(lockingScript bitcoin.Script) bool {
+		return bytes.Equal(lockingScript, bitcoin.Script{bitcoin.OP_TRUE})
+	}, func(lockingScript bitcoin.Script) (int, error) {
+		return 0, nil
+	})
+
+	size, err := registry.UnlockingSize(lockingScript)
+	if err != nil {
+		t.Fatalf("Failed to get unlocking size : %s", err)
+	}
+
+	if size != 0 {
+		t.Fatalf("Wrong unlocking size : got %d, want %d", size, 0)
+	}
+
+	// Built in templates still work.
+	size, err = registry.UnlockingSize(randomLockingScript())
+	if err != nil {
+		t.Fatalf("Failed to get P2PKH unlocking size : %s", err)
+	}
+
+	if size != MaximumP2PKHSigScriptSize {
+		t.Fatalf("Wrong P2PKH unlocking size : got %d, want %d", size,
+			MaximumP2PKHSigScriptSize)
+	}
+}
+
+func Test_UnlockingSizeRegistry_TxBuilder(t *testing.T) {
+	lockingScript := bitcoin.Script{bitcoin.OP_2, bitcoin.OP_DROP, bitcoin.OP_TRUE}
+
+	registry := fees.NewUnlockingSizeRegistry()
+	registry.Register(func(script bitcoin.Script) bool {
+		return bytes.Equal(script, lockingScript)
+	}, func(script bitcoin.Script) (int, error) {
+		return 200, nil
+	})
+
+	tx := NewTxBuilder(0.5, 0.25)
+	if err := tx.AddInputUTXO(bitcoin.UTXO{
+		Hash:          *randomTxId(),
+		Index:         0,
+		Value:         10000,
+		LockingScript: lockingScript,
+	}); err != nil {
+		t.Fatalf("Failed to add input : %s", err)
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 5000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	// The template is only registered for this tx, not with RegisterUnlockingSize.
+	if _, err := tx.EstimateSize(); errors.Cause(err) != bitcoin.ErrUnknownScriptTemplate {
+		t.Fatalf("Wrong error : got %v, want %s", err, bitcoin.ErrUnknownScriptTemplate)
+	}
+
+	tx.UnlockingSizer = registry
+
+	wantSize := BaseTxSize + 1 + 1 + fees.InputSizeForUnlockingScriptSize(200) +
+		tx.MsgTx.TxOut[0].SerializeSize()
+
+	size, err := tx.EstimateSize()
+	if err != nil {
+		t.Fatalf("Failed to estimate size : %s", err)
+	}
+
+	if size != wantSize {
+		t.Fatalf("Wrong estimated size : got %d, want %d", size, wantSize)
+	}
+
+	c := tx.Copy()
+	if size, err := c.EstimateSize(); err != nil || size != wantSize {
+		t.Fatalf("Wrong copy estimated size : got %d (%v), want %d", size, err, wantSize)
+	}
+}
@@ -0,0 +1,241 @@
+package txbuilder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tokenized/bitcoin_interpreter"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/wire"
+
+	"github.com/pkg/errors"
+)
+
+// InputVerifyError is the reason the unlocking script of an input doesn't satisfy its locking
+// script.
+type InputVerifyError struct {
+	Index int
+
+	// OpCode is the locking script op code that failed and OpIndex is its position in the locking
+	//   script. They are empty and -1 when the failure is not in the locking script, for example an
+	//   invalid unlocking script. The op code is found by executing each prefix of the locking
+	//   script, so it is only exact for scripts without branches.
+	OpCode  string
+	OpIndex int
+
+	// Stack is the stack items pushed by the unlocking script that the locking script is executed
+	//   on. The top of the stack is last.
+	Stack [][]byte
+
+	Err error
+}
+
+// VerifyErrors contains an error for each input that failed verification.
+type VerifyErrors []*InputVerifyError
+
+func (e InputVerifyError) Error() string {
+	var stack []string
+	for _, item := range e.Stack {
+		stack = append(stack, fmt.Sprintf("%x", item))
+	}
+
+	if len(e.OpCode) == 0 {
+		return fmt.Sprintf("input %d: stack [%s]: %s", e.Index, strings.Join(stack, " "), e.Err)
+	}
+
+	return fmt.Sprintf("input %d: op %d %s: stack [%s]: %s", e.Index, e.OpIndex, e.OpCode,
+		strings.Join(stack, " "), e.Err)
+}
+
+func (e InputVerifyError) Cause() error {
+	return e.Err
+}
+
+func (e VerifyErrors) Error() string {
+	var result []string
+	for _, err := range e {
+		result = append(result, err.Error())
+	}
+
+	return fmt.Sprintf("verify failed: %s", strings.Join(result, ", "))
+}
+
+// Verify executes the unlocking script of every input against the locking script it spends with
+// the bitcoin interpreter. It returns VerifyErrors containing an error for each input that fails,
+// so problems like a wrong input value or locking script are found before the tx is broadcast.
+// Inputs that are not signed fail. P2SH inputs with a redeem script also have the redeem script
+// executed since the interpreter follows post-genesis rules where P2SH is not evaluated.
+func (tx *TxBuilder) Verify(ctx context.Context) error {
+	var result VerifyErrors
+	for index := range tx.MsgTx.TxIn {
+		if err := tx.verifyInput(ctx, index); err != nil {
+			result = append(result, err)
+		}
+	}
+
+	if len(result) > 0 {
+		return result
+	}
+
+	return nil
+}
+
+// SignAndVerify is the same as Sign, but all inputs are verified after they are signed.
+func (tx *TxBuilder) SignAndVerify(ctx context.Context, keys []bitcoin.Key) ([]bitcoin.Key, error) {
+	signer := NewKeySigner(keys)
+	publicKeys, err := tx.SignWithSigner(ctx, signer)
+	if err != nil {
+		return signer.Keys(publicKeys), err
+	}
+
+	if err := tx.Verify(ctx); err != nil {
+		return signer.Keys(publicKeys), err
+	}
+
+	return signer.Keys(publicKeys), nil
+}
+
+func (tx *TxBuilder) verifyInput(ctx context.Context, index int) *InputVerifyError {
+	input := tx.Inputs[index]
+	unlockingScript := tx.MsgTx.TxIn[index].UnlockingScript
+	if len(unlockingScript) == 0 {
+		return &InputVerifyError{
+			Index:   index,
+			OpIndex: -1,
+			Err:     errors.New("Not signed"),
+		}
+	}
+
+	if err := verifyInputScripts(ctx, tx, index, unlockingScript,
+		input.LockingScript); err != nil {
+		return err
+	}
+
+	if len(input.RedeemScript) == 0 {
+		return nil
+	}
+
+	// Signatures commit to the redeem script, so it is executed as the locking script against the
+	// unlocking script without the redeem script push.
+	redeemPush := bitcoin.PushData(input.RedeemScript)
+	if len(unlockingScript) < len(redeemPush) ||
+		!bytes.Equal(unlockingScript[len(unlockingScript)-len(redeemPush):], redeemPush) {
+		return &InputVerifyError{
+			Index:   index,
+			OpIndex: -1,
+			Err:     errors.New("Unlocking script doesn't end with redeem script"),
+		}
+	}
+
+	redeemTx := tx.Copy()
+	redeemTx.MsgTx.TxIn[index].UnlockingScript = unlockingScript[:len(unlockingScript)-
+		len(redeemPush)]
+	if err := verifyInputScripts(ctx, &redeemTx, index,
+		redeemTx.MsgTx.TxIn[index].UnlockingScript, input.RedeemScript); err != nil {
+		err.Err = errors.Wrap(err.Err, "redeem script")
+		return err
+	}
+
+	return nil
+}
+
+// verifyInputScripts executes the unlocking script of the input against the locking script and
+// returns an error describing the failure.
+func verifyInputScripts(ctx context.Context, tx *TxBuilder, index int,
+	unlockingScript, lockingScript bitcoin.Script) *InputVerifyError {
+
+	err := bitcoin_interpreter.VerifyTx(ctx, &inputVerifyTx{
+		TxBuilder:     tx,
+		index:         index,
+		lockingScript: lockingScript,
+	})
+	if err == nil {
+		return nil
+	}
+
+	result := &InputVerifyError{
+		Index:   index,
+		OpIndex: -1,
+		Err:     err,
+	}
+
+	items, parseErr := bitcoin.ParseScriptItems(bytes.NewReader(unlockingScript), -1)
+	if parseErr != nil {
+		return result
+	}
+	for _, item := range items {
+		if item.Type != bitcoin.ScriptItemTypePushData {
+			return result // not push only so the stack isn't known
+		}
+		result.Stack = append(result.Stack, item.Data)
+	}
+
+	ops, err := splitScriptOps(lockingScript)
+	if err != nil || len(ops) == 0 {
+		return result
+	}
+
+	// Find the first op that fails by executing each prefix of the locking script followed by
+	// OP_TRUE so that only an op that fails, and not a false result, fails the prefix. When no
+	// prefix fails the last op left a false result.
+	failed := len(ops) - 1
+	var prefix bitcoin.Script
+	for i, op := range ops[:len(ops)-1] {
+		prefix = bitcoin.ConcatScript(prefix, op)
+		if err := bitcoin_interpreter.VerifyTx(ctx, &inputVerifyTx{
+			TxBuilder:     tx,
+			index:         index,
+			lockingScript: bitcoin.ConcatScript(prefix, bitcoin.Script{bitcoin.OP_TRUE}),
+		}); err != nil {
+			failed = i
+			break
+		}
+	}
+
+	result.OpIndex = failed
+	result.OpCode = ops[failed].String()
+	return result
+}
+
+// splitScriptOps returns the serialized op codes and push datas of the script.
+func splitScriptOps(script bitcoin.Script) ([]bitcoin.Script, error) {
+	var result []bitcoin.Script
+	r := bytes.NewReader(script)
+	for r.Len() > 0 {
+		offset := len(script) - r.Len()
+		if _, err := bitcoin.ParseScriptItems(r, 1); err != nil {
+			return nil, err
+		}
+
+		result = append(result, script[offset:len(script)-r.Len()])
+	}
+
+	return result, nil
+}
+
+// inputVerifyTx is a tx where only one input is verified against the specified locking script.
+// The other inputs spend OP_TRUE so they always pass. Their unlocking scripts are not part of the
+// sig hash so this doesn't change the signatures being verified.
+type inputVerifyTx struct {
+	*TxBuilder
+	index         int
+	lockingScript bitcoin.Script
+}
+
+func (tx *inputVerifyTx) InputOutput(index int) (*wire.TxOut, error) {
+	if index >= len(tx.Inputs) {
+		return nil, errors.New("Input index out of range")
+	}
+
+	lockingScript := bitcoin.Script{bitcoin.OP_TRUE}
+	if index == tx.index {
+		lockingScript = tx.lockingScript
+	}
+
+	return &wire.TxOut{
+		Value:         tx.Inputs[index].Value,
+		LockingScript: lockingScript,
+	}, nil
+}
@@ -0,0 +1,83 @@
+package txbuilder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+)
+
+func Test_SignAndVerify(t *testing.T) {
+	ctx := context.Background()
+
+	key, err := bitcoin.GenerateKey(bitcoin.MainNet)
+	if err != nil {
+		t.Fatalf("Failed to generate key : %s", err)
+	}
+	lockingScript, _ := key.LockingScript()
+
+	tx := NewTxBuilderWithFeeRates(500, 250)
+	tx.SetChangeLockingScript(randomLockingScript(), "")
+	for i := 0; i < 2; i++ {
+		if err := tx.AddInputUTXO(bitcoin.UTXO{
+			Hash:          *randomTxId(),
+			Index:         0,
+			Value:         10000,
+			LockingScript: lockingScript,
+		}); err != nil {
+			t.Fatalf("Failed to add input : %s", err)
+		}
+	}
+
+	if err := tx.AddPaymentOutput(randomAddress(), 15000, false); err != nil {
+		t.Fatalf("Failed to add payment : %s", err)
+	}
+
+	if err := tx.Verify(ctx); err == nil {
+		t.Fatalf("Unsigned tx should not verify")
+	}
+
+	if _, err := tx.SignAndVerify(ctx, []bitcoin.Key{key}); err != nil {
+		t.Fatalf("Failed to sign and verify : %s", err)
+	}
+
+	// A wrong input value invalidates the signature.
+	tx.Inputs[1].Value = 10001
+	err = tx.Verify(ctx)
+	verifyErrs, ok := err.(VerifyErrors)
+	if !ok {
+		t.Fatalf("Wrong verify error : %v", err)
+	}
+
+	if len(verifyErrs) != 1 || verifyErrs[0].Index != 1 {
+		t.Fatalf("Wrong verify errors : %s", verifyErrs)
+	}
+	t.Logf("Wrong value : %s", verifyErrs)
+
+	if verifyErrs[0].OpCode != "OP_CHECKSIG" {
+		t.Fatalf("Wrong failed op code : got %s, want %s", verifyErrs[0].OpCode, "OP_CHECKSIG")
+	}
+
+	if len(verifyErrs[0].Stack) != 2 {
+		t.Fatalf("Wrong stack size : got %d, want %d", len(verifyErrs[0].Stack), 2)
+	}
+
+	// A wrong locking script fails the public key hash check.
+	tx.Inputs[1].Value = 10000
+	tx.Inputs[1].LockingScript = randomLockingScript()
+	err = tx.Verify(ctx)
+	verifyErrs, ok = err.(VerifyErrors)
+	if !ok {
+		t.Fatalf("Wrong verify error : %v", err)
+	}
+
+	if len(verifyErrs) != 1 || verifyErrs[0].Index != 1 {
+		t.Fatalf("Wrong verify errors : %s", verifyErrs)
+	}
+	t.Logf("Wrong locking script : %s", verifyErrs)
+
+	if verifyErrs[0].OpCode != "OP_EQUALVERIFY" {
+		t.Fatalf("Wrong failed op code : got %s, want %s", verifyErrs[0].OpCode,
+			"OP_EQUALVERIFY")
+	}
+}